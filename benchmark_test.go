@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
 	"time"
@@ -30,6 +31,13 @@ func generateRandomValue(length int) string {
 func cleanup() {
 	os.Remove(testBtreePath)
 	os.Remove(testWalPath)
+	removePages(testBtreePath)
+	// WAL segments and checkpoint snapshots
+	files, _ := filepath.Glob(testWalPath + ".*")
+	snaps, _ := filepath.Glob(testBtreePath + ".snap-*")
+	for _, f := range append(files, snaps...) {
+		os.Remove(f)
+	}
 }
 
 func BenchmarkKVStoreCreation(b *testing.B) {
@@ -68,7 +76,7 @@ func BenchmarkKVStoreWrites(b *testing.B) {
 
 	for i := 0; i < numPairs; i++ {
 		key := "key" + strconv.Itoa(i)
-		kv.Set(key, values[i])
+		kv.Set([]byte(key), []byte(values[i]))
 	}
 
 	kv.flushCh <- struct{}{}
@@ -95,7 +103,7 @@ func BenchmarkKVStoreReads(b *testing.B) {
 
 	for i := 0; i < numPairs; i++ {
 		key := "key" + strconv.Itoa(i)
-		kv.Set(key, values[i])
+		kv.Set([]byte(key), []byte(values[i]))
 	}
 
 	kv.flushCh <- struct{}{}
@@ -106,7 +114,7 @@ func BenchmarkKVStoreReads(b *testing.B) {
 
 	for _, i := range readIndices {
 		key := "key" + strconv.Itoa(i)
-		_, found := kv.Get(key)
+		_, found := kv.Get([]byte(key))
 		if !found {
 			b.Fatalf("Key not found: %s", key)
 		}
@@ -142,13 +150,13 @@ func BenchmarkKVStoreTransactionWrites(b *testing.B) {
 	start := time.Now()
 
 	for batch := 0; batch < numBatches; batch++ {
-		kv.Begin()
+		tx := kv.Begin()
 		for i := 0; i < batchSize; i++ {
 			idx := batch*batchSize + i
 			key := "txkey" + strconv.Itoa(idx)
-			kv.Set(key, values[idx])
+			tx.Set([]byte(key), []byte(values[idx]))
 		}
-		kv.Commit()
+		tx.Commit()
 	}
 
 	elapsed := time.Since(start)
@@ -175,7 +183,7 @@ func BenchmarkKVStoreMixedWorkload(b *testing.B) {
 	halfPairs := numPairs / 2
 	for i := 0; i < halfPairs; i++ {
 		key := "key" + strconv.Itoa(i)
-		kv.Set(key, values[i])
+		kv.Set([]byte(key), []byte(values[i]))
 	}
 
 	kv.flushCh <- struct{}{}
@@ -188,14 +196,14 @@ func BenchmarkKVStoreMixedWorkload(b *testing.B) {
 		if i%2 == 0 {
 			readIdx := rand.Intn(halfPairs)
 			key := "key" + strconv.Itoa(readIdx)
-			_, found := kv.Get(key)
+			_, found := kv.Get([]byte(key))
 			if !found {
 				b.Fatalf("Key not found: %s", key)
 			}
 		} else {
 			writeIdx := halfPairs + (i / 2)
 			key := "key" + strconv.Itoa(writeIdx)
-			kv.Set(key, values[writeIdx])
+			kv.Set([]byte(key), []byte(values[writeIdx]))
 		}
 	}
 
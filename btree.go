@@ -1,75 +1,202 @@
 package main
 
 import (
-	"encoding/gob"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync/atomic"
 )
 
-// --- Minimal B-tree with splitting ---
+// --- Copy-on-write B-tree with splitting ---
+//
+// Published nodes are never modified. A write clones every node on its path
+// from the root (plus any sibling it borrows from or merges with), changes
+// the clones, and atomically publishes the new root. Readers load the root
+// once and see a consistent, immutable tree without taking a lock; a loaded
+// root stays valid for as long as it is referenced, which is what Snapshot
+// hands out. Writers must still be serialized by the caller.
+//
+// A BTreeBatch groups writes under one owner: nodes it has already cloned
+// are changed in place by its later writes, so a batch of N writes copies
+// each node at most once and publishes a single root.
 
-const btreeMinDegree = 16 
+const btreeMinDegree = 16
 
 type btreeNode struct {
 	leaf   bool
 	keys   []string
 	values []string
 	child  []*btreeNode
+	size   int         // keys in this subtree, for order-statistic queries
+	owner  *btreeOwner // batch allowed to modify this node in place
 }
 
+// btreeOwner identifies one batch; it is not zero-sized so every
+// allocation has a distinct address.
+type btreeOwner struct{ _ byte }
+
 type BTree struct {
-	root *btreeNode
+	root atomic.Pointer[btreeNode]
 }
 
 func NewBTree() *BTree {
-	return &BTree{root: &btreeNode{leaf: true}}
+	t := &BTree{}
+	t.root.Store(&btreeNode{leaf: true})
+	return t
+}
+
+// Snapshot returns a read-only view of the tree as it is now. Later writes
+// to t do not show through it.
+func (t *BTree) Snapshot() *BTree {
+	s := &BTree{}
+	s.root.Store(t.root.Load())
+	return s
+}
+
+// Reset empties the tree.
+func (t *BTree) Reset() {
+	t.root.Store(&btreeNode{leaf: true})
 }
 
 func (t *BTree) Insert(key, value []byte) {
-	skey := string(key)
-	sval := string(value)
-	root := t.root
+	b := t.NewBatch()
+	b.Insert(key, value)
+	b.Commit()
+}
+
+// BTreeBatch collects writes against a private copy of the tree and
+// publishes them together on Commit. Only one batch (or single Insert or
+// Delete) may be in progress on a tree at a time.
+type BTreeBatch struct {
+	t       *BTree
+	root    *btreeNode
+	owner   *btreeOwner
+	changed bool
+}
+
+// NewBatch starts a batch on top of the current root.
+func (t *BTree) NewBatch() *BTreeBatch {
+	return &BTreeBatch{t: t, root: t.root.Load(), owner: &btreeOwner{}}
+}
+
+func (b *BTreeBatch) Insert(key, value []byte) {
+	root := b.root.mutable(b.owner)
 	if len(root.keys) == 2*btreeMinDegree-1 {
-		newRoot := &btreeNode{leaf: false, child: []*btreeNode{root}}
-		splitChild(newRoot, 0)
-		t.root = newRoot
-		insertNonFull(newRoot, skey, sval)
-	} else {
-		insertNonFull(root, skey, sval)
+		newRoot := &btreeNode{leaf: false, child: []*btreeNode{root}, size: root.size, owner: b.owner}
+		splitChild(newRoot, 0, b.owner)
+		root = newRoot
+	}
+	insertNonFull(root, string(key), string(value), b.owner)
+	b.root = root
+	b.changed = true
+}
+
+// Delete removes key and reports whether it was present.
+func (b *BTreeBatch) Delete(key []byte) bool {
+	root := b.root.mutable(b.owner)
+	found := btreeDelete(root, string(key), b.owner)
+	// merges on the way down can empty the root even when key is missing
+	if len(root.keys) == 0 && !root.leaf {
+		root = root.child[0]
 	}
+	if !found && !b.changed {
+		// nothing removed; the clones made on the way are equivalent
+		return false
+	}
+	b.root = root
+	b.changed = true
+	return found
 }
 
-func insertNonFull(n *btreeNode, key, value string) {
-	i := len(n.keys) - 1
+// Commit publishes the batch's writes to readers atomically. The batch must
+// not be used afterwards.
+func (b *BTreeBatch) Commit() {
+	if b.changed {
+		b.t.root.Store(b.root)
+	}
+	b.owner = nil
+}
+
+// mutable returns n itself when owner already owns it, otherwise a private
+// copy owned by owner.
+func (n *btreeNode) mutable(owner *btreeOwner) *btreeNode {
+	if n.owner == owner {
+		return n
+	}
+	c := &btreeNode{leaf: n.leaf, size: n.size, owner: owner}
+	c.keys = append(make([]string, 0, len(n.keys)+1), n.keys...)
+	c.values = append(make([]string, 0, len(n.values)+1), n.values...)
+	if !n.leaf {
+		c.child = append(make([]*btreeNode, 0, len(n.child)+1), n.child...)
+	}
+	return c
+}
+
+// recount recomputes n.size from its keys and its children's sizes.
+func (n *btreeNode) recount() {
+	n.size = len(n.keys)
+	for _, c := range n.child {
+		n.size += c.size
+	}
+}
+
+// search returns the position of key in n.keys, or the index of the child
+// subtree that would hold it when the key is not stored in this node.
+func (n *btreeNode) search(key string) (int, bool) {
+	i := sort.SearchStrings(n.keys, key)
+	return i, i < len(n.keys) && n.keys[i] == key
+}
+
+// insertNonFull inserts into the subtree under the owned, non-full node n
+// and reports whether the key is new (false when a value was overwritten).
+func insertNonFull(n *btreeNode, key, value string, owner *btreeOwner) bool {
+	i, found := n.search(key)
+	if found {
+		// existing key: overwrite in place so the tree never holds duplicates
+		n.values[i] = value
+		return false
+	}
 	if n.leaf {
 		n.keys = append(n.keys, "")
 		n.values = append(n.values, "")
-		for i >= 0 && key < n.keys[i] {
-			n.keys[i+1] = n.keys[i]
-			n.values[i+1] = n.values[i]
-			i--
-		}
-		n.keys[i+1] = key
-		n.values[i+1] = value
-		return
+		copy(n.keys[i+1:], n.keys[i:])
+		copy(n.values[i+1:], n.values[i:])
+		n.keys[i] = key
+		n.values[i] = value
+		n.size++
+		return true
 	}
-	for i >= 0 && key < n.keys[i] {
-		i--
-	}
-	i++
+	n.child[i] = n.child[i].mutable(owner)
 	if len(n.child[i].keys) == 2*btreeMinDegree-1 {
-		splitChild(n, i)
+		splitChild(n, i, owner)
+		if key == n.keys[i] {
+			n.values[i] = value
+			return false
+		}
 		if key > n.keys[i] {
 			i++
 		}
 	}
-	insertNonFull(n.child[i], key, value)
+	if !insertNonFull(n.child[i], key, value, owner) {
+		return false
+	}
+	n.size++
+	return true
 }
 
-func splitChild(parent *btreeNode, i int) {
+// splitChild splits the full child i of parent; both must be owned.
+func splitChild(parent *btreeNode, i int, owner *btreeOwner) {
 	t := btreeMinDegree
 	full := parent.child[i]
-	newNode := &btreeNode{leaf: full.leaf}
+	newNode := &btreeNode{leaf: full.leaf, owner: owner}
 	newNode.keys = append(newNode.keys, full.keys[t:]...)
 	newNode.values = append(newNode.values, full.values[t:]...)
 	if !full.leaf {
@@ -89,11 +216,55 @@ func splitChild(parent *btreeNode, i int) {
 	parent.keys[i] = midKey
 	parent.values[i] = midVal
 	parent.child[i+1] = newNode
+	full.recount()
+	newNode.recount()
+}
+
+// Entry is a single key/value pair returned by range queries.
+type Entry struct {
+	Key   []byte
+	Value []byte
+}
+
+// Scan returns the entries with start <= key < end in ascending key order.
+// An empty end means no upper bound and limit <= 0 means no limit.
+func (t *BTree) Scan(start, end []byte, limit int) []Entry {
+	var out []Entry
+	t.Ascend(start, end, func(k, v []byte) bool {
+		out = append(out, Entry{Key: k, Value: v})
+		return limit <= 0 || len(out) < limit
+	})
+	return out
+}
+
+// Ascend calls fn for every key in [start, end) in ascending order until fn
+// returns false. An empty end means no upper bound.
+func (t *BTree) Ascend(start, end []byte, fn func(key, value []byte) bool) {
+	btreeAscend(t.root.Load(), string(start), string(end), len(end) > 0, fn)
+}
+
+func btreeAscend(n *btreeNode, start, end string, bounded bool, fn func(k, v []byte) bool) bool {
+	i, _ := n.search(start)
+	for ; i < len(n.keys); i++ {
+		if !n.leaf && !btreeAscend(n.child[i], start, end, bounded, fn) {
+			return false
+		}
+		if bounded && n.keys[i] >= end {
+			return false
+		}
+		if !fn([]byte(n.keys[i]), []byte(n.values[i])) {
+			return false
+		}
+	}
+	if !n.leaf {
+		return btreeAscend(n.child[i], start, end, bounded, fn)
+	}
+	return true
 }
 
 func (t *BTree) Get(key []byte) ([]byte, bool) {
 	skey := string(key)
-	v, ok := btreeGet(t.root, skey)
+	v, ok := btreeGet(t.root.Load(), skey)
 	if !ok {
 		return nil, false
 	}
@@ -120,46 +291,437 @@ func btreeGet(n *btreeNode, key string) (string, bool) {
 	return "", false
 }
 
+// Delete removes key from the tree and reports whether it was present.
+// Nodes on the way down are topped up to at least btreeMinDegree keys
+// (borrowing from a sibling or merging with one) so the removal never
+// leaves a node underfull, and the root shrinks when it runs out of keys.
 func (t *BTree) Delete(key []byte) bool {
-	// not done now
-	return false
+	b := t.NewBatch()
+	found := b.Delete(key)
+	b.Commit()
+	return found
+}
+
+// btreeDelete removes key from the subtree under the owned node n.
+func btreeDelete(n *btreeNode, key string, owner *btreeOwner) bool {
+	t := btreeMinDegree
+	i, found := n.search(key)
+	if n.leaf {
+		if !found {
+			return false
+		}
+		n.keys = append(n.keys[:i], n.keys[i+1:]...)
+		n.values = append(n.values[:i], n.values[i+1:]...)
+		n.size--
+		return true
+	}
+	// restructuring below moves keys between children but not out of n
+	removed := false
+	if found {
+		left, right := n.child[i], n.child[i+1]
+		switch {
+		case len(left.keys) >= t:
+			// replace with predecessor, then delete it from the left subtree
+			pk, pv := btreeMax(left)
+			n.keys[i], n.values[i] = pk, pv
+			n.child[i] = left.mutable(owner)
+			removed = btreeDelete(n.child[i], pk, owner)
+		case len(right.keys) >= t:
+			// replace with successor, then delete it from the right subtree
+			sk, sv := btreeMin(right)
+			n.keys[i], n.values[i] = sk, sv
+			n.child[i+1] = right.mutable(owner)
+			removed = btreeDelete(n.child[i+1], sk, owner)
+		default:
+			mergeChildren(n, i, owner)
+			removed = btreeDelete(n.child[i], key, owner)
+		}
+	} else {
+		if len(n.child[i].keys) < t {
+			i = fillChild(n, i, owner)
+		} else {
+			n.child[i] = n.child[i].mutable(owner)
+		}
+		removed = btreeDelete(n.child[i], key, owner)
+	}
+	if removed {
+		n.size--
+	}
+	return removed
 }
 
+func btreeMin(n *btreeNode) (string, string) {
+	for !n.leaf {
+		n = n.child[0]
+	}
+	return n.keys[0], n.values[0]
+}
+
+func btreeMax(n *btreeNode) (string, string) {
+	for !n.leaf {
+		n = n.child[len(n.child)-1]
+	}
+	last := len(n.keys) - 1
+	return n.keys[last], n.values[last]
+}
+
+// fillChild makes sure parent.child[i] has at least btreeMinDegree keys and
+// returns the index of the child that now covers the original key range
+// (it moves one to the left when merged with its left sibling). That child
+// is always owned by owner.
+func fillChild(parent *btreeNode, i int, owner *btreeOwner) int {
+	t := btreeMinDegree
+	switch {
+	case i > 0 && len(parent.child[i-1].keys) >= t:
+		borrowFromLeft(parent, i, owner)
+	case i < len(parent.child)-1 && len(parent.child[i+1].keys) >= t:
+		borrowFromRight(parent, i, owner)
+	case i < len(parent.child)-1:
+		mergeChildren(parent, i, owner)
+	default:
+		mergeChildren(parent, i-1, owner)
+		i--
+	}
+	return i
+}
+
+// borrowFromLeft rotates the last key of the left sibling up into the parent
+// and the parent separator down into the front of child i.
+func borrowFromLeft(parent *btreeNode, i int, owner *btreeOwner) {
+	c, sib := parent.child[i].mutable(owner), parent.child[i-1].mutable(owner)
+	parent.child[i], parent.child[i-1] = c, sib
+	last := len(sib.keys) - 1
+
+	c.keys = append([]string{parent.keys[i-1]}, c.keys...)
+	c.values = append([]string{parent.values[i-1]}, c.values...)
+	parent.keys[i-1], parent.values[i-1] = sib.keys[last], sib.values[last]
+	sib.keys, sib.values = sib.keys[:last], sib.values[:last]
+
+	if !c.leaf {
+		lastChild := len(sib.child) - 1
+		c.child = append([]*btreeNode{sib.child[lastChild]}, c.child...)
+		sib.child = sib.child[:lastChild]
+	}
+	c.recount()
+	sib.recount()
+}
+
+// borrowFromRight rotates the first key of the right sibling up into the
+// parent and the parent separator down onto the end of child i.
+func borrowFromRight(parent *btreeNode, i int, owner *btreeOwner) {
+	c, sib := parent.child[i].mutable(owner), parent.child[i+1].mutable(owner)
+	parent.child[i], parent.child[i+1] = c, sib
+
+	c.keys = append(c.keys, parent.keys[i])
+	c.values = append(c.values, parent.values[i])
+	parent.keys[i], parent.values[i] = sib.keys[0], sib.values[0]
+	sib.keys, sib.values = sib.keys[1:], sib.values[1:]
+
+	if !c.leaf {
+		c.child = append(c.child, sib.child[0])
+		sib.child = sib.child[1:]
+	}
+	c.recount()
+	sib.recount()
+}
+
+// mergeChildren folds parent.keys[i] and parent.child[i+1] into
+// parent.child[i]; both children must hold btreeMinDegree-1 keys.
+func mergeChildren(parent *btreeNode, i int, owner *btreeOwner) {
+	c, sib := parent.child[i].mutable(owner), parent.child[i+1]
+	parent.child[i] = c
+
+	c.keys = append(c.keys, parent.keys[i])
+	c.values = append(c.values, parent.values[i])
+	c.keys = append(c.keys, sib.keys...)
+	c.values = append(c.values, sib.values...)
+	if !c.leaf {
+		c.child = append(c.child, sib.child...)
+	}
+	c.size += 1 + sib.size
+
+	parent.keys = append(parent.keys[:i], parent.keys[i+1:]...)
+	parent.values = append(parent.values[:i], parent.values[i+1:]...)
+	parent.child = append(parent.child[:i+1], parent.child[i+2:]...)
+}
+
+// --- Snapshot files ---
+//
+// A snapshot is the tree's entries in key order, so loading one is a bulk
+// load rather than a series of inserts. It is tagged with the log position
+// (LSN) it covers; 0 when it was not taken against a log.
+//
+//   "GODBSNP2" | lsn uint64
+//   0x01 | uvarint klen | key | uvarint vlen | value    (one per entry)
+//   0x00 | uvarint count | crc32 of every preceding byte (little endian)
+//
+// "GODBSNP1" files, which have no LSN, are still read.
+
+const (
+	snapshotMagic   = "GODBSNP2"
+	snapshotMagicV1 = "GODBSNP1"
+)
+
+var ErrBadSnapshot = errors.New("godb: snapshot file is truncated or corrupt")
+
+// SaveToFile writes a snapshot of the tree to filename atomically.
 func (t *BTree) SaveToFile(filename string) error {
-	f, err := os.Create(filename)
+	return t.SaveSnapshot(filename, 0)
+}
+
+// SaveSnapshot writes a snapshot tagged with lsn to filename atomically.
+func (t *BTree) SaveSnapshot(filename string, lsn uint64) error {
+	return writeFileAtomic(filename, func(w io.Writer) error {
+		return t.WriteSnapshot(w, lsn)
+	})
+}
+
+// writeFileAtomic creates filename with what write writes: it goes to a
+// temporary file that is fsynced and then renamed into place.
+func writeFileAtomic(filename string, write func(io.Writer) error) error {
+	tmp := filename + ".tmp"
+	f, err := os.Create(tmp)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	enc := gob.NewEncoder(f)
-	return enc.Encode(t.root)
+	if err := write(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return err
+	}
+	return syncDir(filename)
+}
+
+// WriteSnapshot streams the tree's current contents to w, tagged with lsn.
+func (t *BTree) WriteSnapshot(w io.Writer, lsn uint64) error {
+	return writeSnapshot(w, lsn, func(emit func(k, v []byte)) error {
+		t.Ascend(nil, nil, func(k, v []byte) bool {
+			emit(k, v)
+			return true
+		})
+		return nil
+	})
+}
+
+// writeSnapshot streams a snapshot tagged with lsn to w. ascend must emit
+// the entries in key order.
+func writeSnapshot(w io.Writer, lsn uint64, ascend func(emit func(k, v []byte)) error) error {
+	crc := crc32.NewIEEE()
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+	var hdr [1 + 2*binary.MaxVarintLen64]byte
+	count := uint64(0)
+	bw.WriteString(snapshotMagic)
+	bw.Write(binary.LittleEndian.AppendUint64(nil, lsn))
+	err := ascend(func(k, v []byte) {
+		hdr[0] = 1
+		n := 1 + binary.PutUvarint(hdr[1:], uint64(len(k)))
+		bw.Write(hdr[:n])
+		bw.Write(k)
+		n = binary.PutUvarint(hdr[:], uint64(len(v)))
+		bw.Write(hdr[:n])
+		bw.Write(v)
+		count++
+	})
+	if err != nil {
+		return err
+	}
+	hdr[0] = 0
+	n := 1 + binary.PutUvarint(hdr[1:], count)
+	bw.Write(hdr[:n])
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], crc.Sum32())
+	_, err = w.Write(sum[:])
+	return err
 }
 
+// LoadFromFile replaces the tree's contents with the snapshot in filename.
+// The tree is left untouched if the file fails its checksum.
 func (t *BTree) LoadFromFile(filename string) error {
+	_, err := t.LoadSnapshot(filename)
+	return err
+}
+
+// LoadSnapshot is LoadFromFile that also returns the snapshot's LSN.
+func (t *BTree) LoadSnapshot(filename string) (uint64, error) {
 	f, err := os.Open(filename)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer f.Close()
-	dec := gob.NewDecoder(f)
-	root := &btreeNode{}
-	if err := dec.Decode(root); err != nil {
+	return t.ReadSnapshot(f)
+}
+
+// ReadSnapshot replaces the tree's contents with a snapshot read from r and
+// returns the LSN it is tagged with.
+func (t *BTree) ReadSnapshot(r io.Reader) (uint64, error) {
+	d, err := newSnapshotDecoder(r)
+	if err != nil {
+		return 0, err
+	}
+	loaded := NewBTree()
+	if err := loaded.BulkLoad(d.next, DefaultFillFactor); err != nil {
+		return 0, ErrBadSnapshot
+	}
+	if err := d.finish(); err != nil {
+		return 0, err
+	}
+	t.root.Store(loaded.root.Load())
+	return d.lsn, nil
+}
+
+// snapshotDecoder reads a snapshot's entries one at a time. Nothing read is
+// known to be intact until finish has checked the count and checksum.
+type snapshotDecoder struct {
+	sr    *snapshotReader
+	lsn   uint64
+	count uint64
+	prev  []byte
+	err   error
+}
+
+func newSnapshotDecoder(r io.Reader) (*snapshotDecoder, error) {
+	sr := &snapshotReader{br: bufio.NewReader(r), crc: crc32.NewIEEE()}
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(sr, magic); err != nil {
+		return nil, ErrBadSnapshot
+	}
+	d := &snapshotDecoder{sr: sr}
+	switch string(magic) {
+	case snapshotMagic:
+		var buf [8]byte
+		if _, err := io.ReadFull(sr, buf[:]); err != nil {
+			return nil, ErrBadSnapshot
+		}
+		d.lsn = binary.LittleEndian.Uint64(buf[:])
+	case snapshotMagicV1:
+	default:
+		return nil, ErrBadSnapshot
+	}
+	return d, nil
+}
+
+// next returns the next entry, or false at the end of the entries or on
+// damage, which finish then reports.
+func (d *snapshotDecoder) next() ([]byte, []byte, bool) {
+	if d.err != nil {
+		return nil, nil, false
+	}
+	tag, err := d.sr.ReadByte()
+	if err == nil && tag == 0 {
+		return nil, nil, false
+	}
+	if err == nil && tag != 1 {
+		err = ErrBadSnapshot
+	}
+	var k, v []byte
+	if err == nil {
+		k, err = readUvarintBytes(d.sr)
+	}
+	if err == nil {
+		v, err = readUvarintBytes(d.sr)
+	}
+	if err == nil && d.count > 0 && bytes.Compare(d.prev, k) >= 0 {
+		err = ErrBadSnapshot // out-of-order keys are corruption too
+	}
+	if err != nil {
+		d.err = err
+		return nil, nil, false
+	}
+	d.count++
+	d.prev = k
+	return k, v, true
+}
+
+// finish checks the entry count and checksum once next has returned false.
+func (d *snapshotDecoder) finish() error {
+	if d.err != nil {
+		return ErrBadSnapshot
+	}
+	if want, err := binary.ReadUvarint(d.sr); err != nil || want != d.count {
+		return ErrBadSnapshot
+	}
+	sum := d.sr.crc.Sum32()
+	var trailer [4]byte
+	if _, err := io.ReadFull(d.sr.br, trailer[:]); err != nil ||
+		binary.LittleEndian.Uint32(trailer[:]) != sum {
+		return ErrBadSnapshot
+	}
+	return nil
+}
+
+// snapshotReader checksums exactly the bytes the decoder consumes, which
+// a TeeReader under a bufio.Reader would not.
+type snapshotReader struct {
+	br  *bufio.Reader
+	crc hash.Hash32
+}
+
+func (r *snapshotReader) Read(p []byte) (int, error) {
+	n, err := r.br.Read(p)
+	r.crc.Write(p[:n])
+	return n, err
+}
+
+func (r *snapshotReader) ReadByte() (byte, error) {
+	b, err := r.br.ReadByte()
+	if err == nil {
+		r.crc.Write([]byte{b})
+	}
+	return b, err
+}
+
+func readUvarintBytes(r *snapshotReader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > 1<<30 {
+		return nil, ErrBadSnapshot
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// syncDir fsyncs the directory holding path so a rename into it survives a
+// crash.
+func syncDir(path string) error {
+	d, err := os.Open(filepath.Dir(path))
+	if err != nil {
 		return err
 	}
-	t.root = root
+	defer d.Close()
+	d.Sync() // best effort: not every platform can fsync a directory
 	return nil
 }
 
 func (t *BTree) DebugPrint() {
-	// fmt.Println("BTree dump:") 
-	btreeDebugPrint(t.root, 0)
+	// fmt.Println("BTree dump:")
+	btreeDebugPrint(t.root.Load(), 0)
 }
 
 func btreeDebugPrint(n *btreeNode, level int) {
 	if n == nil {
 		return
 	}
-	// fmt.Printf("%sKeys: %v\n", indent(level), n.keys) 
+	// fmt.Printf("%sKeys: %v\n", indent(level), n.keys)
 	if !n.leaf {
 		for _, c := range n.child {
 			btreeDebugPrint(c, level+1)
@@ -170,4 +732,3 @@ func btreeDebugPrint(n *btreeNode, level int) {
 func indent(n int) string {
 	return strings.Repeat("  ", n)
 }
-
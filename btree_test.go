@@ -0,0 +1,393 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// checkBTree walks the whole tree and fails the test if any B-tree invariant
+// is broken: sorted keys within bounds, node occupancy, child counts and
+// uniform leaf depth and subtree sizes. It returns the number of keys found.
+func checkBTree(t *testing.T, tree *BTree) int {
+	t.Helper()
+	root := tree.root.Load()
+	leafDepth := -1
+	var walk func(n *btreeNode, depth int, lo, hi *string) int
+	walk = func(n *btreeNode, depth int, lo, hi *string) int {
+		if len(n.keys) != len(n.values) {
+			t.Fatalf("node has %d keys but %d values", len(n.keys), len(n.values))
+		}
+		if n == root && !n.leaf && len(n.keys) == 0 {
+			t.Fatal("internal root without keys")
+		}
+		if n != root && len(n.keys) < btreeMinDegree-1 {
+			t.Fatalf("underfull node: %d keys", len(n.keys))
+		}
+		if len(n.keys) > 2*btreeMinDegree-1 {
+			t.Fatalf("overfull node: %d keys", len(n.keys))
+		}
+		for i, k := range n.keys {
+			if i > 0 && n.keys[i-1] >= k {
+				t.Fatalf("keys out of order: %q >= %q", n.keys[i-1], k)
+			}
+			if (lo != nil && k <= *lo) || (hi != nil && k >= *hi) {
+				t.Fatalf("key %q outside separator bounds", k)
+			}
+		}
+		if n.leaf {
+			if len(n.child) != 0 {
+				t.Fatalf("leaf has %d children", len(n.child))
+			}
+			if leafDepth == -1 {
+				leafDepth = depth
+			} else if leafDepth != depth {
+				t.Fatalf("leaves at depth %d and %d", leafDepth, depth)
+			}
+			if n.size != len(n.keys) {
+				t.Fatalf("leaf with %d keys records size %d", len(n.keys), n.size)
+			}
+			return len(n.keys)
+		}
+		if len(n.child) != len(n.keys)+1 {
+			t.Fatalf("internal node has %d keys but %d children", len(n.keys), len(n.child))
+		}
+		count := len(n.keys)
+		for i, c := range n.child {
+			clo, chi := lo, hi
+			if i > 0 {
+				clo = &n.keys[i-1]
+			}
+			if i < len(n.keys) {
+				chi = &n.keys[i]
+			}
+			count += walk(c, depth+1, clo, chi)
+		}
+		if n.size != count {
+			t.Fatalf("subtree with %d keys records size %d", count, n.size)
+		}
+		return count
+	}
+	return walk(root, 0, nil, nil)
+}
+
+func TestBTreeInsertOverwrites(t *testing.T) {
+	tree := NewBTree()
+	for i := 0; i < 1000; i++ {
+		tree.Insert([]byte(fmt.Sprintf("k%04d", i%100)), []byte(fmt.Sprint(i)))
+	}
+	if n := checkBTree(t, tree); n != 100 {
+		t.Fatalf("expected 100 keys, got %d", n)
+	}
+	v, ok := tree.Get([]byte("k0042"))
+	if !ok || string(v) != "942" {
+		t.Fatalf("Get(k0042) = %q, %v; want \"942\", true", v, ok)
+	}
+}
+
+func TestBTreeDelete(t *testing.T) {
+	tree := NewBTree()
+	if tree.Delete([]byte("missing")) {
+		t.Fatal("Delete on empty tree reported a key")
+	}
+	for i := 0; i < 5000; i++ {
+		tree.Insert([]byte(fmt.Sprintf("k%05d", i)), []byte("v"))
+	}
+	for i := 0; i < 5000; i += 2 {
+		if !tree.Delete([]byte(fmt.Sprintf("k%05d", i))) {
+			t.Fatalf("Delete(k%05d) = false", i)
+		}
+	}
+	if n := checkBTree(t, tree); n != 2500 {
+		t.Fatalf("expected 2500 keys, got %d", n)
+	}
+	for i := 0; i < 5000; i++ {
+		_, ok := tree.Get([]byte(fmt.Sprintf("k%05d", i)))
+		if ok != (i%2 == 1) {
+			t.Fatalf("Get(k%05d) found = %v", i, ok)
+		}
+	}
+	for i := 1; i < 5000; i += 2 {
+		tree.Delete([]byte(fmt.Sprintf("k%05d", i)))
+	}
+	if n := checkBTree(t, tree); n != 0 {
+		t.Fatalf("expected empty tree, got %d keys", n)
+	}
+	if !tree.root.Load().leaf {
+		t.Fatal("root of empty tree is not a leaf")
+	}
+}
+
+func TestBTreeRandomInsertDelete(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	tree := NewBTree()
+	model := make(map[string]string)
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 2000; i++ {
+			k := fmt.Sprintf("key%d", rng.Intn(4000))
+			if rng.Intn(3) == 0 {
+				_, want := model[k]
+				if got := tree.Delete([]byte(k)); got != want {
+					t.Fatalf("Delete(%q) = %v, want %v", k, got, want)
+				}
+				delete(model, k)
+			} else {
+				v := fmt.Sprint(rng.Int())
+				tree.Insert([]byte(k), []byte(v))
+				model[k] = v
+			}
+		}
+		if n := checkBTree(t, tree); n != len(model) {
+			t.Fatalf("round %d: tree holds %d keys, model %d", round, n, len(model))
+		}
+		for k, want := range model {
+			got, ok := tree.Get([]byte(k))
+			if !ok || string(got) != want {
+				t.Fatalf("Get(%q) = %q, %v; want %q", k, got, ok, want)
+			}
+		}
+	}
+}
+
+func TestBTreeScan(t *testing.T) {
+	tree := NewBTree()
+	for i := 0; i < 1000; i++ {
+		tree.Insert([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprint(i)))
+	}
+	got := tree.Scan([]byte("k0100"), []byte("k0200"), 0)
+	if len(got) != 100 {
+		t.Fatalf("Scan returned %d entries, want 100", len(got))
+	}
+	for i, e := range got {
+		if want := fmt.Sprintf("k%04d", 100+i); string(e.Key) != want {
+			t.Fatalf("entry %d = %q, want %q", i, e.Key, want)
+		}
+	}
+	if got := tree.Scan([]byte("k0990"), nil, 0); len(got) != 10 {
+		t.Fatalf("open-ended Scan returned %d entries, want 10", len(got))
+	}
+	if got := tree.Scan([]byte("k00055"), nil, 2); len(got) != 2 || string(got[0].Key) != "k0006" {
+		t.Fatalf("limited Scan = %v", got)
+	}
+}
+
+func TestCursorWalk(t *testing.T) {
+	tree := NewBTree()
+	c := tree.NewCursor()
+	if c.First() || c.Last() || c.Seek([]byte("a")) {
+		t.Fatal("cursor on empty tree is valid")
+	}
+	const n = 3000
+	for i := 0; i < n; i++ {
+		tree.Insert([]byte(fmt.Sprintf("k%05d", i*2)), []byte(fmt.Sprint(i)))
+	}
+
+	count := 0
+	for ok := c.First(); ok; ok = c.Next() {
+		if want := fmt.Sprintf("k%05d", count*2); string(c.Key()) != want {
+			t.Fatalf("forward step %d at %q, want %q", count, c.Key(), want)
+		}
+		count++
+	}
+	if count != n {
+		t.Fatalf("forward walk saw %d keys, want %d", count, n)
+	}
+	count = 0
+	for ok := c.Last(); ok; ok = c.Prev() {
+		if want := fmt.Sprintf("k%05d", (n-1-count)*2); string(c.Key()) != want {
+			t.Fatalf("backward step %d at %q, want %q", count, c.Key(), want)
+		}
+		count++
+	}
+	if count != n {
+		t.Fatalf("backward walk saw %d keys, want %d", count, n)
+	}
+
+	if !c.Seek([]byte("k00101")) || string(c.Key()) != "k00102" {
+		t.Fatalf("Seek(k00101) at %q", c.Key())
+	}
+	if !c.Prev() || string(c.Key()) != "k00100" {
+		t.Fatalf("Prev after Seek at %q", c.Key())
+	}
+	if !c.Next() || !c.Next() || string(c.Key()) != "k00104" {
+		t.Fatalf("Next after Prev at %q", c.Key())
+	}
+	if c.Seek([]byte("z")) {
+		t.Fatal("Seek past the end is valid")
+	}
+}
+
+func TestCursorReseeksAfterWrites(t *testing.T) {
+	tree := NewBTree()
+	for i := 0; i < 2000; i++ {
+		tree.Insert([]byte(fmt.Sprintf("k%05d", i)), []byte("v"))
+	}
+	c := tree.NewCursor()
+	if !c.Seek([]byte("k01000")) {
+		t.Fatal("Seek failed")
+	}
+	// delete the current key and its neighbours, add a key just after it
+	for i := 990; i <= 1005; i++ {
+		tree.Delete([]byte(fmt.Sprintf("k%05d", i)))
+	}
+	tree.Insert([]byte("k01000a"), []byte("new"))
+	if !c.Next() || string(c.Key()) != "k01000a" {
+		t.Fatalf("Next after writes at %q, want k01000a", c.Key())
+	}
+	if !c.Next() || string(c.Key()) != "k01006" {
+		t.Fatalf("second Next at %q, want k01006", c.Key())
+	}
+	tree.Delete([]byte("k01000a"))
+	if !c.Prev() || string(c.Key()) != "k00989" {
+		t.Fatalf("Prev after writes at %q, want k00989", c.Key())
+	}
+}
+
+func TestBTreeSnapshotIsUnaffectedByWrites(t *testing.T) {
+	tree := NewBTree()
+	for i := 0; i < 3000; i++ {
+		tree.Insert([]byte(fmt.Sprintf("k%05d", i)), []byte("v1"))
+	}
+	snap := tree.Snapshot()
+	for i := 0; i < 3000; i += 2 {
+		tree.Delete([]byte(fmt.Sprintf("k%05d", i)))
+	}
+	for i := 1; i < 3000; i += 2 {
+		tree.Insert([]byte(fmt.Sprintf("k%05d", i)), []byte("v2"))
+	}
+	tree.Insert([]byte("new"), []byte("v2"))
+
+	if n := checkBTree(t, snap); n != 3000 {
+		t.Fatalf("snapshot holds %d keys, want 3000", n)
+	}
+	for _, e := range snap.Scan(nil, nil, 0) {
+		if string(e.Value) != "v1" {
+			t.Fatalf("snapshot sees %q = %q", e.Key, e.Value)
+		}
+	}
+	if n := checkBTree(t, tree); n != 1501 {
+		t.Fatalf("tree holds %d keys, want 1501", n)
+	}
+}
+
+func TestBTreeLockFreeReaders(t *testing.T) {
+	tree := NewBTree()
+	const n = 20000
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			tree.Insert([]byte(fmt.Sprintf("k%06d", i)), []byte("v"))
+		}
+	}()
+	// keys are published in order, so every read must see a prefix
+	for reading := true; reading; {
+		select {
+		case <-done:
+			reading = false
+		default:
+		}
+		entries := tree.Scan(nil, nil, 0)
+		for i, e := range entries {
+			if want := fmt.Sprintf("k%06d", i); string(e.Key) != want {
+				t.Fatalf("reader saw %q at %d, want %q", e.Key, i, want)
+			}
+		}
+		if len(entries) > 0 {
+			if _, ok := tree.Get(entries[len(entries)-1].Key); !ok {
+				t.Fatal("Get lost a key a Scan already returned")
+			}
+		}
+	}
+	if got := len(tree.Scan(nil, nil, 0)); got != n {
+		t.Fatalf("final tree has %d keys, want %d", got, n)
+	}
+}
+
+func TestBTreeBatchPublishesOnCommit(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	tree := NewBTree()
+	model := make(map[string]bool)
+	for round := 0; round < 20; round++ {
+		before := checkBTree(t, tree)
+		b := tree.NewBatch()
+		for i := 0; i < 500; i++ {
+			k := fmt.Sprintf("key%d", rng.Intn(3000))
+			if rng.Intn(3) == 0 {
+				if got := b.Delete([]byte(k)); got != model[k] {
+					t.Fatalf("batch Delete(%q) = %v, want %v", k, got, model[k])
+				}
+				delete(model, k)
+			} else {
+				b.Insert([]byte(k), []byte("v"))
+				model[k] = true
+			}
+		}
+		if n := checkBTree(t, tree); n != before {
+			t.Fatalf("uncommitted batch visible: %d keys, was %d", n, before)
+		}
+		b.Commit()
+		if n := checkBTree(t, tree); n != len(model) {
+			t.Fatalf("round %d: tree holds %d keys, model %d", round, n, len(model))
+		}
+	}
+}
+
+func TestBTreeBatchShrinksRootOnMissingDelete(t *testing.T) {
+	// a root with one key over two minimal children
+	tree := NewBTree()
+	for i := 0; i < 2*btreeMinDegree; i++ {
+		tree.Insert([]byte(fmt.Sprintf("k%04d", i)), []byte("v"))
+	}
+	tree.Delete([]byte("k0031"))
+	if root := tree.root.Load(); len(root.keys) != 1 || len(root.child[0].keys) != btreeMinDegree-1 || len(root.child[1].keys) != btreeMinDegree-1 {
+		t.Fatal("unexpected tree shape")
+	}
+
+	// the missing key's descent merges the children into the root
+	b := tree.NewBatch()
+	b.Insert([]byte("k9999"), []byte("v"))
+	b.Delete([]byte("k9999"))
+	if b.Delete([]byte("k9998")) {
+		t.Fatal("Delete(k9998) = true")
+	}
+	b.Commit()
+	if n := checkBTree(t, tree); n != 2*btreeMinDegree-1 {
+		t.Fatalf("tree holds %d keys", n)
+	}
+}
+
+func TestBTreeSnapshotFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree.snap")
+	tree := NewBTree()
+	for i := 0; i < 5000; i++ {
+		tree.Insert([]byte(fmt.Sprintf("k%05d", i)), []byte(fmt.Sprint(i)))
+	}
+	tree.Insert([]byte("empty"), nil)
+	if err := tree.SaveToFile(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewBTree()
+	if err := loaded.LoadFromFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if n := checkBTree(t, loaded); n != 5001 {
+		t.Fatalf("loaded %d keys, want 5001", n)
+	}
+	if v, ok := loaded.Get([]byte("k04321")); !ok || string(v) != "4321" {
+		t.Fatalf("Get(k04321) = %q, %v", v, ok)
+	}
+
+	// any flipped byte fails the checksum and leaves the tree alone
+	data, _ := os.ReadFile(path)
+	data[len(data)/2] ^= 0x40
+	os.WriteFile(path, data, 0644)
+	if err := loaded.LoadFromFile(path); err != ErrBadSnapshot {
+		t.Fatalf("corrupt snapshot: err = %v", err)
+	}
+	if n := checkBTree(t, loaded); n != 5001 {
+		t.Fatalf("tree changed by failed load: %d keys", n)
+	}
+}
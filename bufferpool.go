@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"sort"
+)
+
+// --- Buffer pool ---
+//
+// A fixed number of page frames shared by every page the B+tree touches.
+// Pages are pinned while in use and only unpinned frames can be evicted.
+// The victim is chosen with the CLOCK algorithm: each access sets a frame's
+// reference bit and the clock hand clears bits until it finds a frame whose
+// bit is already clear.
+//
+// A dirty frame remembers the newest log record (LSN) that changed it. The
+// write-ahead rule is enforced on every write-back: the pool asks the log to
+// be durable through that LSN before the page goes to disk, and a full flush
+// writes pages in LSN order.
+
+const defaultPoolBytes = 8 << 20
+
+var ErrPoolExhausted = errors.New("godb: every buffer pool frame is pinned")
+
+// PoolStats is a snapshot of buffer pool counters.
+type PoolStats struct {
+	Frames     int
+	Used       int
+	Dirty      int
+	Pinned     int
+	Hits       uint64
+	Misses     uint64
+	Evictions  uint64
+	WriteBacks uint64
+}
+
+// HitRate returns the fraction of page requests served from memory.
+func (s PoolStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+type frame struct {
+	id    uint32
+	data  []byte
+	used  bool
+	pins  int
+	ref   bool
+	dirty bool
+	lsn   uint64
+}
+
+type bufferPool struct {
+	frames []frame
+	table  map[uint32]int // page id -> frame index
+	hand   int
+
+	// load fills buf with page id from disk; store writes it back
+	load  func(id uint32, buf []byte) error
+	store func(id uint32, buf []byte) error
+	// flushWAL makes the log durable through lsn; nil when there is no log
+	flushWAL func(lsn uint64) error
+
+	hits, misses, evictions, writeBacks uint64
+}
+
+func newBufferPool(bytes int) *bufferPool {
+	n := bytes / pageSize
+	if n < 8 {
+		n = 8
+	}
+	bp := &bufferPool{
+		frames: make([]frame, n),
+		table:  make(map[uint32]int, n),
+	}
+	for i := range bp.frames {
+		bp.frames[i].data = make([]byte, pageSize)
+	}
+	return bp
+}
+
+// pin returns the frame holding page id, reading it from disk on a miss.
+// The caller must unpin it.
+func (bp *bufferPool) pin(id uint32) (*frame, error) {
+	if i, ok := bp.table[id]; ok {
+		bp.hits++
+		f := &bp.frames[i]
+		f.pins++
+		f.ref = true
+		return f, nil
+	}
+	bp.misses++
+	i, err := bp.victim()
+	if err != nil {
+		return nil, err
+	}
+	if err := bp.load(id, bp.frames[i].data); err != nil {
+		return nil, err
+	}
+	return bp.install(i, id), nil
+}
+
+// pinNew returns a frame for page id without reading it, for callers that
+// are about to overwrite the whole page.
+func (bp *bufferPool) pinNew(id uint32) (*frame, error) {
+	if i, ok := bp.table[id]; ok {
+		f := &bp.frames[i]
+		f.pins++
+		f.ref = true
+		return f, nil
+	}
+	i, err := bp.victim()
+	if err != nil {
+		return nil, err
+	}
+	return bp.install(i, id), nil
+}
+
+// unpin releases a pin, marking the page dirty with the LSN that changed it.
+func (bp *bufferPool) unpin(f *frame, dirty bool, lsn uint64) {
+	f.pins--
+	if dirty {
+		f.dirty = true
+		if lsn > f.lsn {
+			f.lsn = lsn
+		}
+	}
+}
+
+// install assigns frame i to page id, pinned once.
+func (bp *bufferPool) install(i int, id uint32) *frame {
+	f := &bp.frames[i]
+	*f = frame{id: id, data: f.data, used: true, pins: 1, ref: true}
+	bp.table[id] = i
+	return f
+}
+
+// victim finds a free frame or evicts one, writing it back if dirty, and
+// returns its index.
+func (bp *bufferPool) victim() (int, error) {
+	for sweep := 0; sweep < 2*len(bp.frames)+1; sweep++ {
+		i := bp.hand
+		f := &bp.frames[i]
+		bp.hand = (bp.hand + 1) % len(bp.frames)
+		if !f.used {
+			return i, nil
+		}
+		if f.pins > 0 {
+			continue
+		}
+		if f.ref {
+			f.ref = false
+			continue
+		}
+		if f.dirty {
+			if err := bp.writeBack(f); err != nil {
+				return 0, err
+			}
+		}
+		bp.evictions++
+		delete(bp.table, f.id)
+		f.used = false
+		return i, nil
+	}
+	return 0, ErrPoolExhausted
+}
+
+func (bp *bufferPool) writeBack(f *frame) error {
+	if bp.flushWAL != nil {
+		if err := bp.flushWAL(f.lsn); err != nil {
+			return err
+		}
+	}
+	if err := bp.store(f.id, f.data); err != nil {
+		return err
+	}
+	bp.writeBacks++
+	f.dirty = false
+	return nil
+}
+
+// dirtyFrames returns the dirty frames ordered by LSN.
+func (bp *bufferPool) dirtyFrames() []*frame {
+	var out []*frame
+	for i := range bp.frames {
+		if f := &bp.frames[i]; f.used && f.dirty {
+			out = append(out, f)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].lsn < out[j].lsn })
+	return out
+}
+
+// flushAll writes every dirty page back in LSN order.
+func (bp *bufferPool) flushAll() error {
+	dirty := bp.dirtyFrames()
+	if len(dirty) == 0 {
+		return nil
+	}
+	if bp.flushWAL != nil {
+		if err := bp.flushWAL(dirty[len(dirty)-1].lsn); err != nil {
+			return err
+		}
+	}
+	for _, f := range dirty {
+		if err := bp.store(f.id, f.data); err != nil {
+			return err
+		}
+		bp.writeBacks++
+		f.dirty = false
+	}
+	return nil
+}
+
+// discard drops every cached page without writing anything back.
+func (bp *bufferPool) discard() {
+	for i := range bp.frames {
+		bp.frames[i] = frame{data: bp.frames[i].data}
+	}
+	bp.table = make(map[uint32]int, len(bp.frames))
+}
+
+func (bp *bufferPool) stats() PoolStats {
+	s := PoolStats{
+		Frames:     len(bp.frames),
+		Hits:       bp.hits,
+		Misses:     bp.misses,
+		Evictions:  bp.evictions,
+		WriteBacks: bp.writeBacks,
+	}
+	for i := range bp.frames {
+		f := &bp.frames[i]
+		if !f.used {
+			continue
+		}
+		s.Used++
+		if f.dirty {
+			s.Dirty++
+		}
+		if f.pins > 0 {
+			s.Pinned++
+		}
+	}
+	return s
+}
@@ -0,0 +1,99 @@
+package main
+
+import "errors"
+
+// --- Bulk loading ---
+//
+// BulkLoad builds a tree bottom-up from entries that are already sorted
+// instead of inserting them one by one. Each level is cut into nodes of the
+// requested fill, with one entry between neighbouring nodes moving up as
+// their separator, so there are no splits and every node is packed evenly.
+
+// ErrUnsorted is returned by BulkLoad when keys are not strictly ascending.
+var ErrUnsorted = errors.New("godb: bulk load keys are not strictly ascending")
+
+// DefaultFillFactor leaves a little room in each node so the first inserts
+// after a load do not immediately split everything.
+const DefaultFillFactor = 0.9
+
+// BulkLoad replaces the contents of t with the entries produced by next,
+// which must yield keys in strictly ascending order until it returns
+// ok == false. fill is the fraction of each node's capacity to use; it is
+// clamped so every node stays within B-tree occupancy bounds, and fill <= 0
+// selects DefaultFillFactor. The new tree
+// is published in one step, and t is left unchanged on error.
+func (t *BTree) BulkLoad(next func() (key, value []byte, ok bool), fill float64) error {
+	var keys, values []string
+	for {
+		k, v, ok := next()
+		if !ok {
+			break
+		}
+		key := string(k)
+		if len(keys) > 0 && key <= keys[len(keys)-1] {
+			return ErrUnsorted
+		}
+		keys = append(keys, key)
+		values = append(values, string(v))
+	}
+	t.root.Store(buildBTree(keys, values, fill))
+	return nil
+}
+
+func buildBTree(keys, values []string, fill float64) *btreeNode {
+	if fill <= 0 {
+		fill = DefaultFillFactor
+	}
+	per := int(fill*float64(2*btreeMinDegree-1) + 0.5)
+	per = max(btreeMinDegree-1, min(per, 2*btreeMinDegree-1))
+
+	var children []*btreeNode // nil at the leaf level
+	for {
+		nodes, upKeys, upValues := packLevel(keys, values, children, per)
+		if len(nodes) == 1 {
+			return nodes[0]
+		}
+		keys, values, children = upKeys, upValues, nodes
+	}
+}
+
+// packLevel cuts one level into nodes of about per keys each. children,
+// when not nil, has one more element than keys and is split along with
+// them. It returns the nodes and the separators to place above them.
+func packLevel(keys, values []string, children []*btreeNode, per int) ([]*btreeNode, []string, []string) {
+	n := len(keys)
+	t := btreeMinDegree
+	// k nodes hold n-(k-1) keys between them; stay within [t-1, 2t-1] each
+	k := (n + 1 + per) / (per + 1)
+	k = max(1, min(k, (n+1)/t))
+	if n <= 2*t-1 {
+		k = 1
+	}
+
+	nodes := make([]*btreeNode, 0, k)
+	var upKeys, upValues []string
+	base, extra := (n-(k-1))/k, (n-(k-1))%k
+	pos, cpos := 0, 0
+	for i := 0; i < k; i++ {
+		size := base
+		if i < extra {
+			size++
+		}
+		node := &btreeNode{leaf: children == nil}
+		node.keys = append(make([]string, 0, size+1), keys[pos:pos+size]...)
+		node.values = append(make([]string, 0, size+1), values[pos:pos+size]...)
+		if children != nil {
+			node.child = append(make([]*btreeNode, 0, size+2), children[cpos:cpos+size+1]...)
+			cpos += size + 1
+		}
+		pos += size
+		node.recount()
+		nodes = append(nodes, node)
+		if i < k-1 {
+			upKeys = append(upKeys, keys[pos])
+			upValues = append(upValues, values[pos])
+			pos++
+		}
+	}
+	return nodes, upKeys, upValues
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func sortedSource(n int) func() ([]byte, []byte, bool) {
+	i := 0
+	return func() ([]byte, []byte, bool) {
+		if i >= n {
+			return nil, nil, false
+		}
+		i++
+		return []byte(fmt.Sprintf("key%06d", i-1)), []byte(fmt.Sprint(i - 1)), true
+	}
+}
+
+func TestBulkLoadInvariants(t *testing.T) {
+	for _, fill := range []float64{0, 0.1, 0.5, 0.9, 1} {
+		for _, n := range []int{0, 1, 15, 31, 32, 33, 500, 1023, 1024, 20000} {
+			tree := NewBTree()
+			if err := tree.BulkLoad(sortedSource(n), fill); err != nil {
+				t.Fatalf("fill %v n %d: %v", fill, n, err)
+			}
+			if got := checkBTree(t, tree); got != n {
+				t.Fatalf("fill %v: loaded %d keys, tree has %d", fill, n, got)
+			}
+			for _, i := range []int{0, n / 2, n - 1} {
+				if i < 0 || i >= n {
+					continue
+				}
+				v, ok := tree.Get([]byte(fmt.Sprintf("key%06d", i)))
+				if !ok || string(v) != fmt.Sprint(i) {
+					t.Fatalf("fill %v n %d: Get(%d) = %q, %v", fill, n, i, v, ok)
+				}
+			}
+			// the loaded tree takes ordinary writes
+			tree.Insert([]byte("key999999"), []byte("x"))
+			tree.Delete([]byte("key000000"))
+			checkBTree(t, tree)
+		}
+	}
+}
+
+func TestBulkLoadFillFactor(t *testing.T) {
+	leaves := func(tree *BTree) int {
+		n := 0
+		var walk func(*btreeNode)
+		walk = func(nd *btreeNode) {
+			if nd.leaf {
+				n++
+			}
+			for _, c := range nd.child {
+				walk(c)
+			}
+		}
+		walk(tree.root.Load())
+		return n
+	}
+	dense, sparse := NewBTree(), NewBTree()
+	dense.BulkLoad(sortedSource(10000), 1)
+	sparse.BulkLoad(sortedSource(10000), 0.5)
+	if leaves(dense) >= leaves(sparse) {
+		t.Fatalf("fill 1 made %d leaves, fill 0.5 made %d", leaves(dense), leaves(sparse))
+	}
+}
+
+func TestBulkLoadRejectsUnsorted(t *testing.T) {
+	tree := NewBTree()
+	tree.Insert([]byte("keep"), []byte("me"))
+	keys := []string{"a", "c", "b"}
+	i := 0
+	err := tree.BulkLoad(func() ([]byte, []byte, bool) {
+		if i == len(keys) {
+			return nil, nil, false
+		}
+		i++
+		return []byte(keys[i-1]), nil, true
+	}, DefaultFillFactor)
+	if err != ErrUnsorted {
+		t.Fatalf("err = %v, want ErrUnsorted", err)
+	}
+	if _, ok := tree.Get([]byte("keep")); !ok {
+		t.Fatal("failed bulk load changed the tree")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import "errors"
+
+// --- Conditional writes ---
+//
+// CompareAndSwap, SetIfAbsent, SetIfExists and PutIfVersion check a
+// condition on a key and set it only if the condition holds. The check runs
+// inside logAndQueue, after every earlier commit and before any later one,
+// so the write it guards is logged as an ordinary SET record and recovery
+// needs nothing new. A failed condition writes nothing and logs nothing.
+//
+// A key's version is the LSN of the commit that last wrote it, so versions
+// only grow and never repeat for a key; 0 means the key does not exist. For
+// keys last written before the page file or checkpoint the store was
+// recovered from, the exact LSN is gone and that LSN stands in, which is
+// still newer than any version handed out for them before.
+
+// errNotApplied is the check error for a failed condition.
+var errNotApplied = errors.New("condition not met")
+
+// GetVersion returns the value of key and its version.
+func (kv *UltraKV) GetVersion(key []byte) (value []byte, version uint64, ok bool) {
+	kv.cacheLock.RLock()
+	v, version := kv.latestVersionLocked(string(key))
+	kv.cacheLock.RUnlock()
+	if v == nil {
+		return nil, 0, false
+	}
+	return []byte(*v), version, true
+}
+
+// CompareAndSwap sets key to new if its value is old. It reports false,
+// writing nothing, if key holds anything else or does not exist.
+func (kv *UltraKV) CompareAndSwap(key, old, new []byte) (bool, error) {
+	return kv.setIf(string(key), string(new), func(cur *string, _ uint64) bool {
+		return cur != nil && *cur == string(old)
+	})
+}
+
+// SetIfAbsent sets key to value if key does not exist.
+func (kv *UltraKV) SetIfAbsent(key, value []byte) (bool, error) {
+	return kv.setIf(string(key), string(value), func(cur *string, _ uint64) bool {
+		return cur == nil
+	})
+}
+
+// SetIfExists sets key to value if key exists.
+func (kv *UltraKV) SetIfExists(key, value []byte) (bool, error) {
+	return kv.setIf(string(key), string(value), func(cur *string, _ uint64) bool {
+		return cur != nil
+	})
+}
+
+// PutIfVersion sets key to value if its version, as returned by
+// GetVersion, is version; version 0 requires that key does not exist.
+func (kv *UltraKV) PutIfVersion(key, value []byte, version uint64) (bool, error) {
+	return kv.setIf(string(key), string(value), func(_ *string, cur uint64) bool {
+		return cur == version
+	})
+}
+
+// setIf sets key to value, acknowledging like Set, if cond holds for the
+// key's latest value and version. It reports whether it did.
+func (kv *UltraKV) setIf(key, value string, cond func(cur *string, version uint64) bool) (bool, error) {
+	check := func() error {
+		kv.cacheLock.RLock()
+		cur, version := kv.latestVersionLocked(key)
+		kv.cacheLock.RUnlock()
+		if !cond(cur, version) {
+			return errNotApplied
+		}
+		return nil
+	}
+	lsn, err := kv.writeKey(check, "SET", key, value, WriteOp{OpType: "set", Key: key, Value: value})
+	if err == errNotApplied {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, kv.waitDurable(lsn)
+}
+
+// latestVersionLocked is latestLocked with the key's version; cacheLock is
+// held.
+func (kv *UltraKV) latestVersionLocked(key string) (*string, uint64) {
+	v := kv.latestLocked(key)
+	if v == nil {
+		return nil, 0
+	}
+	if version, ok := kv.keyLSN[key]; ok {
+		return v, version
+	}
+	return v, kv.baseVersion
+}
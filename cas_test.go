@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestConditionalWrites(t *testing.T) {
+	dir := t.TempDir()
+	kv := openCheckpointKV(t, dir, &Options{CheckpointWALBytes: -1})
+	must := func(applied bool, err error) bool {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return applied
+	}
+
+	if !must(kv.SetIfAbsent([]byte("a"), []byte("1"))) || must(kv.SetIfAbsent([]byte("a"), []byte("2"))) {
+		t.Fatal("SetIfAbsent")
+	}
+	if must(kv.SetIfExists([]byte("b"), []byte("1"))) || !must(kv.SetIfExists([]byte("a"), []byte("2"))) {
+		t.Fatal("SetIfExists")
+	}
+	if must(kv.CompareAndSwap([]byte("a"), []byte("1"), []byte("3"))) ||
+		!must(kv.CompareAndSwap([]byte("a"), []byte("2"), []byte("3"))) ||
+		must(kv.CompareAndSwap([]byte("b"), nil, []byte("1"))) {
+		t.Fatal("CompareAndSwap")
+	}
+	if v, _ := kv.Get([]byte("a")); string(v) != "3" {
+		t.Fatalf("a = %q", v)
+	}
+
+	_, version, ok := kv.GetVersion([]byte("a"))
+	if !ok || version != 3 {
+		t.Fatalf("version of a = %d, %v; want the LSN of its third write", version, ok)
+	}
+	if _, v, ok := kv.GetVersion([]byte("b")); ok || v != 0 {
+		t.Fatalf("version of a missing key = %d, %v", v, ok)
+	}
+	if must(kv.PutIfVersion([]byte("a"), []byte("4"), version-1)) || !must(kv.PutIfVersion([]byte("a"), []byte("4"), version)) {
+		t.Fatal("PutIfVersion")
+	}
+	if must(kv.PutIfVersion([]byte("a"), []byte("5"), 0)) || !must(kv.PutIfVersion([]byte("b"), []byte("1"), 0)) {
+		t.Fatal("PutIfVersion 0")
+	}
+	if n := len(walLSNs(t, kv.walPath)); n != 5 {
+		t.Fatalf("%d records logged, want one per write applied", n)
+	}
+	_, version, _ = kv.GetVersion([]byte("a"))
+	kv.Close()
+
+	// replay restores the versions, here of the whole log
+	removePages(filepath.Join(dir, "test.db"))
+	kv = openCheckpointKV(t, dir, &Options{CheckpointWALBytes: -1})
+	if _, v, _ := kv.GetVersion([]byte("a")); v != version {
+		t.Fatalf("version of a after reopen = %d, want %d", v, version)
+	}
+	kv.Checkpoint()
+	kv.Close()
+
+	// the page file and the checkpoint stand in for versions they cover
+	kv = openCheckpointKV(t, dir, nil)
+	defer kv.Close()
+	_, v, _ := kv.GetVersion([]byte("a"))
+	if v <= version || must(kv.PutIfVersion([]byte("a"), []byte("6"), version)) || !must(kv.PutIfVersion([]byte("a"), []byte("6"), v)) {
+		t.Fatalf("version of a after a checkpoint = %d, was %d", v, version)
+	}
+	kv.Del([]byte("a"))
+	if !must(kv.SetIfAbsent([]byte("a"), []byte("7"))) {
+		t.Fatal("SetIfAbsent after Del")
+	}
+}
+
+func TestCompareAndSwapCounter(t *testing.T) {
+	kv := openTestKV(t)
+	kv.Set([]byte("n"), []byte("0"))
+	const workers, incs = 8, 25
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < incs; {
+				old, _ := kv.Get([]byte("n"))
+				n, _ := strconv.Atoi(string(old))
+				ok, err := kv.CompareAndSwap([]byte("n"), old, []byte(strconv.Itoa(n+1)))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if ok {
+					i++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if v, _ := kv.Get([]byte("n")); string(v) != strconv.Itoa(workers*incs) {
+		t.Fatalf("n = %s, want %d", v, workers*incs)
+	}
+}
+
+func TestColdGetDoesNotCacheOverwrittenValue(t *testing.T) {
+	kv := openCheckpointKV(t, t.TempDir(), &Options{Sync: SyncNone})
+	defer kv.Close()
+	const n = 20000
+	key := func(i int) []byte { return []byte(fmt.Sprintf("k%05d", i)) }
+	entries := make([]Entry, n)
+	for i := range entries {
+		entries[i] = Entry{Key: key(i), Value: []byte("old")}
+	}
+	// imported keys are in the tree only, so the first Get of each is cold
+	if err := kv.Import(entries, DefaultFillFactor); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				for i := 0; i < n; i++ {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					kv.Get(key(i))
+				}
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		kv.Set(key(i), []byte("new"))
+	}
+	close(done)
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		if v, _ := kv.Get(key(i)); string(v) != "new" {
+			t.Fatalf("Get(%s) = %q after Set returned", key(i), v)
+		}
+		if ok, _ := kv.CompareAndSwap(key(i), []byte("old"), []byte("lost")); ok {
+			t.Fatalf("CompareAndSwap(%s) from the overwritten value succeeded", key(i))
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Checkpoints ---
+//
+// A checkpoint saves the whole tree as a snapshot tagged with the LSN it
+// covers (<btreePath>.snap-<lsn>) and then retires the WAL segments that
+// snapshots make redundant, so the log stops growing and startup replays
+// only its tail. Writers are paused just long enough to take a
+// copy-on-write snapshot of the tree, or to commit the page file the
+// snapshot is read out of (see pagefile.go); the snapshot file is written
+// while they run.
+//
+// The newest CheckpointsKept snapshots are retained and the WAL keeps every
+// segment holding a record after the oldest of them. If the newest snapshot turns out to be
+// damaged, recovery falls back to an older one and replays from there.
+
+// Options tunes an UltraKV. The zero value selects the defaults.
+type Options struct {
+	// CheckpointWALBytes starts a checkpoint once this many bytes have been
+	// logged since the last one (default 64 MiB, negative disables).
+	CheckpointWALBytes int64
+	// CheckpointInterval starts a checkpoint this often (0 disables).
+	CheckpointInterval time.Duration
+	// CheckpointsKept is the number of snapshots retained (default 2).
+	CheckpointsKept int
+
+	// SegmentBytes starts a new WAL segment once the active one reaches
+	// this size (default 16 MiB, negative disables).
+	SegmentBytes int64
+	// SegmentAge starts a new WAL segment once the active one is this old
+	// (0 disables).
+	SegmentAge time.Duration
+	// WALArchiveDir, if set, receives retired segments instead of them
+	// being deleted.
+	WALArchiveDir string
+	// WALCodec compresses each flushed batch of WAL records as one block
+	// (default WALCodecNone).
+	WALCodec WALCodec
+
+	// EncryptionKeys, if set, encrypt the WAL and snapshots (see crypt.go).
+	// The first key encrypts new files; all of them decrypt.
+	EncryptionKeys []EncryptionKey
+
+	// Sync says when writes are acknowledged (default SyncGroup).
+	Sync SyncPolicy
+	// SyncEvery is how often the WAL is flushed in the background, and
+	// fsynced under SyncInterval (default 2ms).
+	SyncEvery time.Duration
+
+	// LockTimeout bounds how long a transaction waits for a key lock
+	// (default 5s, negative waits indefinitely).
+	LockTimeout time.Duration
+
+	// PoolBytes bounds the memory caching page file pages (default 8 MiB).
+	PoolBytes int
+	// CacheEntries bounds the number of values cached for reads (default
+	// 65536).
+	CacheEntries int
+}
+
+const (
+	defaultCheckpointWALBytes = 64 << 20
+	defaultSegmentBytes       = 16 << 20
+	defaultCacheEntries       = 1 << 16
+)
+
+func (o *Options) withDefaults() Options {
+	var out Options
+	if o != nil {
+		out = *o
+	}
+	if out.CheckpointWALBytes == 0 {
+		out.CheckpointWALBytes = defaultCheckpointWALBytes
+	}
+	if out.Sync == 0 {
+		out.Sync = SyncGroup
+	}
+	if out.SyncEvery <= 0 {
+		out.SyncEvery = 2 * time.Millisecond
+	}
+	if out.SegmentBytes == 0 {
+		out.SegmentBytes = defaultSegmentBytes
+	}
+	if out.CheckpointsKept <= 0 {
+		out.CheckpointsKept = 2
+	}
+	if out.CacheEntries <= 0 {
+		out.CacheEntries = defaultCacheEntries
+	}
+	if out.LockTimeout == 0 {
+		out.LockTimeout = 5 * time.Second
+	}
+	return out
+}
+
+type snapshotFile struct {
+	lsn  uint64
+	path string
+}
+
+func (kv *UltraKV) snapshotPath(lsn uint64) string {
+	return snapshotPath(kv.btreePath, lsn)
+}
+
+func (kv *UltraKV) listSnapshots() ([]snapshotFile, error) {
+	return listSnapshots(kv.btreePath)
+}
+
+func snapshotPath(btreePath string, lsn uint64) string {
+	return fmt.Sprintf("%s.snap-%020d", btreePath, lsn)
+}
+
+// listSnapshots returns the snapshot files named after btreePath, newest
+// first.
+func listSnapshots(btreePath string) ([]snapshotFile, error) {
+	dir, base := filepath.Split(btreePath)
+	if dir == "" {
+		dir = "."
+	}
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var snaps []snapshotFile
+	prefix := base + ".snap-"
+	for _, e := range ents {
+		name, ok := strings.CutPrefix(e.Name(), prefix)
+		if !ok {
+			continue
+		}
+		lsn, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue // a .tmp or set-aside file
+		}
+		snaps = append(snaps, snapshotFile{lsn: lsn, path: filepath.Join(dir, e.Name())})
+	}
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].lsn > snaps[j].lsn })
+	return snaps, nil
+}
+
+// loadNewestSnapshot loads the newest snapshot that passes its checksum and
+// returns its LSN, 0 when there is none. Damaged snapshots newer than it
+// are renamed aside so retention no longer counts them.
+func (kv *UltraKV) loadNewestSnapshot() (uint64, error) {
+	snaps, err := kv.listSnapshots()
+	if err != nil {
+		return 0, err
+	}
+	for i, s := range snaps {
+		lsn, err := kv.loadSnapshotFile(s.path)
+		if errors.Is(err, ErrKeyNotFound) {
+			return 0, err // not damage: the snapshot is fine
+		}
+		if err != nil {
+			continue
+		}
+		for _, bad := range snaps[:i] {
+			os.Rename(bad.path, bad.path+".corrupt")
+		}
+		return lsn, nil
+	}
+	if len(snaps) > 0 {
+		return 0, fmt.Errorf("none of %d snapshots is readable: %w", len(snaps), ErrBadSnapshot)
+	}
+	return 0, nil
+}
+
+// Checkpoint writes a snapshot covering every write made so far and trims
+// the WAL to the records the retained snapshots do not cover.
+func (kv *UltraKV) Checkpoint() error {
+	kv.ckptMu.Lock()
+	defer kv.ckptMu.Unlock()
+
+	kv.ckptLock.Lock()
+	if !kv.syncTree() {
+		kv.ckptLock.Unlock()
+		return ErrClosed
+	}
+	kv.walBufferMutex.Lock()
+	lsn := kv.lsn
+	kv.walBufferMutex.Unlock()
+	save := lsn != kv.ckptLSN.Load()
+	var snap *BTree
+	var err error
+	if kv.paged {
+		// the page file holds everything logged too; say so, or the
+		// snapshot would look newer to recovery and get the page file
+		// rebuilt. The snapshot is read out of it as committed here.
+		err = kv.commitPages(lsn, save)
+	} else {
+		snap = kv.btree.Snapshot()
+	}
+	kv.ckptBytes.Store(0)
+	kv.ckptLock.Unlock()
+
+	if err != nil || !save {
+		return err
+	}
+	if snap != nil {
+		err = saveSnapshot(snap, kv.snapshotPath(lsn), lsn, kv.keys)
+	} else {
+		err = kv.savePages(kv.snapshotPath(lsn), lsn)
+	}
+	if err != nil {
+		return err
+	}
+	kv.ckptLSN.Store(lsn)
+	return kv.pruneCheckpoints()
+}
+
+// pruneCheckpoints deletes all but the newest CheckpointsKept snapshots and
+// retires the WAL segments the oldest remaining one covers. ckptMu is held.
+func (kv *UltraKV) pruneCheckpoints() error {
+	snaps, err := kv.listSnapshots()
+	if err != nil || len(snaps) == 0 {
+		return err
+	}
+	keep := min(len(snaps), kv.opts.CheckpointsKept)
+	for _, s := range snaps[keep:] {
+		os.Remove(s.path)
+	}
+	return kv.retireSegments(snaps[keep-1].lsn)
+}
+
+// checkpointer runs checkpoints when the WAL has grown enough or the
+// interval has passed.
+func (kv *UltraKV) checkpointer() {
+	defer kv.ckptWG.Done()
+	var tick <-chan time.Time
+	if kv.opts.CheckpointInterval > 0 {
+		t := time.NewTicker(kv.opts.CheckpointInterval)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case <-kv.ckptCh:
+		case <-tick:
+		case <-kv.closeCh:
+			return
+		}
+		// a failed checkpoint leaves the WAL intact; the next trigger retries
+		kv.Checkpoint()
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openCheckpointKV(t *testing.T, dir string, opts *Options) *UltraKV {
+	t.Helper()
+	kv, err := NewUltraKVWithOptions(filepath.Join(dir, "test.db"), filepath.Join(dir, "test.db.wal"), opts)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	return kv
+}
+
+func TestCheckpointTruncatesWAL(t *testing.T) {
+	dir := t.TempDir()
+	kv := openCheckpointKV(t, dir, nil)
+	for i := 0; i < 1000; i++ {
+		kv.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprint(i)))
+	}
+	if err := kv.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		kv.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("new"))
+	}
+	kv.Del([]byte("k0999"))
+	kv.Close()
+
+	if lsns := walLSNs(t, filepath.Join(dir, "test.db.wal")); len(lsns) != 11 || lsns[0] != 1001 {
+		t.Fatalf("WAL after checkpoint holds LSNs %v, want 1001..1011", lsns)
+	}
+	kv = openCheckpointKV(t, dir, nil)
+	defer kv.Close()
+	if st := kv.Stats(); st.CheckpointLSN != 1000 || st.LSN != 1011 {
+		t.Fatalf("reopened at LSN %d with checkpoint %d", st.LSN, st.CheckpointLSN)
+	}
+	if n := kv.Count(); n != 999 {
+		t.Fatalf("Count = %d, want 999", n)
+	}
+	if v, _ := kv.Get([]byte("k0005")); string(v) != "new" {
+		t.Fatalf("Get(k0005) = %q", v)
+	}
+	if v, _ := kv.Get([]byte("k0500")); string(v) != "500" {
+		t.Fatalf("Get(k0500) = %q", v)
+	}
+}
+
+func TestCheckpointRetentionAndFallback(t *testing.T) {
+	dir := t.TempDir()
+	kv := openCheckpointKV(t, dir, &Options{CheckpointsKept: 2})
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 100; i++ {
+			kv.Set([]byte(fmt.Sprintf("r%d-%03d", round, i)), []byte("v"))
+		}
+		if err := kv.Checkpoint(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kv.Set([]byte("tail"), []byte("v"))
+	snaps, _ := kv.listSnapshots()
+	kv.Close()
+
+	if len(snaps) != 2 || snaps[0].lsn != 300 || snaps[1].lsn != 200 {
+		t.Fatalf("retained snapshots %+v, want LSNs 300 and 200", snaps)
+	}
+	// the WAL still reaches back to the older snapshot
+	if lsns := walLSNs(t, filepath.Join(dir, "test.db.wal")); len(lsns) != 101 || lsns[0] != 201 {
+		t.Fatalf("WAL holds %d records from LSN %v", len(lsns), lsns[:1])
+	}
+
+	// damage the newest snapshot and lose the page file: recovery falls
+	// back to the older snapshot
+	removePages(filepath.Join(dir, "test.db"))
+	data, _ := os.ReadFile(snaps[0].path)
+	data[len(data)/2] ^= 0xff
+	os.WriteFile(snaps[0].path, data, 0644)
+	kv = openCheckpointKV(t, dir, &Options{CheckpointsKept: 2})
+	defer kv.Close()
+	if n := kv.Count(); n != 301 {
+		t.Fatalf("Count after fallback = %d, want 301", n)
+	}
+	if st := kv.Stats(); st.CheckpointLSN != 200 {
+		t.Fatalf("recovered from checkpoint %d, want 200", st.CheckpointLSN)
+	}
+	if _, err := os.Stat(snaps[0].path + ".corrupt"); err != nil {
+		t.Fatalf("damaged snapshot not set aside: %v", err)
+	}
+}
+
+func TestCheckpointTriggeredByWALSize(t *testing.T) {
+	dir := t.TempDir()
+	kv := openCheckpointKV(t, dir, &Options{CheckpointWALBytes: 8 << 10})
+	defer kv.Close()
+	for i := 0; i < 2000; i++ {
+		kv.Set([]byte(fmt.Sprintf("k%04d", i)), make([]byte, 32))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for kv.Stats().CheckpointLSN == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no checkpoint after writing well past CheckpointWALBytes")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCheckpointTriggeredByInterval(t *testing.T) {
+	dir := t.TempDir()
+	kv := openCheckpointKV(t, dir, &Options{CheckpointWALBytes: -1, CheckpointInterval: 10 * time.Millisecond})
+	defer kv.Close()
+	kv.Set([]byte("k"), []byte("v"))
+	deadline := time.Now().Add(5 * time.Second)
+	for kv.Stats().CheckpointLSN != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("no interval checkpoint")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
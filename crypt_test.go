@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testKey(t *testing.T, b byte) EncryptionKey {
+	t.Helper()
+	key, err := NewEncryptionKey(bytes.Repeat([]byte{b}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// assertNoPlaintext fails if any file in dir contains secret.
+func assertNoPlaintext(t *testing.T, dir, secret string) {
+	t.Helper()
+	ents, _ := os.ReadDir(dir)
+	for _, e := range ents {
+		data, _ := os.ReadFile(filepath.Join(dir, e.Name()))
+		if bytes.Contains(data, []byte(secret)) {
+			t.Fatalf("%s holds %q in the clear", e.Name(), secret)
+		}
+	}
+}
+
+func TestEncryptedStore(t *testing.T) {
+	for _, codec := range []WALCodec{WALCodecNone, WALCodecFlate} {
+		t.Run(codec.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			opts := &Options{EncryptionKeys: []EncryptionKey{testKey(t, 1)}, WALCodec: codec, CheckpointWALBytes: -1}
+			kv := openCheckpointKV(t, dir, opts)
+			for i := 0; i < 20; i++ {
+				kv.Set([]byte(fmt.Sprintf("card:%d", i)), []byte("secret-4111-1111"))
+			}
+			kv.Checkpoint()
+			tx := kv.Begin()
+			tx.Set([]byte("ssn"), []byte("secret-078-05"))
+			tx.Commit()
+			kv.Close()
+			assertNoPlaintext(t, dir, "secret-")
+
+			kv = openCheckpointKV(t, dir, opts)
+			if v, _ := kv.Get([]byte("ssn")); string(v) != "secret-078-05" {
+				t.Fatalf("Get(ssn) = %q", v)
+			}
+			if n := kv.Count(); n != 21 {
+				t.Fatalf("Count = %d", n)
+			}
+			kv.Close()
+
+			for _, keys := range [][]EncryptionKey{nil, {testKey(t, 2)}} {
+				_, err := NewUltraKVWithOptions(kv.btreePath, kv.walPath, &Options{EncryptionKeys: keys})
+				if !errors.Is(err, ErrKeyNotFound) {
+					t.Fatalf("open with keys %v = %v, want ErrKeyNotFound", keys, err)
+				}
+			}
+			if snaps, _ := listSnapshots(kv.btreePath); len(snaps) == 0 {
+				t.Fatal("a missing key set the snapshots aside")
+			}
+		})
+	}
+}
+
+func TestEncryptedSnapshotDamage(t *testing.T) {
+	kr, _ := newKeyring([]EncryptionKey{testKey(t, 1)})
+	tree := NewBTree()
+	for i := 0; i < 10000; i++ {
+		tree.Insert([]byte(fmt.Sprintf("key%05d", i)), []byte("value"))
+	}
+	path := filepath.Join(t.TempDir(), "snap")
+	if err := saveSnapshot(tree, path, 7, kr); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewBTree()
+	if lsn, err := loadSnapshot(loaded, path, kr); err != nil || lsn != 7 || loaded.Count() != 10000 {
+		t.Fatalf("load = %d, %v, %d entries", lsn, err, loaded.Count())
+	}
+
+	data, _ := os.ReadFile(path)
+	first := len(kr.header(snapshotMagicSealed)) + 5 + 12 + sealChunk + 16 // one whole chunk
+	if len(data) <= first {
+		t.Fatalf("snapshot of %d bytes has a single chunk", len(data))
+	}
+	flipped := bytes.Clone(data)
+	flipped[len(flipped)-3] ^= 1
+	for name, bad := range map[string][]byte{"cut after a chunk": data[:first], "flipped bit": flipped} {
+		os.WriteFile(path, bad, 0644)
+		if _, err := loadSnapshot(NewBTree(), path, kr); err != ErrBadSnapshot {
+			t.Fatalf("%s: load = %v, want ErrBadSnapshot", name, err)
+		}
+	}
+}
+
+func TestRekey(t *testing.T) {
+	dir := t.TempDir()
+	kv := openCheckpointKV(t, dir, &Options{CheckpointWALBytes: -1})
+	kv.Set([]byte("a"), []byte("secret-1"))
+	kv.Checkpoint()
+	kv.Set([]byte("b"), []byte("secret-2"))
+	kv.Close()
+
+	// encrypt the plaintext store, then move it to a second key
+	oldKey, newKey := testKey(t, 1), testKey(t, 2)
+	if _, _, err := rekeyStore(kv.btreePath, kv.walPath, "", oldKey, nil); err != nil {
+		t.Fatal(err)
+	}
+	assertNoPlaintext(t, dir, "secret-")
+	keyFile := filepath.Join(t.TempDir(), "new.key")
+	os.WriteFile(keyFile, []byte(strings.Repeat("02", 32)+"\n"), 0600)
+	var out bytes.Buffer
+	if err := runRekey([]string{"-new-key-file", keyFile}, kv.btreePath, kv.walPath, []EncryptionKey{oldKey}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "under key ID "+newKey.ID) {
+		t.Fatalf("rekey printed %q", out.String())
+	}
+
+	if _, err := NewUltraKVWithOptions(kv.btreePath, kv.walPath, &Options{EncryptionKeys: []EncryptionKey{oldKey}}); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("open with the old key = %v", err)
+	}
+	if _, err := runTool(t, kv.walPath, "verify"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("verify without a key = %v", err)
+	}
+	if out, err := runWALToolKeys(kv.walPath, []EncryptionKey{newKey}, "verify"); err != nil {
+		t.Fatalf("verify with the new key = %v:\n%s", err, out)
+	}
+	kv = openCheckpointKV(t, dir, &Options{EncryptionKeys: []EncryptionKey{newKey}})
+	defer kv.Close()
+	if v, _ := kv.Get([]byte("b")); string(v) != "secret-2" {
+		t.Fatalf("Get(b) after rekey = %q", v)
+	}
+}
+
+func runWALToolKeys(walPath string, keys []EncryptionKey, args ...string) (string, error) {
+	var out bytes.Buffer
+	err := runWALTool(args, walPath, keys, &out)
+	return out.String(), err
+}
+
+func TestParseEncryptionKey(t *testing.T) {
+	key, err := ParseEncryptionKey(strings.Repeat("ab", 32) + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := ParseEncryptionKey(strings.Repeat("AB", 32)); again.ID != key.ID || len(key.ID) != 16 {
+		t.Fatalf("IDs %q and %q", key.ID, again.ID)
+	}
+	for _, bad := range []string{"xyz", strings.Repeat("ab", 5)} {
+		if _, err := ParseEncryptionKey(bad); err == nil {
+			t.Fatalf("key %q accepted", bad)
+		}
+	}
+}
+
+func TestEncryptingRemovesPageFile(t *testing.T) {
+	dir := t.TempDir()
+	kv := openCheckpointKV(t, dir, &Options{CheckpointWALBytes: -1})
+	kv.Set([]byte("card"), []byte("secret-4111-1111"))
+	kv.Close()
+	if _, err := os.Stat(kv.pagesPath()); err != nil {
+		t.Fatalf("no page file to start with: %v", err)
+	}
+
+	kv = openCheckpointKV(t, dir, &Options{EncryptionKeys: []EncryptionKey{testKey(t, 1)}, CheckpointWALBytes: -1})
+	defer kv.Close()
+	if _, err := os.Stat(kv.pagesPath()); !os.IsNotExist(err) {
+		t.Fatalf("plaintext page file left behind: %v", err)
+	}
+	if v, _ := kv.Get([]byte("card")); string(v) != "secret-4111-1111" {
+		t.Fatalf("Get(card) = %q", v)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+// Cursor is a stateful, bidirectional position in a BTree.
+//
+// It keeps the root-to-key path of the current entry so Next and Prev are
+// amortised O(1). The path belongs to the root the cursor last positioned
+// on, which copy-on-write keeps intact, so the cursor never needs a lock.
+// When a newer root has been published (for example by writeFlusher
+// applying a batch) the cursor re-seeks from the last key it returned and
+// carries on in the new tree, so iteration never repeats or skips over keys
+// that were not themselves inserted or deleted concurrently. A cursor over
+// a Snapshot never sees a newer root.
+//
+// A cursor over a store's page file keeps only the current entry and looks
+// its neighbours up in the page file on every move, so it always sees the
+// latest tree.
+type Cursor struct {
+	kv    *UltraKV // set for a cursor over kv's page file
+	tree  *BTree
+	root  *btreeNode // tree the stack was built on
+	stack []cursorFrame
+	key   string
+	value string
+	valid bool
+}
+
+// cursorFrame is one level of the cursor path. In the top frame i is the
+// index of the current key; in lower frames it is the child being visited.
+type cursorFrame struct {
+	n *btreeNode
+	i int
+}
+
+// NewCursor returns an unpositioned cursor over t. Call First, Last or Seek
+// before reading from it.
+func (t *BTree) NewCursor() *Cursor {
+	return &Cursor{tree: t}
+}
+
+// Valid reports whether the cursor is positioned on an entry.
+func (c *Cursor) Valid() bool { return c.valid }
+
+// Key returns the key at the cursor, or nil when it is not valid.
+func (c *Cursor) Key() []byte {
+	if !c.valid {
+		return nil
+	}
+	return []byte(c.key)
+}
+
+// Value returns the value at the cursor, or nil when it is not valid.
+func (c *Cursor) Value() []byte {
+	if !c.valid {
+		return nil
+	}
+	return []byte(c.value)
+}
+
+// First moves to the smallest key and reports whether there is one.
+func (c *Cursor) First() bool {
+	if c.kv != nil {
+		return c.pageSeek(nil)
+	}
+	c.reset()
+	c.descendLeft(c.root)
+	return c.settle(true)
+}
+
+// Last moves to the largest key and reports whether there is one.
+func (c *Cursor) Last() bool {
+	if c.kv != nil {
+		return c.pageBefore(nil)
+	}
+	c.reset()
+	c.descendRight(c.root)
+	return c.settle(false)
+}
+
+// Seek moves to the first key >= key and reports whether there is one.
+func (c *Cursor) Seek(key []byte) bool {
+	if c.kv != nil {
+		return c.pageSeek(key)
+	}
+	c.seek(string(key))
+	return c.valid
+}
+
+// Next moves to the following key and reports whether there is one.
+func (c *Cursor) Next() bool {
+	if !c.valid {
+		return false
+	}
+	if c.kv != nil {
+		return c.pageSeek(append([]byte(c.key), 0))
+	}
+	if c.stale() {
+		// tree changed under us: find the first key after the last one seen
+		prev := c.key
+		if !c.seek(prev) || c.key != prev {
+			return c.valid
+		}
+	}
+	c.next()
+	return c.valid
+}
+
+// Prev moves to the preceding key and reports whether there is one.
+func (c *Cursor) Prev() bool {
+	if !c.valid {
+		return false
+	}
+	if c.kv != nil {
+		return c.pageBefore([]byte(c.key))
+	}
+	if c.stale() {
+		// tree changed under us: find the last key before the last one seen
+		if !c.seek(c.key) {
+			c.reset()
+			c.descendRight(c.root)
+			return c.settle(false)
+		}
+	}
+	c.prev()
+	return c.valid
+}
+
+// pageSeek moves to the page file's first key >= key.
+func (c *Cursor) pageSeek(key []byte) bool {
+	return c.load(c.kv.findPages(func(d *DiskBTree) ([]byte, []byte, bool, error) {
+		e, err := d.Scan(key, nil, 1)
+		if len(e) == 0 {
+			return nil, nil, false, err
+		}
+		return e[0].Key, e[0].Value, true, err
+	}))
+}
+
+// pageBefore moves to the page file's last key < key, or its last key of
+// all when key is nil.
+func (c *Cursor) pageBefore(key []byte) bool {
+	return c.load(c.kv.findPages(func(d *DiskBTree) ([]byte, []byte, bool, error) {
+		return d.Before(key)
+	}))
+}
+
+func (c *Cursor) load(k, v []byte, ok bool) bool {
+	c.key, c.value, c.valid = string(k), string(v), ok
+	return ok
+}
+
+func (c *Cursor) stale() bool {
+	return c.root != c.tree.root.Load()
+}
+
+func (c *Cursor) reset() {
+	c.stack = c.stack[:0]
+	c.root = c.tree.root.Load()
+	c.valid = false
+}
+
+func (c *Cursor) descendLeft(n *btreeNode) {
+	for {
+		c.stack = append(c.stack, cursorFrame{n: n})
+		if n.leaf {
+			return
+		}
+		n = n.child[0]
+	}
+}
+
+func (c *Cursor) descendRight(n *btreeNode) {
+	for {
+		if n.leaf {
+			c.stack = append(c.stack, cursorFrame{n: n, i: len(n.keys) - 1})
+			return
+		}
+		c.stack = append(c.stack, cursorFrame{n: n, i: len(n.child) - 1})
+		n = n.child[len(n.child)-1]
+	}
+}
+
+func (c *Cursor) seek(key string) bool {
+	c.reset()
+	n := c.root
+	for {
+		i, found := n.search(key)
+		c.stack = append(c.stack, cursorFrame{n: n, i: i})
+		if found || n.leaf {
+			return c.settle(true)
+		}
+		n = n.child[i]
+	}
+}
+
+// settle makes the top frame point at a real key, climbing towards the
+// root in the given direction when it has run off the end of its node, and
+// loads the current entry.
+func (c *Cursor) settle(forward bool) bool {
+	for len(c.stack) > 0 {
+		top := &c.stack[len(c.stack)-1]
+		if forward && top.i < len(top.n.keys) {
+			break
+		}
+		if !forward && top.i >= 0 {
+			break
+		}
+		c.stack = c.stack[:len(c.stack)-1]
+		if !forward && len(c.stack) > 0 {
+			// coming back up from child j, the previous key is keys[j-1]
+			c.stack[len(c.stack)-1].i--
+		}
+	}
+	if len(c.stack) == 0 {
+		c.valid = false
+		return false
+	}
+	top := c.stack[len(c.stack)-1]
+	c.key, c.value, c.valid = top.n.keys[top.i], top.n.values[top.i], true
+	return true
+}
+
+func (c *Cursor) next() {
+	top := &c.stack[len(c.stack)-1]
+	top.i++
+	if !top.n.leaf {
+		c.descendLeft(top.n.child[top.i])
+	}
+	c.settle(true)
+}
+
+func (c *Cursor) prev() {
+	top := &c.stack[len(c.stack)-1]
+	if !top.n.leaf {
+		c.descendRight(top.n.child[top.i])
+	} else {
+		top.i--
+	}
+	c.settle(false)
+}
@@ -0,0 +1,730 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// --- Disk-resident B+tree over the page file ---
+//
+// Leaves hold the entries and are doubly linked to their siblings so range
+// scans walk the leaf level without going back through the parents.
+// Internal nodes hold separator keys: child[i] covers keys k with
+// keys[i-1] <= k < keys[i]. Nodes are sized in bytes rather than key count,
+// so they split when the encoded node no longer fits a page and merge or
+// redistribute with a sibling when it drops under a quarter page. Values
+// larger than diskMaxInline live in a chain of overflow pages, and so do
+// keys longer than diskMaxInlineKey, in leaves and internal nodes alike.
+// A page's long keys get fresh chains every time it is written and lose
+// them when it is rewritten or freed, so no chain is shared between pages.
+//
+// Leaf page:     type u8 | _ u8 | n u16 | prev u32 | next u32 | entries
+// leaf entry:    key | 0 u8 | vlen u16 | value
+//                key | 1 u8 | vlen u32 | first overflow page u32
+// Internal page: type u8 | _ u8 | n u16 | child0 u32 | n x (key | child u32)
+// key:           klen u16 | key
+//                0xffff u16 | klen u32 | first overflow page u32
+// Overflow page: type u8 | _ u8 | used u16 | next u32 | data
+
+const (
+	diskMaxInlineKey = 512
+	diskMaxInline    = 512
+	diskMinFill      = pageSize / 4
+	leafHeaderSize   = 12
+	nodeHeaderSize   = 8
+	overflowHeader   = 8
+	overflowData     = pageSize - overflowHeader
+)
+
+var errBadNode = errors.New("godb: page is not a B+tree node")
+
+// DiskBTree is a B+tree stored in a page file. Changes accumulate in memory
+// until Commit, which makes them durable atomically.
+type DiskBTree struct {
+	p *pager
+}
+
+type diskValue struct {
+	inline   []byte
+	overflow uint32 // first overflow page, 0 when inline
+	length   uint32
+}
+
+type diskNode struct {
+	id         uint32
+	leaf       bool
+	prev, next uint32 // leaf siblings, 0 at either end
+	keys       [][]byte
+	vals       []diskValue // leaves only
+	child      []uint32    // internal only, len(keys)+1
+	keyPages   []uint32    // chains of the long keys in the page as last read or written
+}
+
+// diskPathElem records the internal node passed on the way to a leaf and
+// the child index that was followed.
+type diskPathElem struct {
+	n   *diskNode
+	idx int
+}
+
+// OpenDiskBTree opens or creates the page file at path. opts may be nil.
+// A DiskBTree is not safe for concurrent use.
+func OpenDiskBTree(path string, opts *DiskOptions) (*DiskBTree, error) {
+	p, err := openPager(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &DiskBTree{p: p}, nil
+}
+
+// Len returns the number of keys, including uncommitted changes.
+func (t *DiskBTree) Len() uint64 { return t.p.meta.entries }
+
+// LSN returns the log position recorded by the last successful Commit.
+func (t *DiskBTree) LSN() uint64 { return t.p.committed.lsn }
+
+// Commit durably applies every change since the previous commit and records
+// lsn as the log position they cover.
+func (t *DiskBTree) Commit(lsn uint64) error { return t.p.commit(lsn) }
+
+// Rollback discards every change since the previous commit.
+func (t *DiskBTree) Rollback() error { return t.p.rollback() }
+
+// SetLSN declares that the changes that follow are described by log record
+// lsn, so the pages they dirty are not written before the log reaches it.
+func (t *DiskBTree) SetLSN(lsn uint64) { t.p.lsn = lsn }
+
+// Stats returns the buffer pool counters.
+func (t *DiskBTree) Stats() PoolStats { return t.p.pool.stats() }
+
+// Close closes the page file. Uncommitted changes are discarded.
+func (t *DiskBTree) Close() error { return t.p.close() }
+
+func (t *DiskBTree) Get(key []byte) ([]byte, bool, error) {
+	if t.p.meta.root == 0 {
+		return nil, false, nil
+	}
+	_, leaf, err := t.findLeaf(key)
+	if err != nil {
+		return nil, false, err
+	}
+	i, found := leaf.search(key)
+	if !found {
+		return nil, false, nil
+	}
+	v, err := t.loadValue(leaf.vals[i])
+	return v, err == nil, err
+}
+
+func (t *DiskBTree) Put(key, value []byte) error {
+	if t.p.meta.root == 0 {
+		id, err := t.p.alloc()
+		if err != nil {
+			return err
+		}
+		if err := t.writeNode(&diskNode{id: id, leaf: true}); err != nil {
+			return err
+		}
+		t.p.meta.root = id
+	}
+	path, leaf, err := t.findLeaf(key)
+	if err != nil {
+		return err
+	}
+	val, err := t.storeValue(value)
+	if err != nil {
+		return err
+	}
+	i, found := leaf.search(key)
+	if found {
+		if err := t.freeValue(leaf.vals[i]); err != nil {
+			return err
+		}
+		leaf.vals[i] = val
+	} else {
+		leaf.keys = insertAt(leaf.keys, i, append([]byte(nil), key...))
+		leaf.vals = insertAt(leaf.vals, i, val)
+		t.p.meta.entries++
+	}
+	return t.fixNode(path, leaf)
+}
+
+// Delete removes key and reports whether it was present.
+func (t *DiskBTree) Delete(key []byte) (bool, error) {
+	if t.p.meta.root == 0 {
+		return false, nil
+	}
+	path, leaf, err := t.findLeaf(key)
+	if err != nil {
+		return false, err
+	}
+	i, found := leaf.search(key)
+	if !found {
+		return false, nil
+	}
+	if err := t.freeValue(leaf.vals[i]); err != nil {
+		return false, err
+	}
+	leaf.keys = removeAt(leaf.keys, i)
+	leaf.vals = removeAt(leaf.vals, i)
+	t.p.meta.entries--
+	return true, t.fixNode(path, leaf)
+}
+
+// Scan returns the entries with start <= key < end in ascending order,
+// following leaf sibling links. An empty end means no upper bound and
+// limit <= 0 means no limit.
+func (t *DiskBTree) Scan(start, end []byte, limit int) ([]Entry, error) {
+	var out []Entry
+	if t.p.meta.root == 0 {
+		return nil, nil
+	}
+	_, leaf, err := t.findLeaf(start)
+	if err != nil {
+		return nil, err
+	}
+	i, _ := leaf.search(start)
+	for {
+		for ; i < len(leaf.keys); i++ {
+			if len(end) > 0 && bytes.Compare(leaf.keys[i], end) >= 0 {
+				return out, nil
+			}
+			v, err := t.loadValue(leaf.vals[i])
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, Entry{Key: leaf.keys[i], Value: v})
+			if limit > 0 && len(out) >= limit {
+				return out, nil
+			}
+		}
+		if leaf.next == 0 {
+			return out, nil
+		}
+		if leaf, err = t.readNode(leaf.next); err != nil {
+			return nil, err
+		}
+		i = 0
+	}
+}
+
+// Before returns the last entry with key < before, or the last entry of all
+// when before is nil, following leaf sibling links backwards.
+func (t *DiskBTree) Before(before []byte) (key, value []byte, ok bool, err error) {
+	if t.p.meta.root == 0 {
+		return nil, nil, false, nil
+	}
+	var leaf *diskNode
+	i := 0
+	if before == nil {
+		leaf, err = t.readNode(t.p.meta.root)
+		for err == nil && !leaf.leaf {
+			leaf, err = t.readNode(leaf.child[len(leaf.child)-1])
+		}
+		if err != nil {
+			return nil, nil, false, err
+		}
+		i = len(leaf.keys)
+	} else {
+		if _, leaf, err = t.findLeaf(before); err != nil {
+			return nil, nil, false, err
+		}
+		i, _ = leaf.search(before)
+	}
+	for i == 0 {
+		if leaf.prev == 0 {
+			return nil, nil, false, nil
+		}
+		if leaf, err = t.readNode(leaf.prev); err != nil {
+			return nil, nil, false, err
+		}
+		i = len(leaf.keys)
+	}
+	v, err := t.loadValue(leaf.vals[i-1])
+	if err != nil {
+		return nil, nil, false, err
+	}
+	return leaf.keys[i-1], v, true, nil
+}
+
+func (t *DiskBTree) findLeaf(key []byte) ([]diskPathElem, *diskNode, error) {
+	var path []diskPathElem
+	n, err := t.readNode(t.p.meta.root)
+	if err != nil {
+		return nil, nil, err
+	}
+	for !n.leaf {
+		// number of separators <= key picks the child
+		idx := sort.Search(len(n.keys), func(i int) bool { return bytes.Compare(n.keys[i], key) > 0 })
+		path = append(path, diskPathElem{n: n, idx: idx})
+		if n, err = t.readNode(n.child[idx]); err != nil {
+			return nil, nil, err
+		}
+	}
+	return path, n, nil
+}
+
+// fixNode writes n back after a change, splitting it when it overflows a
+// page and merging or redistributing it with a sibling when it underflows,
+// then repeats the check on the parent it changed.
+func (t *DiskBTree) fixNode(path []diskPathElem, n *diskNode) error {
+	switch {
+	case n.size() > pageSize:
+		return t.split(path, n)
+	case len(path) == 0:
+		if !n.leaf && len(n.keys) == 0 {
+			// root with a single child: the tree loses a level
+			t.p.meta.root = n.child[0]
+			return t.freeNode(n)
+		}
+		if n.leaf && len(n.keys) == 0 {
+			t.p.meta.root = 0
+			return t.freeNode(n)
+		}
+		return t.writeNode(n)
+	case n.size() < diskMinFill:
+		return t.rebalance(path, n)
+	default:
+		return t.writeNode(n)
+	}
+}
+
+func (t *DiskBTree) split(path []diskPathElem, n *diskNode) error {
+	id, err := t.p.alloc()
+	if err != nil {
+		return err
+	}
+	right := &diskNode{id: id, leaf: n.leaf}
+	m := n.splitPoint()
+	var sep []byte
+	if n.leaf {
+		right.keys = append(right.keys, n.keys[m:]...)
+		right.vals = append(right.vals, n.vals[m:]...)
+		n.keys, n.vals = n.keys[:m:m], n.vals[:m:m]
+		sep = right.keys[0]
+		right.prev, right.next = n.id, n.next
+		if n.next != 0 {
+			nb, err := t.readNode(n.next)
+			if err != nil {
+				return err
+			}
+			nb.prev = right.id
+			if err := t.writeNode(nb); err != nil {
+				return err
+			}
+		}
+		n.next = right.id
+	} else {
+		sep = n.keys[m]
+		right.keys = append(right.keys, n.keys[m+1:]...)
+		right.child = append(right.child, n.child[m+1:]...)
+		n.keys, n.child = n.keys[:m:m], n.child[:m+1:m+1]
+	}
+	if err := t.writeNode(n); err != nil {
+		return err
+	}
+	if err := t.writeNode(right); err != nil {
+		return err
+	}
+
+	if len(path) == 0 {
+		rootID, err := t.p.alloc()
+		if err != nil {
+			return err
+		}
+		if err := t.writeNode(&diskNode{id: rootID, keys: [][]byte{sep}, child: []uint32{n.id, right.id}}); err != nil {
+			return err
+		}
+		t.p.meta.root = rootID
+		return nil
+	}
+	parent := path[len(path)-1]
+	parent.n.keys = insertAt(parent.n.keys, parent.idx, sep)
+	parent.n.child = insertAt(parent.n.child, parent.idx+1, right.id)
+	return t.fixNode(path[:len(path)-1], parent.n)
+}
+
+// rebalance fixes an underfull non-root node by merging it with a sibling
+// when both fit one page, or by sharing the sibling's entries otherwise.
+func (t *DiskBTree) rebalance(path []diskPathElem, n *diskNode) error {
+	parent := path[len(path)-1]
+	sepIdx := parent.idx
+	var left, right *diskNode
+	if parent.idx > 0 {
+		sepIdx = parent.idx - 1
+		sib, err := t.readNode(parent.n.child[sepIdx])
+		if err != nil {
+			return err
+		}
+		left, right = sib, n
+	} else {
+		sib, err := t.readNode(parent.n.child[1])
+		if err != nil {
+			return err
+		}
+		left, right = n, sib
+	}
+	sep := parent.n.keys[sepIdx]
+
+	// gather both nodes into one
+	merged := &diskNode{id: left.id, leaf: left.leaf, prev: left.prev, next: right.next, keyPages: left.keyPages}
+	merged.keys = append(append(merged.keys, left.keys...), right.keys...)
+	if left.leaf {
+		merged.vals = append(append(merged.vals, left.vals...), right.vals...)
+	} else {
+		merged.keys = append(append(append([][]byte{}, left.keys...), sep), right.keys...)
+		merged.child = append(append(merged.child, left.child...), right.child...)
+	}
+
+	if merged.size() <= pageSize {
+		if merged.leaf && merged.next != 0 {
+			nb, err := t.readNode(merged.next)
+			if err != nil {
+				return err
+			}
+			nb.prev = merged.id
+			if err := t.writeNode(nb); err != nil {
+				return err
+			}
+		}
+		if err := t.writeNode(merged); err != nil {
+			return err
+		}
+		if err := t.freeNode(right); err != nil {
+			return err
+		}
+		parent.n.keys = removeAt(parent.n.keys, sepIdx)
+		parent.n.child = removeAt(parent.n.child, sepIdx+1)
+		return t.fixNode(path[:len(path)-1], parent.n)
+	}
+
+	m := merged.splitPoint()
+	if merged.leaf {
+		left.keys = append([][]byte(nil), merged.keys[:m]...)
+		left.vals = append([]diskValue(nil), merged.vals[:m]...)
+		right.keys = append([][]byte(nil), merged.keys[m:]...)
+		right.vals = append([]diskValue(nil), merged.vals[m:]...)
+		parent.n.keys[sepIdx] = right.keys[0]
+	} else {
+		left.keys = append([][]byte(nil), merged.keys[:m]...)
+		left.child = append([]uint32(nil), merged.child[:m+1]...)
+		right.keys = append([][]byte(nil), merged.keys[m+1:]...)
+		right.child = append([]uint32(nil), merged.child[m+1:]...)
+		parent.n.keys[sepIdx] = merged.keys[m]
+	}
+	if err := t.writeNode(left); err != nil {
+		return err
+	}
+	if err := t.writeNode(right); err != nil {
+		return err
+	}
+	// the new separator may be longer than the old one
+	return t.fixNode(path[:len(path)-1], parent.n)
+}
+
+// splitPoint picks the index that divides n's entries into two halves of
+// roughly equal encoded size. For internal nodes keys[m] moves up.
+func (n *diskNode) splitPoint() int {
+	// both halves must keep at least one key
+	lo, hi := 1, len(n.keys)-1
+	if !n.leaf {
+		hi--
+	}
+	total := n.size()
+	acc := n.headerSize()
+	m := len(n.keys) / 2
+	for i := range n.keys {
+		acc += n.entrySize(i)
+		if acc >= total/2 {
+			m = i
+			break
+		}
+	}
+	return max(lo, min(m, hi))
+}
+
+func (n *diskNode) search(key []byte) (int, bool) {
+	i := sort.Search(len(n.keys), func(i int) bool { return bytes.Compare(n.keys[i], key) >= 0 })
+	return i, i < len(n.keys) && bytes.Equal(n.keys[i], key)
+}
+
+func (n *diskNode) headerSize() int {
+	if n.leaf {
+		return leafHeaderSize
+	}
+	return nodeHeaderSize
+}
+
+func (n *diskNode) entrySize(i int) int {
+	k := 2 + len(n.keys[i])
+	if len(n.keys[i]) > diskMaxInlineKey {
+		k = 2 + 8
+	}
+	if !n.leaf {
+		return k + 4
+	}
+	if n.vals[i].overflow != 0 {
+		return k + 1 + 8
+	}
+	return k + 1 + 2 + len(n.vals[i].inline)
+}
+
+func (n *diskNode) size() int {
+	s := n.headerSize()
+	for i := range n.keys {
+		s += n.entrySize(i)
+	}
+	return s
+}
+
+// writeNode encodes n into its page. The node must fit.
+func (t *DiskBTree) writeNode(n *diskNode) error {
+	for _, id := range n.keyPages {
+		if err := t.freeChain(id); err != nil {
+			return err
+		}
+	}
+	n.keyPages = n.keyPages[:0]
+	buf := make([]byte, pageSize)
+	binary.LittleEndian.PutUint16(buf[2:], uint16(len(n.keys)))
+	off := 0
+	if n.leaf {
+		buf[0] = pageTypeLeaf
+		binary.LittleEndian.PutUint32(buf[4:], n.prev)
+		binary.LittleEndian.PutUint32(buf[8:], n.next)
+		off = leafHeaderSize
+		for i, k := range n.keys {
+			var err error
+			if off, err = t.encodeKey(n, buf, off, k); err != nil {
+				return err
+			}
+			v := n.vals[i]
+			if v.overflow != 0 {
+				buf[off] = 1
+				binary.LittleEndian.PutUint32(buf[off+1:], v.length)
+				binary.LittleEndian.PutUint32(buf[off+5:], v.overflow)
+				off += 9
+			} else {
+				binary.LittleEndian.PutUint16(buf[off+1:], uint16(len(v.inline)))
+				off += 3 + copy(buf[off+3:], v.inline)
+			}
+		}
+	} else {
+		buf[0] = pageTypeInternal
+		binary.LittleEndian.PutUint32(buf[4:], n.child[0])
+		off = nodeHeaderSize
+		for i, k := range n.keys {
+			var err error
+			if off, err = t.encodeKey(n, buf, off, k); err != nil {
+				return err
+			}
+			binary.LittleEndian.PutUint32(buf[off:], n.child[i+1])
+			off += 4
+		}
+	}
+	return t.p.write(n.id, buf)
+}
+
+// readNode decodes page id. Keys and inline values point into a private
+// copy of the page rather than being copied one by one.
+func (t *DiskBTree) readNode(id uint32) (*diskNode, error) {
+	buf, err := t.p.read(id)
+	if err != nil {
+		return nil, err
+	}
+	n := &diskNode{id: id}
+	count := int(binary.LittleEndian.Uint16(buf[2:]))
+	switch buf[0] {
+	case pageTypeLeaf:
+		n.leaf = true
+		n.prev = binary.LittleEndian.Uint32(buf[4:])
+		n.next = binary.LittleEndian.Uint32(buf[8:])
+		off := leafHeaderSize
+		n.keys = make([][]byte, count)
+		n.vals = make([]diskValue, count)
+		for i := 0; i < count; i++ {
+			if n.keys[i], off, err = t.decodeKey(n, buf, off); err != nil {
+				return nil, err
+			}
+			if buf[off] == 1 {
+				n.vals[i] = diskValue{
+					length:   binary.LittleEndian.Uint32(buf[off+1:]),
+					overflow: binary.LittleEndian.Uint32(buf[off+5:]),
+				}
+				off += 9
+			} else {
+				vlen := int(binary.LittleEndian.Uint16(buf[off+1:]))
+				n.vals[i] = diskValue{inline: buf[off+3 : off+3+vlen : off+3+vlen], length: uint32(vlen)}
+				off += 3 + vlen
+			}
+		}
+	case pageTypeInternal:
+		n.child = make([]uint32, count+1)
+		n.keys = make([][]byte, count)
+		n.child[0] = binary.LittleEndian.Uint32(buf[4:])
+		off := nodeHeaderSize
+		for i := 0; i < count; i++ {
+			if n.keys[i], off, err = t.decodeKey(n, buf, off); err != nil {
+				return nil, err
+			}
+			n.child[i+1] = binary.LittleEndian.Uint32(buf[off:])
+			off += 4
+		}
+	default:
+		return nil, fmt.Errorf("%w: page %d has type %d", errBadNode, id, buf[0])
+	}
+	return n, nil
+}
+
+// diskLongKey is the klen of a key stored out of line.
+const diskLongKey = 0xffff
+
+// encodeKey writes key into buf at off, in a fresh chain of overflow pages
+// recorded in n.keyPages when it is long, and returns the offset after it.
+func (t *DiskBTree) encodeKey(n *diskNode, buf []byte, off int, key []byte) (int, error) {
+	if len(key) <= diskMaxInlineKey {
+		binary.LittleEndian.PutUint16(buf[off:], uint16(len(key)))
+		return off + 2 + copy(buf[off+2:], key), nil
+	}
+	id, err := t.writeChain(key)
+	if err != nil {
+		return 0, err
+	}
+	n.keyPages = append(n.keyPages, id)
+	binary.LittleEndian.PutUint16(buf[off:], diskLongKey)
+	binary.LittleEndian.PutUint32(buf[off+2:], uint32(len(key)))
+	binary.LittleEndian.PutUint32(buf[off+6:], id)
+	return off + 2 + 8, nil
+}
+
+// decodeKey reads the key at off in buf, loading it from its chain when it
+// is long, and returns the offset after it.
+func (t *DiskBTree) decodeKey(n *diskNode, buf []byte, off int) ([]byte, int, error) {
+	klen := int(binary.LittleEndian.Uint16(buf[off:]))
+	if klen != diskLongKey {
+		return buf[off+2 : off+2+klen : off+2+klen], off + 2 + klen, nil
+	}
+	id := binary.LittleEndian.Uint32(buf[off+6:])
+	key, err := t.readChain(id, binary.LittleEndian.Uint32(buf[off+2:]))
+	if err != nil {
+		return nil, 0, err
+	}
+	n.keyPages = append(n.keyPages, id)
+	return key, off + 2 + 8, nil
+}
+
+// freeNode frees a node's page and the chains of its long keys.
+func (t *DiskBTree) freeNode(n *diskNode) error {
+	for _, id := range n.keyPages {
+		if err := t.freeChain(id); err != nil {
+			return err
+		}
+	}
+	n.keyPages = nil
+	return t.p.free(n.id)
+}
+
+// storeValue keeps small values inline and writes large ones to a fresh
+// chain of overflow pages.
+func (t *DiskBTree) storeValue(value []byte) (diskValue, error) {
+	if len(value) <= diskMaxInline {
+		return diskValue{inline: append([]byte{}, value...), length: uint32(len(value))}, nil
+	}
+	id, err := t.writeChain(value)
+	if err != nil {
+		return diskValue{}, err
+	}
+	return diskValue{overflow: id, length: uint32(len(value))}, nil
+}
+
+// writeChain writes data to a fresh chain of overflow pages and returns
+// its first page.
+func (t *DiskBTree) writeChain(data []byte) (uint32, error) {
+	ids := make([]uint32, (len(data)+overflowData-1)/overflowData)
+	for i := range ids {
+		id, err := t.p.alloc()
+		if err != nil {
+			return 0, err
+		}
+		ids[i] = id
+	}
+	for i, id := range ids {
+		chunk := data[i*overflowData:]
+		if len(chunk) > overflowData {
+			chunk = chunk[:overflowData]
+		}
+		buf := make([]byte, pageSize)
+		buf[0] = pageTypeOverflow
+		binary.LittleEndian.PutUint16(buf[2:], uint16(len(chunk)))
+		if i+1 < len(ids) {
+			binary.LittleEndian.PutUint32(buf[4:], ids[i+1])
+		}
+		copy(buf[overflowHeader:], chunk)
+		if err := t.p.write(id, buf); err != nil {
+			return 0, err
+		}
+	}
+	return ids[0], nil
+}
+
+func (t *DiskBTree) loadValue(v diskValue) ([]byte, error) {
+	if v.overflow == 0 {
+		return v.inline, nil
+	}
+	return t.readChain(v.overflow, v.length)
+}
+
+// readChain reads the length bytes held by the chain starting at id.
+func (t *DiskBTree) readChain(id, length uint32) ([]byte, error) {
+	out := make([]byte, 0, length)
+	for id != 0 {
+		buf, err := t.p.read(id)
+		if err != nil {
+			return nil, err
+		}
+		if buf[0] != pageTypeOverflow {
+			return nil, fmt.Errorf("godb: page %d is not an overflow page", id)
+		}
+		used := int(binary.LittleEndian.Uint16(buf[2:]))
+		out = append(out, buf[overflowHeader:overflowHeader+used]...)
+		id = binary.LittleEndian.Uint32(buf[4:])
+	}
+	return out, nil
+}
+
+// freeValue returns a value's overflow pages to the free list.
+func (t *DiskBTree) freeValue(v diskValue) error {
+	return t.freeChain(v.overflow)
+}
+
+// freeChain returns the chain of overflow pages starting at id to the free
+// list.
+func (t *DiskBTree) freeChain(id uint32) error {
+	for id != 0 {
+		buf, err := t.p.read(id)
+		if err != nil {
+			return err
+		}
+		next := binary.LittleEndian.Uint32(buf[4:])
+		if err := t.p.free(id); err != nil {
+			return err
+		}
+		id = next
+	}
+	return nil
+}
+
+func insertAt[T any](s []T, i int, v T) []T {
+	var zero T
+	s = append(s, zero)
+	copy(s[i+1:], s[i:])
+	s[i] = v
+	return s
+}
+
+func removeAt[T any](s []T, i int) []T {
+	return append(s[:i], s[i+1:]...)
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// checkDiskBTree verifies separator bounds, uniform leaf depth, page
+// occupancy and the leaf sibling chain, and returns the keys in order.
+func checkDiskBTree(t *testing.T, tree *DiskBTree) []string {
+	t.Helper()
+	if tree.p.meta.root == 0 {
+		return nil
+	}
+	var leaves []uint32
+	leafDepth := -1
+	var walk func(id uint32, depth int, lo, hi []byte)
+	walk = func(id uint32, depth int, lo, hi []byte) {
+		n, err := tree.readNode(id)
+		if err != nil {
+			t.Fatalf("readNode(%d): %v", id, err)
+		}
+		if n.size() > pageSize {
+			t.Fatalf("page %d holds %d bytes", id, n.size())
+		}
+		if id != tree.p.meta.root && n.size() < diskMinFill && len(n.keys) < 2 {
+			t.Fatalf("page %d underfull: %d bytes, %d keys", id, n.size(), len(n.keys))
+		}
+		for i, k := range n.keys {
+			if i > 0 && bytes.Compare(n.keys[i-1], k) >= 0 {
+				t.Fatalf("page %d keys out of order", id)
+			}
+			if (lo != nil && bytes.Compare(k, lo) < 0) || (hi != nil && bytes.Compare(k, hi) >= 0) {
+				t.Fatalf("page %d key %q outside [%q, %q)", id, k, lo, hi)
+			}
+		}
+		if n.leaf {
+			if leafDepth == -1 {
+				leafDepth = depth
+			} else if leafDepth != depth {
+				t.Fatalf("leaves at depth %d and %d", leafDepth, depth)
+			}
+			leaves = append(leaves, id)
+			return
+		}
+		for i, c := range n.child {
+			clo, chi := lo, hi
+			if i > 0 {
+				clo = n.keys[i-1]
+			}
+			if i < len(n.keys) {
+				chi = n.keys[i]
+			}
+			walk(c, depth+1, clo, chi)
+		}
+	}
+	walk(tree.p.meta.root, 0, nil, nil)
+
+	var keys []string
+	prev := uint32(0)
+	for i, id := range leaves {
+		n, _ := tree.readNode(id)
+		if n.prev != prev {
+			t.Fatalf("leaf %d prev = %d, want %d", id, n.prev, prev)
+		}
+		want := uint32(0)
+		if i+1 < len(leaves) {
+			want = leaves[i+1]
+		}
+		if n.next != want {
+			t.Fatalf("leaf %d next = %d, want %d", id, n.next, want)
+		}
+		for _, k := range n.keys {
+			keys = append(keys, string(k))
+		}
+		prev = id
+	}
+	return keys
+}
+
+func TestDiskBTreeRandomOps(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree.pages")
+	tree, err := OpenDiskBTree(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(7))
+	model := make(map[string]string)
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 1500; i++ {
+			n := rng.Intn(5000)
+			k := fmt.Sprintf("key-%06d", n)
+			if n%40 == 0 {
+				k += strings.Repeat("#", diskMaxInlineKey+n) // long keys go out of line
+			}
+			if rng.Intn(3) == 0 {
+				_, want := model[k]
+				got, err := tree.Delete([]byte(k))
+				if err != nil || got != want {
+					t.Fatalf("Delete(%q) = %v, %v; want %v", k, got, err, want)
+				}
+				delete(model, k)
+				continue
+			}
+			v := bytes.Repeat([]byte{byte('a' + rng.Intn(26))}, rng.Intn(200))
+			if rng.Intn(20) == 0 {
+				v = bytes.Repeat([]byte("big"), 2000+rng.Intn(3000)) // overflow pages
+			}
+			if err := tree.Put([]byte(k), v); err != nil {
+				t.Fatal(err)
+			}
+			model[k] = string(v)
+		}
+		if err := tree.Commit(uint64(round)); err != nil {
+			t.Fatal(err)
+		}
+		// reopen every round to read back from disk
+		tree.Close()
+		if tree, err = OpenDiskBTree(path, nil); err != nil {
+			t.Fatal(err)
+		}
+		keys := checkDiskBTree(t, tree)
+		if len(keys) != len(model) || tree.Len() != uint64(len(model)) {
+			t.Fatalf("round %d: %d keys in tree (Len %d), %d in model", round, len(keys), tree.Len(), len(model))
+		}
+		if tree.LSN() != uint64(round) {
+			t.Fatalf("LSN = %d, want %d", tree.LSN(), round)
+		}
+		for k, want := range model {
+			got, ok, err := tree.Get([]byte(k))
+			if err != nil || !ok || string(got) != want {
+				t.Fatalf("Get(%q): ok=%v err=%v, len %d want %d", k, ok, err, len(got), len(want))
+			}
+		}
+	}
+	tree.Close()
+}
+
+func TestDiskBTreeScan(t *testing.T) {
+	tree, err := OpenDiskBTree(filepath.Join(t.TempDir(), "tree.pages"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	var want []string
+	for i := 0; i < 3000; i++ {
+		k := fmt.Sprintf("k%05d", i)
+		tree.Put([]byte(k), []byte(k))
+		want = append(want, k)
+	}
+	sort.Strings(want)
+	got, err := tree.Scan([]byte("k01000"), []byte("k02000"), 0)
+	if err != nil || len(got) != 1000 {
+		t.Fatalf("Scan: %d entries, %v", len(got), err)
+	}
+	for i, e := range got {
+		if string(e.Key) != want[1000+i] || string(e.Value) != want[1000+i] {
+			t.Fatalf("entry %d = %q", i, e.Key)
+		}
+	}
+	if got, _ := tree.Scan(nil, nil, 5); len(got) != 5 || string(got[4].Key) != "k00004" {
+		t.Fatalf("limited Scan = %v", got)
+	}
+
+	// walking backwards crosses every leaf boundary
+	n := 0
+	for k, _, ok, err := tree.Before(nil); ok || err != nil; k, _, ok, err = tree.Before(k) {
+		if err != nil || string(k) != want[len(want)-1-n] {
+			t.Fatalf("step %d back: %q, %v", n, k, err)
+		}
+		n++
+	}
+	if n != len(want) {
+		t.Fatalf("walked back over %d keys, want %d", n, len(want))
+	}
+	if k, _, ok, _ := tree.Before([]byte("k01000x")); !ok || string(k) != "k01000" {
+		t.Fatalf("Before(k01000x) = %q, %v", k, ok)
+	}
+}
+
+func TestDiskBTreeReusesFreePages(t *testing.T) {
+	tree, err := OpenDiskBTree(filepath.Join(t.TempDir(), "tree.pages"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	big := bytes.Repeat([]byte("x"), 50000)
+	key := func(i int) []byte {
+		if i%2 == 0 {
+			return []byte(fmt.Sprint(i) + strings.Repeat("#", 5000)) // out of line
+		}
+		return []byte(fmt.Sprint(i))
+	}
+	fill := func() {
+		for i := 0; i < 200; i++ {
+			tree.Put(key(i), big)
+		}
+		tree.Commit(0)
+	}
+	fill()
+	pages := tree.p.meta.pageCount
+	for i := 0; i < 200; i++ {
+		tree.Delete(key(i))
+	}
+	fill()
+	if tree.p.meta.pageCount != pages {
+		t.Fatalf("file grew from %d to %d pages after delete and refill", pages, tree.p.meta.pageCount)
+	}
+}
+
+func TestDiskBTreeJournalRollback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree.pages")
+	tree, err := OpenDiskBTree(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2000; i++ {
+		tree.Put([]byte(fmt.Sprintf("k%05d", i)), []byte("old"))
+	}
+	if err := tree.Commit(1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4000; i++ {
+		tree.Put([]byte(fmt.Sprintf("k%05d", i)), []byte("new"))
+	}
+	// crash in the middle of a commit: journal saved, pages overwritten,
+	// meta page and journal removal never happen
+	ids := []uint32{0}
+	for _, f := range tree.p.pool.dirtyFrames() {
+		ids = append(ids, f.id)
+	}
+	if err := tree.p.journalPages(ids); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.p.pool.flushAll(); err != nil {
+		t.Fatal(err)
+	}
+	tree.p.journal.Close()
+	tree.p.file.Close()
+	if _, err := os.Stat(path + "-journal"); err != nil {
+		t.Fatalf("journal missing: %v", err)
+	}
+
+	tree, err = OpenDiskBTree(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if tree.LSN() != 1 || tree.Len() != 2000 {
+		t.Fatalf("after recovery LSN=%d Len=%d, want 1 and 2000", tree.LSN(), tree.Len())
+	}
+	if keys := checkDiskBTree(t, tree); len(keys) != 2000 {
+		t.Fatalf("recovered tree has %d keys", len(keys))
+	}
+	if v, _, _ := tree.Get([]byte("k00010")); string(v) != "old" {
+		t.Fatalf("k00010 = %q after rollback", v)
+	}
+}
+
+func TestDiskBTreeSmallPool(t *testing.T) {
+	var durable uint64
+	opts := &DiskOptions{
+		PoolBytes: 8 * pageSize,
+		FlushWAL: func(lsn uint64) error {
+			if lsn > durable {
+				durable = lsn
+			}
+			return nil
+		},
+	}
+	path := filepath.Join(t.TempDir(), "tree.pages")
+	tree, err := OpenDiskBTree(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	// every page write-back must come after the log covering it is durable
+	store := tree.p.pool.store
+	tree.p.pool.store = func(id uint32, buf []byte) error {
+		if i, ok := tree.p.pool.table[id]; ok && tree.p.pool.frames[i].lsn > durable {
+			t.Fatalf("page %d (lsn %d) written before WAL was durable past %d", id, tree.p.pool.frames[i].lsn, durable)
+		}
+		return store(id, buf)
+	}
+
+	for i := 0; i < 3000; i++ {
+		tree.SetLSN(uint64(i + 1))
+		if err := tree.Put([]byte(fmt.Sprintf("k%05d", i)), []byte("committed")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Commit(3000); err != nil {
+		t.Fatal(err)
+	}
+	st := tree.Stats()
+	if st.Frames != 8 || st.Evictions == 0 || st.Dirty != 0 {
+		t.Fatalf("unexpected pool stats %+v", st)
+	}
+
+	// changes spilled to disk by eviction are undone by Rollback
+	for i := 0; i < 3000; i++ {
+		tree.SetLSN(uint64(3001 + i))
+		tree.Put([]byte(fmt.Sprintf("k%05d", i)), []byte("rolled back"))
+		tree.Delete([]byte(fmt.Sprintf("k%05d", i+1)))
+	}
+	if err := tree.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if keys := checkDiskBTree(t, tree); len(keys) != 3000 {
+		t.Fatalf("after rollback tree has %d keys", len(keys))
+	}
+	for i := 0; i < 3000; i += 97 {
+		v, ok, err := tree.Get([]byte(fmt.Sprintf("k%05d", i)))
+		if err != nil || !ok || string(v) != "committed" {
+			t.Fatalf("k%05d = %q, %v, %v after rollback", i, v, ok, err)
+		}
+	}
+	if st := tree.Stats(); st.Misses == 0 || st.HitRate() <= 0 || st.HitRate() >= 1 {
+		t.Fatalf("hit rate %.2f", st.HitRate())
+	}
+}
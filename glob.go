@@ -0,0 +1,125 @@
+package main
+
+// Redis-style glob matching for KEYS patterns:
+//   *      any run of bytes, including none
+//   ?      exactly one byte
+//   [abc]  one byte from the set; [^abc] negates, [a-z] is a range
+//   \x     the literal byte x
+
+// globMatch reports whether key matches pattern.
+func globMatch(pattern, key string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(key); i++ {
+				if globMatch(pattern, key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(key) == 0 {
+				return false
+			}
+			pattern, key = pattern[1:], key[1:]
+		case '[':
+			if len(key) == 0 {
+				return false
+			}
+			ok, rest := matchClass(pattern[1:], key[0])
+			if !ok {
+				return false
+			}
+			pattern, key = rest, key[1:]
+		default:
+			c := pattern[0]
+			if c == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+				c = pattern[0]
+			}
+			if len(key) == 0 || key[0] != c {
+				return false
+			}
+			pattern, key = pattern[1:], key[1:]
+		}
+	}
+	return len(key) == 0
+}
+
+// matchClass matches c against the bracket expression at the start of p
+// (just after the '['), returning the match and the pattern after ']'. An
+// unterminated class runs to the end of the pattern, as in Redis.
+func matchClass(p string, c byte) (bool, string) {
+	negate := false
+	if len(p) > 0 && p[0] == '^' {
+		negate = true
+		p = p[1:]
+	}
+	matched := false
+	for len(p) > 0 && p[0] != ']' {
+		lo := p[0]
+		if lo == '\\' && len(p) > 1 {
+			p = p[1:]
+			lo = p[0]
+		}
+		p = p[1:]
+		hi := lo
+		if len(p) > 1 && p[0] == '-' && p[1] != ']' {
+			hi = p[1]
+			if hi == '\\' && len(p) > 2 {
+				hi = p[2]
+				p = p[1:]
+			}
+			p = p[2:]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+	}
+	if len(p) > 0 {
+		p = p[1:] // skip ']'
+	}
+	return matched != negate, p
+}
+
+// globPrefix returns the literal prefix of pattern before its first
+// wildcard, which bounds the keys that could possibly match.
+func globPrefix(pattern string) string {
+	prefix := make([]byte, 0, len(pattern))
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*', '?', '[':
+			return string(prefix)
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			prefix = append(prefix, pattern[i])
+		default:
+			prefix = append(prefix, c)
+		}
+	}
+	return string(prefix)
+}
+
+// prefixEnd returns the smallest key greater than every key that starts
+// with prefix, or "" when no such bound exists (prefix is all 0xff bytes).
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
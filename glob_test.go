@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"user:*", "user:42", true},
+		{"user:*", "users", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"*:*:end", "a:b:end", true},
+		{"*:*:end", "a:end", false},
+	}
+	for _, c := range cases {
+		if got := globMatch(c.pattern, c.key); got != c.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", c.pattern, c.key, got, c.want)
+		}
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	cases := map[string]string{
+		"user:":    "user;",
+		"a\xff":    "b",
+		"\xff\xff": "",
+		"":         "",
+		"key\x00":  "key\x01",
+	}
+	for prefix, want := range cases {
+		if got := prefixEnd(prefix); got != want {
+			t.Errorf("prefixEnd(%q) = %q, want %q", prefix, got, want)
+		}
+	}
+	if got := globPrefix(`user:\*x*`); got != "user:*x" {
+		t.Errorf("globPrefix = %q", got)
+	}
+}
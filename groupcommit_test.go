@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGroupCommitAcknowledgesDurableWrites(t *testing.T) {
+	for _, p := range []SyncPolicy{SyncGroup, SyncAlways} {
+		dir := t.TempDir()
+		kv := openCheckpointKV(t, dir, &Options{Sync: p})
+		var wg sync.WaitGroup
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					if err := kv.Set([]byte(fmt.Sprintf("w%d-%02d", w, i)), []byte("v")); err != nil {
+						t.Errorf("%v: Set: %v", p, err)
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+		kv.Del([]byte("w0-00"))
+
+		// acknowledged means already in the log, before any Close
+		if n := len(walLSNs(t, kv.walPath)); n != 401 {
+			t.Fatalf("%v: %d records on disk after 401 acknowledged writes", p, n)
+		}
+		st := kv.Stats()
+		if st.SyncedLSN != 401 || st.WALSyncs == 0 || st.WALSyncs > 401 {
+			t.Fatalf("%v: synced to %d with %d fsyncs", p, st.SyncedLSN, st.WALSyncs)
+		}
+		kv.Close()
+	}
+}
+
+func TestGroupCommitTransaction(t *testing.T) {
+	kv := openCheckpointKV(t, t.TempDir(), nil)
+	defer kv.Close()
+	tx := kv.Begin()
+	tx.Set([]byte("a"), []byte("1"))
+	tx.Set([]byte("b"), []byte("2"))
+	if n := len(walLSNs(t, kv.walPath)); n != 0 {
+		t.Fatalf("%d records logged before Commit", n)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(walLSNs(t, kv.walPath)); n != 1 {
+		t.Fatalf("%d records on disk after Commit, want the one TXN", n)
+	}
+}
+
+func TestSyncIntervalAndNone(t *testing.T) {
+	for _, p := range []SyncPolicy{SyncInterval, SyncNone} {
+		dir := t.TempDir()
+		kv := openCheckpointKV(t, dir, &Options{Sync: p, SyncEvery: 5 * time.Millisecond})
+		for i := 0; i < 100; i++ {
+			kv.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("v"))
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for kv.Stats().SyncedLSN != 100 {
+			if time.Now().After(deadline) {
+				t.Fatalf("%v: background flush never caught up", p)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if syncs := kv.Stats().WALSyncs; (p == SyncNone) != (syncs == 0) {
+			t.Fatalf("%v: %d fsyncs", p, syncs)
+		}
+		kv.Close()
+
+		kv = openCheckpointKV(t, dir, nil)
+		if n := kv.Count(); n != 100 {
+			t.Fatalf("%v: Count after reopen = %d", p, n)
+		}
+		kv.Close()
+	}
+}
+
+func TestGroupCommitWriteErrorIsSticky(t *testing.T) {
+	kv := openCheckpointKV(t, t.TempDir(), nil)
+	defer kv.Close()
+	if err := kv.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	// make the next flush fail
+	kv.walLock.Lock()
+	kv.walFile.Close()
+	kv.walLock.Unlock()
+	if err := kv.Set([]byte("b"), []byte("2")); err == nil {
+		t.Fatal("Set acknowledged a write the WAL could not take")
+	}
+	if err := kv.Del([]byte("a")); err == nil {
+		t.Fatal("later write acknowledged after a WAL failure")
+	}
+	if st := kv.Stats(); st.SyncedLSN != 1 {
+		t.Fatalf("synced LSN %d, want 1", st.SyncedLSN)
+	}
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	for _, p := range []SyncPolicy{SyncGroup, SyncAlways, SyncInterval, SyncNone} {
+		if got, err := ParseSyncPolicy(p.String()); err != nil || got != p {
+			t.Fatalf("ParseSyncPolicy(%q) = %v, %v", p.String(), got, err)
+		}
+	}
+	if _, err := ParseSyncPolicy("sometimes"); err == nil {
+		t.Fatal("bad policy name accepted")
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openTestKV(t *testing.T) *UltraKV {
+	t.Helper()
+	dir := t.TempDir()
+	kv, err := NewUltraKV(filepath.Join(dir, "test.db"), filepath.Join(dir, "test.db.wal"))
+	if err != nil {
+		t.Fatalf("NewUltraKV: %v", err)
+	}
+	t.Cleanup(kv.Close)
+	return kv
+}
+
+func scanKeys(entries []Entry) []string {
+	keys := make([]string, len(entries))
+	for i, e := range entries {
+		keys[i] = string(e.Key)
+	}
+	return keys
+}
+
+func TestUltraKVScanMatchesGet(t *testing.T) {
+	kv := openTestKV(t)
+	for i := 0; i < 20; i++ {
+		kv.Set([]byte(fmt.Sprintf("k%02d", i)), []byte(fmt.Sprint(i)))
+	}
+	// no explicit flush: some of these are still queued for writeFlusher
+	kv.Del([]byte("k03"))
+	kv.Set([]byte("k05"), []byte("five"))
+
+	entries := kv.Scan([]byte("k02"), []byte("k07"), 0)
+	want := []string{"k02", "k04", "k05", "k06"}
+	if got := scanKeys(entries); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("Scan keys = %v, want %v", got, want)
+	}
+	for _, e := range entries {
+		v, ok := kv.Get(e.Key)
+		if !ok || !bytes.Equal(v, e.Value) {
+			t.Fatalf("Scan returned %q=%q but Get says %q, %v", e.Key, e.Value, v, ok)
+		}
+	}
+	if got := kv.Scan([]byte("k10"), nil, 3); fmt.Sprint(scanKeys(got)) != "[k10 k11 k12]" {
+		t.Fatalf("limited Scan = %v", scanKeys(got))
+	}
+
+	tx := kv.Begin()
+	tx.Set([]byte("k025"), []byte("tx"))
+	tx.Del([]byte("k04"))
+	if got := scanKeys(tx.Scan([]byte("k02"), []byte("k05"), 0)); fmt.Sprint(got) != "[k02 k025]" {
+		t.Fatalf("Scan inside transaction = %v", got)
+	}
+	tx.Rollback()
+	if got := scanKeys(kv.Scan([]byte("k02"), []byte("k05"), 0)); fmt.Sprint(got) != "[k02 k04]" {
+		t.Fatalf("Scan after abort = %v", got)
+	}
+}
+
+func TestUltraKVPrefixAndKeys(t *testing.T) {
+	kv := openTestKV(t)
+	for _, k := range []string{"user:1", "user:2", "user:10", "users", "order:1", "user;x"} {
+		kv.Set([]byte(k), []byte("v"))
+	}
+	kv.Del([]byte("user:2"))
+
+	if got := scanKeys(kv.ScanPrefix([]byte("user:"), 0)); fmt.Sprint(got) != "[user:1 user:10]" {
+		t.Fatalf("ScanPrefix(user:) = %v", got)
+	}
+	if got := scanKeys(kv.ScanPrefix(nil, 2)); fmt.Sprint(got) != "[order:1 user:1]" {
+		t.Fatalf("ScanPrefix(\"\", 2) = %v", got)
+	}
+	if got := kv.Keys("user:?"); fmt.Sprintf("%s", got) != "[user:1]" {
+		t.Fatalf("Keys(user:?) = %v", got)
+	}
+	if got := kv.Keys("*:1*"); fmt.Sprintf("%s", got) != "[order:1 user:1 user:10]" {
+		t.Fatalf("Keys(*:1*) = %v", got)
+	}
+
+	// a transaction sees its own writes, and conflicts over what it listed
+	tx := kv.Begin()
+	tx.Set([]byte("user:3"), []byte("v"))
+	tx.Del([]byte("user:1"))
+	if got := scanKeys(tx.ScanPrefix([]byte("user:"), 0)); fmt.Sprint(got) != "[user:10 user:3]" {
+		t.Fatalf("tx.ScanPrefix(user:) = %v", got)
+	}
+	if got := tx.Keys("user:?"); fmt.Sprintf("%s", got) != "[user:3]" {
+		t.Fatalf("tx.Keys(user:?) = %v", got)
+	}
+	kv.Set([]byte("user:4"), []byte("v"))
+	if err := tx.Commit(); err != ErrConflict {
+		t.Fatalf("Commit after a key was added to a listed range = %v", err)
+	}
+}
+
+func TestUltraKVCursor(t *testing.T) {
+	kv := openTestKV(t)
+	for i := 0; i < 50; i++ {
+		kv.Set([]byte(fmt.Sprintf("k%02d", i)), []byte(fmt.Sprint(i)))
+	}
+	kv.Del([]byte("k48"))
+
+	// "latest N": walk backwards from the end
+	c := kv.Cursor()
+	var latest []string
+	for ok := c.Last(); ok && len(latest) < 3; ok = c.Prev() {
+		latest = append(latest, string(c.Key()))
+	}
+	if fmt.Sprint(latest) != "[k49 k47 k46]" {
+		t.Fatalf("latest 3 = %v", latest)
+	}
+
+	// writes landing in the tree mid-iteration are picked up
+	if !c.Seek([]byte("k10")) {
+		t.Fatal("Seek(k10) failed")
+	}
+	kv.Set([]byte("k10x"), []byte("new"))
+	kv.syncTree()
+	if !c.Next() || string(c.Key()) != "k10x" {
+		t.Fatalf("Next after concurrent write at %q", c.Key())
+	}
+}
+
+func TestUltraKVImport(t *testing.T) {
+	dir := t.TempDir()
+	dbPath, walPath := filepath.Join(dir, "test.db"), filepath.Join(dir, "test.db.wal")
+	kv, err := NewUltraKV(dbPath, walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.Set([]byte("a"), []byte("old"))
+	kv.Set([]byte("zz"), []byte("kept"))
+	var entries []Entry
+	for i := 999; i >= 0; i-- {
+		entries = append(entries, Entry{Key: []byte(fmt.Sprintf("imp%04d", i)), Value: []byte(fmt.Sprint(i))})
+	}
+	entries = append(entries, Entry{Key: []byte("a"), Value: []byte("first")},
+		Entry{Key: []byte("a"), Value: []byte("new")})
+	if err := kv.Import(entries, DefaultFillFactor); err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	kv.Set([]byte("after"), []byte("1"))
+	kv.Del([]byte("imp0005"))
+	if v, _ := kv.Get([]byte("a")); string(v) != "new" {
+		t.Fatalf("Get(a) = %q, want new", v)
+	}
+	kv.Close()
+
+	var ops []string
+	for _, r := range walRecords(t, walPath) {
+		ops = append(ops, r.op)
+	}
+	// the import's snapshot covers everything up to its CHECKPOINT record
+	if fmt.Sprint(ops) != "[SET DEL]" {
+		t.Fatalf("WAL records = %v, want just the SET and DEL after the import", ops)
+	}
+
+	kv, err = NewUltraKV(dbPath, walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	kv.diskMu.Lock()
+	keys := checkDiskBTree(t, kv.disk)
+	kv.diskMu.Unlock()
+	if len(keys) != 1002 {
+		t.Fatalf("reopened page file has %d keys, want 1002", len(keys))
+	}
+	for k, want := range map[string]string{"a": "new", "zz": "kept", "imp0999": "999", "after": "1"} {
+		if v, ok := kv.Get([]byte(k)); !ok || string(v) != want {
+			t.Fatalf("Get(%s) = %q, %v; want %q", k, v, ok, want)
+		}
+	}
+	if _, ok := kv.Get([]byte("imp0005")); ok {
+		t.Fatal("delete after the checkpoint was lost")
+	}
+}
+
+func TestUltraKVBinarySafe(t *testing.T) {
+	dir := t.TempDir()
+	dbPath, walPath := filepath.Join(dir, "test.db"), filepath.Join(dir, "test.db.wal")
+	kv, err := NewUltraKV(dbPath, walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payloads := map[string][]byte{
+		"tab\tkey":      []byte("a\tb"),
+		"nl\nkey":       []byte("line1\nline2\n"),
+		"\x00\xff":      {0, 1, 2, 0xff, '\n', '\r', '\t'},
+		"SET 3 4\nfake": []byte("DEL 1\nx\n"),
+		"empty":         {},
+		"big":           bytes.Repeat([]byte{0, '\n', 0xfe}, 100000),
+	}
+	for k, v := range payloads {
+		kv.Set([]byte(k), v)
+	}
+	kv.Del([]byte("empty"))
+	kv.Close()
+
+	kv, err = NewUltraKV(dbPath, walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	for k, want := range payloads {
+		v, ok := kv.Get([]byte(k))
+		if k == "empty" {
+			if ok {
+				t.Fatal("deleted key came back")
+			}
+			continue
+		}
+		if !ok || !bytes.Equal(v, want) {
+			t.Fatalf("Get(%q) = %q, %v after restart", k, v, ok)
+		}
+	}
+}
+
+func TestUltraKVUpgradesLegacyWAL(t *testing.T) {
+	dir := t.TempDir()
+	dbPath, walPath := filepath.Join(dir, "test.db"), filepath.Join(dir, "test.db.wal")
+	os.WriteFile(walPath, []byte("SET\ta\t1\nSET\tb\tx y\nDEL\ta\nbogus\n"), 0644)
+	kv, err := NewUltraKV(dbPath, walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.Set([]byte("c"), []byte("3\n"))
+	kv.Close()
+
+	kv, err = NewUltraKV(dbPath, walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	if got := fmt.Sprintf("%q", kv.Scan(nil, nil, 0)); got != `[{"b" "x y"} {"c" "3\n"}]` {
+		t.Fatalf("after upgrade: %s", got)
+	}
+	if _, err := os.Stat(walPath); !os.IsNotExist(err) {
+		t.Fatalf("old WAL not retired: %v", err)
+	}
+	if ops := walRecords(t, walPath); len(ops) != 1 || ops[0].key != "c" {
+		t.Fatalf("WAL after upgrade = %+v, want just the SET of c", ops)
+	}
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"os"
-	"strings"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,81 +17,235 @@ type WriteOp struct {
 	OpType string
 	Key    string
 	Value  string // empty for del
+
+	seq  uint64 // matches the pending entry this op resolves
+	lsn  uint64 // record it was logged in
+	last bool   // the record's last op
+}
+
+// pendingWrite is a write that is visible through the cache but has not yet
+// been applied to the B-tree by writeFlusher. value is nil for a delete.
+type pendingWrite struct {
+	seq   uint64
+	value *string
+}
+
+// walEntry is an encoded record waiting in the WAL buffers.
+type walEntry struct {
+	lsn   uint64
+	frame string
 }
 
 // UltraKV: High-performance, ACID-compliant key-value store
 //
 // ARCHITECTURE:
-// - WAL writes: IMMEDIATE and SYNCHRONOUS for ACID durability
+// - WAL writes: acknowledged per Options.Sync, by default once group
+//   committed to disk (see groupcommit.go)
 // - B-tree updates: BATCHED for performance (500 ops or 100ms timeout)
 // - Cache updates: IMMEDIATE for read performance
-// - Crash recovery: WAL replay rebuilds B-tree on startup
+// - Page file: the B-tree lives on disk, read through a bounded buffer
+//   pool, and every batch is committed to it tagged with its LSN (see
+//   pagefile.go); encrypted stores keep it in memory instead
+// - Crash recovery: open the page file, replay the WAL records after it
 //
 // This ensures ACID compliance while maintaining high throughput through
+//
+// Keys and values are arbitrary bytes. Internally they are held as Go
+// strings, which are immutable byte sequences, so nothing is lost or
+// reinterpreted; the API copies at the boundary so callers may reuse their
+// slices.
 
 type UltraKV struct {
 	btree     *BTree
-	walFile   *os.File
-	walPath   string
+	walFile   *os.File // active WAL segment
+	walPath   string   // prefix of the segment file names
 	btreePath string
 	lock      sync.Mutex
 	walLock   sync.Mutex // Dedicated lock for immediate WAL writes
-	inTx      bool
-	txBuffer  map[string]*string // nil means delete
+	// ckptLock is held shared by every WAL write + queue pair and
+	// exclusively by checkpoints and Import, so they see no write half done
+	ckptLock  sync.RWMutex
+	ckptMu    sync.Mutex    // one checkpoint or Import at a time
+	ckptLSN   atomic.Uint64 // LSN of the newest snapshot
+	ckptBytes atomic.Int64  // WAL bytes written since the last checkpoint
+	ckptCh    chan struct{}
+	ckptWG    sync.WaitGroup
+	opts      Options
+	lsn       uint64 // last LSN handed out; guarded by walBufferMutex
+	lastTime  int64  // time of that record; guarded by walBufferMutex
+
+	// active segment state; guarded by walLock
+	walSegSize    int64
+	walSegOpened  time.Time
+	walFlushedLSN uint64
+	walHeader     string           // what new segments start with
+	walBlocks     *walBlockEncoder // nil when segments hold plain frames
+	keys          *keyring         // nil when not encrypting
+
+	// group commit: writers wait on walSyncedCh, which is closed and
+	// replaced after every flush; guarded by walSyncMu
+	walSyncMu    sync.Mutex
+	walSyncedLSN uint64
+	walSyncedCh  chan struct{}
+	walErr       error
+	walSyncs     atomic.Uint64
+
+	// open change subscriptions (see subscribe.go); guarded by subMu
+	subMu sync.Mutex
+	subs  map[*Subscription]struct{}
+	subWG sync.WaitGroup
 
 	// Double Buffer WAL optimization
-	walActiveBuffer []string
-	walFlushBuffer  []string
+	walActiveBuffer []walEntry
+	walFlushBuffer  []walEntry
 	walBufferMutex  sync.RWMutex
 	walFlushCh      chan struct{}
 	walFlusherWG    sync.WaitGroup
 
 	writeCh   chan WriteOp
 	flushCh   chan struct{}
+	syncCh    chan chan struct{} // flush everything queued, then ack
 	cache     map[string]string
 	cacheLock sync.RWMutex
-	flusherWG sync.WaitGroup
-	closeCh   chan struct{}
-}
+	// pending tracks ops queued on writeCh so reads can see them before
+	// the flusher lands them in the B-tree; guarded by cacheLock
+	pending    map[string]pendingWrite
+	pendingSeq uint64 // bumped by every write, so cold reads can tell
+	flusherWG  sync.WaitGroup
+	closeCh    chan struct{}
 
-func NewUltraKV(btreePath, walPath string) (*UltraKV, error) {
-	btree := NewBTree()
-	// WAL-only recovery: Skip B-Tree loading, rebuild from WAL entirely
+	// commitMu is held from logging a write to queueing it, so the WAL,
+	// the cache and writeCh see writes in the same order
+	commitMu sync.Mutex
 
-	// WHY THIS ?? ===> OPTIMIZATION: B-Tree is empty on startup, so no need to load it from file
+	// transaction snapshots and the versions they read (see mvcc.go);
+	// guarded by cacheLock
+	visibleLSN uint64 // last commit queued
+	snapshots  map[uint64]int
+	versions   map[string][]version
 
-	// WE can load btre from ssd and partially replay wal or just simpley full replay wal
+	// transactions' key locks (see locks.go)
+	keyLocks lockManager
+	txSeq    atomic.Uint64 // last Tx id
 
-	// pros : faster startup, no need to load btree from disk
+	// key versions for conditional writes (see cas.go); guarded by
+	// cacheLock. keyLSN has the last commit of each live key written since
+	// the page file or checkpoint recovered from; the others are at
+	// baseVersion.
+	keyLSN      map[string]uint64
+	baseVersion uint64
 
-	// cons : for larger  datasets, WAL replay can be slower than loading a pre-built B-Tree
+	// page file (see pagefile.go), which holds the tree unless encrypting,
+	// when paged, fixed at open, is false and disk nil. diskLSN is the log
+	// position it holds every write through, diskOps the writes applied
+	// since its last commit, diskErr what stopped it being updated and
+	// diskSnap the snapshot being read out of it. Guarded by diskMu.
+	paged         bool
+	disk          *DiskBTree
+	diskLSN       uint64
+	diskOps       []WriteOp
+	diskErr       error
+	diskFailed    atomic.Bool // diskErr is set
+	diskSnap      *pageSnapshot
+	diskCommitted time.Time
+	diskMu        sync.Mutex
+
+	// read counters for Stats
+	cacheHits, treeHits, readMisses atomic.Uint64
+}
 
-	
+// ErrClosed is returned by operations that need the background workers
+// after Close.
+var ErrClosed = errors.New("godb: store is closed")
 
+// StoreStats is a snapshot of store counters.
+type StoreStats struct {
+	CacheEntries  int
+	PendingWrites int
+	Snapshots     int    // open transactions' snapshots
+	Versions      int    // old values kept for them to read
+	CacheHits     uint64 // Gets answered from the cache
+	TreeHits      uint64 // Gets that had to search the B-tree
+	Misses        uint64 // Gets for keys that do not exist
+	LSN           uint64 // last record written to the WAL
+	SyncedLSN     uint64 // last record flushed (and fsynced unless SyncNone)
+	CheckpointLSN uint64 // newest snapshot
+	WALSyncs      uint64 // fsyncs of the WAL, one per group commit
 
+	// Pool counts the page file's buffer pool; zero without a page file.
+	Pool PoolStats
+}
+
+// CacheHitRate returns the fraction of successful Gets served by the cache.
+func (s StoreStats) CacheHitRate() float64 {
+	if s.CacheHits+s.TreeHits == 0 {
+		return 0
+	}
+	return float64(s.CacheHits) / float64(s.CacheHits+s.TreeHits)
+}
 
-	walFile, err := os.OpenFile(walPath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+// NewUltraKV opens the store with default Options.
+func NewUltraKV(btreePath, walPath string) (*UltraKV, error) {
+	return NewUltraKVWithOptions(btreePath, walPath, nil)
+}
+
+// NewUltraKVWithOptions opens the store. Recovery loads the newest valid
+// checkpoint snapshot and replays only the WAL records after it.
+func NewUltraKVWithOptions(btreePath, walPath string, opts *Options) (*UltraKV, error) {
+	if opts != nil {
+		if _, ok := walCodecNames[opts.WALCodec]; !ok {
+			return nil, fmt.Errorf("godb: unknown WAL codec %d", opts.WALCodec)
+		}
+	}
+	keys, err := newKeyring(opts.withDefaults().EncryptionKeys)
 	if err != nil {
 		return nil, err
 	}
+	btree := NewBTree()
 	kv := &UltraKV{
+		opts:      opts.withDefaults(),
+		ckptCh:    make(chan struct{}, 1),
 		btree:     btree,
-		walFile:   walFile,
 		walPath:   walPath,
 		btreePath: btreePath,
-		txBuffer:  make(map[string]*string),
+		keys:      keys,
 
 		// Initialize double buffer WAL
-		walActiveBuffer: make([]string, 0, 500),
-		walFlushBuffer:  make([]string, 0, 500),
+		walActiveBuffer: make([]walEntry, 0, 500),
+		walFlushBuffer:  make([]walEntry, 0, 500),
 		walFlushCh:      make(chan struct{}, 1),
+		walSyncedCh:     make(chan struct{}),
+		subs:            make(map[*Subscription]struct{}),
 
 		writeCh: make(chan WriteOp, 10000),
 		flushCh: make(chan struct{}, 1),
+		syncCh:  make(chan chan struct{}),
 		cache:   make(map[string]string),
+		pending: make(map[string]pendingWrite),
 		closeCh: make(chan struct{}),
+
+		snapshots: make(map[uint64]int),
+		versions:  make(map[string][]version),
+		keyLSN:    make(map[string]uint64),
+	}
+	kv.walHeader = walHeader(kv.opts.WALCodec, keys)
+	if kv.walBlocks, err = newWALBlockEncoder(kv.opts.WALCodec, keys, kv.walHeader); err != nil {
+		return nil, err
 	}
-	if err := kv.replayWAL(); err != nil {
+	if err := kv.openPages(); err != nil {
+		return nil, err
+	}
+	kv.paged = kv.disk != nil
+	legacy, err := kv.replayWAL()
+	if err != nil {
+		if kv.disk != nil {
+			kv.disk.Close() // leaving what replay changed uncommitted
+		}
+		return nil, err
+	}
+	kv.visibleLSN = kv.lsn
+	if err := kv.openSegmentLocked(); err != nil {
+		kv.closePages() // replay is complete, so committing it is safe
 		return nil, err
 	}
 
@@ -100,6 +256,17 @@ func NewUltraKV(btreePath, walPath string) (*UltraKV, error) {
 	kv.walFlusherWG.Add(1)
 	go kv.walBackgroundFlusher()
 
+	kv.ckptWG.Add(1)
+	go kv.checkpointer()
+
+	if legacy {
+		// the old formats cannot hold every key and value, and the old
+		// single-file log is not a segment: checkpoint, which retires it
+		if err := kv.Checkpoint(); err != nil {
+			kv.Close()
+			return nil, err
+		}
+	}
 	return kv, nil
 }
 
@@ -107,14 +274,14 @@ func (kv *UltraKV) Close() {
 	close(kv.closeCh)
 	kv.flusherWG.Wait()
 	kv.walFlusherWG.Wait()
+	kv.ckptWG.Wait()
+	kv.subWG.Wait()
 
 	// Save B-Tree snapshot on clean shutdown (for backup, not recovery)
-	if err := kv.btree.SaveToFile(kv.btreePath); err != nil {
-		// fmt.Printf("[DEBUG] Error saving B-tree snapshot on shutdown: %v\n", err)
-	} else {
-		// fmt.Println("[DEBUG] B-tree snapshot saved on shutdown")
-	}
+	kv.persist()
+	kv.closePages()
 
+	kv.walFile.Sync() // even under SyncNone, a clean shutdown loses nothing
 	kv.walFile.Close()
 }
 
@@ -125,162 +292,566 @@ func (kv *UltraKV) Finish() {
 	go kv.writeFlusher()
 }
 
-func (kv *UltraKV) Begin() {
-	kv.lock.Lock()
-	defer kv.lock.Unlock()
-	if kv.inTx {
-		fmt.Println("[DEBUG] Transaction already in progress")
-		return
-	}
-	kv.inTx = true
-	kv.txBuffer = make(map[string]*string)
-	// fmt.Println("[DEBUG] Transaction started")
+// Set stores value under key. It returns once the write is as durable as
+// Options.Sync promises; an error means it may not survive a crash.
+func (kv *UltraKV) Set(key, value []byte) error {
+	return kv.set(string(key), string(value))
 }
 
-func (kv *UltraKV) Set(key, value string) {
-	if kv.inTx {
-		kv.lock.Lock()
-		kv.txBuffer[key] = &value
-		kv.lock.Unlock()
-		return
+func (kv *UltraKV) set(key, value string) error {
+	lsn, err := kv.writeKey(nil, "SET", key, value, WriteOp{OpType: "set", Key: key, Value: value})
+	if err != nil {
+		return err
 	}
-
-	// CRITICAL: WAL MUST be written BEFORE operation for ACID compliance
-	kv.writeWAL("SET", key, value)
-
-	// update cache immediately for read performance
-	kv.cacheLock.Lock()
-	kv.cache[key] = value
-	kv.cacheLock.Unlock()
-
-	kv.writeCh <- WriteOp{OpType: "set", Key: key, Value: value}
+	return kv.waitDurable(lsn)
 }
 
-func (kv *UltraKV) Get(key string) (string, bool) {
-	if kv.inTx {
-		kv.lock.Lock()
-		if v, ok := kv.txBuffer[key]; ok {
-			kv.lock.Unlock()
-			if v == nil {
-				return "", false
-			}
-			return *v, true
-		}
-		kv.lock.Unlock()
+// Get returns a copy of the value stored under key.
+func (kv *UltraKV) Get(key []byte) ([]byte, bool) {
+	v, ok := kv.get(string(key))
+	if !ok {
+		return nil, false
 	}
+	return []byte(v), true
+}
 
+func (kv *UltraKV) get(key string) (string, bool) {
 	kv.cacheLock.RLock()
+	p, queued := kv.pending[key]
 	v, ok := kv.cache[key]
+	seq := kv.pendingSeq
 	kv.cacheLock.RUnlock()
+	if queued {
+		// still waiting for the flusher or a page file commit: the tree
+		// may be stale and the cache may have let it go
+		if p.value == nil {
+			kv.readMisses.Add(1)
+			return "", false
+		}
+		ok, v = true, *p.value
+	}
 	if ok {
+		kv.cacheHits.Add(1)
 		return v, true
 	}
 
 	// b tree search for non cached keys cold lookip
-	val, found := kv.btree.Get([]byte(key))
+	val, found := kv.treeGet(key)
 	if found {
-		// cache the result for future reads -> convert to hot keys
+		kv.treeHits.Add(1)
+		// cache the result for future reads -> convert to hot keys, unless
+		// a write was queued since: it may have replaced what was read
 		kv.cacheLock.Lock()
-		kv.cache[key] = string(val)
+		if kv.pendingSeq == seq {
+			kv.cacheLocked(key, string(val))
+		}
 		kv.cacheLock.Unlock()
 		return string(val), true
 	}
+	kv.readMisses.Add(1)
 	return "", false
 }
 
-func (kv *UltraKV) Del(key string) {
-	if kv.inTx {
-		kv.lock.Lock()
-		kv.txBuffer[key] = nil
-		kv.lock.Unlock()
-		return
+// treeGet looks key up in the tree: the page file, or the in-memory B-tree,
+// which is searched lock-free because it is copy-on-write and writeFlusher
+// only publishes new roots.
+func (kv *UltraKV) treeGet(key string) ([]byte, bool) {
+	if kv.paged {
+		return kv.getPages(key)
 	}
+	return kv.btree.Get([]byte(key))
+}
 
-	// CRITICAL: WAL MUST be written BEFORE operation for ACID compliance
-	kv.writeWAL("DEL", key, "")
+// cacheLocked caches value under key, first evicting an arbitrary entry if
+// the cache is full; cacheLock is held. Pending writes stay readable in the
+// pending set when their cache entries go.
+func (kv *UltraKV) cacheLocked(key, value string) {
+	if _, ok := kv.cache[key]; !ok && len(kv.cache) >= kv.opts.CacheEntries {
+		for k := range kv.cache {
+			delete(kv.cache, k)
+			break
+		}
+	}
+	kv.cache[key] = value
+}
 
+// dropPending forgets the pending entries of ops, now in the tree, unless
+// a later write has replaced them.
+func (kv *UltraKV) dropPending(ops []WriteOp) {
+	if len(ops) == 0 {
+		return
+	}
 	kv.cacheLock.Lock()
-	delete(kv.cache, key)
-	kv.cacheLock.Unlock()
+	defer kv.cacheLock.Unlock()
+	for _, op := range ops {
+		if p, ok := kv.pending[op.Key]; ok && p.seq == op.seq {
+			delete(kv.pending, op.Key)
+		}
+	}
+}
 
-	// send to batched B-tree writer
-	kv.writeCh <- WriteOp{OpType: "del", Key: key}
+// Stats returns the current store counters.
+func (kv *UltraKV) Stats() StoreStats {
+	var pool PoolStats
+	kv.diskMu.Lock()
+	if kv.disk != nil {
+		pool = kv.disk.Stats()
+	}
+	kv.diskMu.Unlock()
+	kv.cacheLock.RLock()
+	defer kv.cacheLock.RUnlock()
+	versions := 0
+	for _, h := range kv.versions {
+		versions += len(h)
+	}
+	snapshots := 0
+	for _, n := range kv.snapshots {
+		snapshots += n
+	}
+	return StoreStats{
+		CacheEntries:  len(kv.cache),
+		PendingWrites: len(kv.pending),
+		Snapshots:     snapshots,
+		Versions:      versions,
+		CacheHits:     kv.cacheHits.Load(),
+		TreeHits:      kv.treeHits.Load(),
+		Misses:        kv.readMisses.Load(),
+		LSN:           kv.lastLSN(),
+		SyncedLSN:     kv.syncedLSN(),
+		CheckpointLSN: kv.ckptLSN.Load(),
+		WALSyncs:      kv.walSyncs.Load(),
+		Pool:          pool,
+	}
 }
 
-func (kv *UltraKV) Commit() {
-	kv.lock.Lock()
-	if !kv.inTx {
-		kv.lock.Unlock()
-		return
+func (kv *UltraKV) syncedLSN() uint64 {
+	kv.walSyncMu.Lock()
+	defer kv.walSyncMu.Unlock()
+	return kv.walSyncedLSN
+}
+
+func (kv *UltraKV) lastLSN() uint64 {
+	kv.walBufferMutex.RLock()
+	defer kv.walBufferMutex.RUnlock()
+	return kv.lsn
+}
+
+// Del removes key, acknowledging like Set.
+func (kv *UltraKV) Del(key []byte) error {
+	return kv.del(string(key))
+}
+
+func (kv *UltraKV) del(key string) error {
+	lsn, err := kv.writeKey(nil, "DEL", key, "", WriteOp{OpType: "del", Key: key})
+	if err != nil {
+		return err
 	}
-	ops := make([]WriteOp, 0, len(kv.txBuffer))
-	for k, v := range kv.txBuffer {
-		if v == nil {
-			ops = append(ops, WriteOp{OpType: "del", Key: k})
-		} else {
-			ops = append(ops, WriteOp{OpType: "set", Key: k, Value: *v})
+	return kv.waitDurable(lsn)
+}
+
+// logAndQueue writes one WAL record and queues the ops it covers, which
+// commit together at its LSN, and returns the LSN. check, if not nil, runs
+// first with no other commit able to land before this one; an error from
+// it is returned and nothing is written. Nothing is written either once
+// the page file has failed.
+func (kv *UltraKV) logAndQueue(check func() error, op, key, value string, ops ...WriteOp) (uint64, error) {
+	// CRITICAL: WAL MUST be written BEFORE operation for ACID compliance
+	kv.ckptLock.RLock()
+	defer kv.ckptLock.RUnlock()
+	kv.commitMu.Lock()
+	defer kv.commitMu.Unlock()
+	if err := kv.pagesError(); err != nil {
+		return 0, err
+	}
+	if check != nil {
+		if err := check(); err != nil {
+			return 0, err
 		}
 	}
-	kv.lock.Unlock()
+	lsn := kv.writeWAL(op, key, value)
+	kv.queueWrites(lsn, ops)
+	return lsn, nil
+}
 
-	// CRITICAL: Write WAL IMMEDIATELY for all transaction operations (ACID compliance)
-	for _, op := range ops {
+// queueWrites makes the ops committed at lsn visible to readers through the
+// cache and the pending set, all at once, then hands them to the batched
+// B-tree writer.
+func (kv *UltraKV) queueWrites(lsn uint64, ops []WriteOp) {
+	kv.cacheLock.Lock()
+	kv.recordVersions(lsn, ops)
+	for i, op := range ops {
+		kv.pendingSeq++
+		ops[i].seq = kv.pendingSeq
+		ops[i].lsn = lsn
+		ops[i].last = i == len(ops)-1
 		if op.OpType == "set" {
-			kv.writeWAL("SET", op.Key, op.Value)
-			// Update cache immediately
-			kv.cacheLock.Lock()
-			kv.cache[op.Key] = op.Value
-			kv.cacheLock.Unlock()
+			value := op.Value
+			kv.cacheLocked(op.Key, value)
+			kv.pending[op.Key] = pendingWrite{seq: ops[i].seq, value: &value}
+			kv.keyLSN[op.Key] = lsn
 		} else {
-			kv.writeWAL("DEL", op.Key, "")
-			//  cache update immediately
-			kv.cacheLock.Lock()
 			delete(kv.cache, op.Key)
-			kv.cacheLock.Unlock()
+			kv.pending[op.Key] = pendingWrite{seq: ops[i].seq}
+			delete(kv.keyLSN, op.Key)
 		}
-		// send to batched B-tree writer
+	}
+	kv.visibleLSN = lsn
+	kv.cacheLock.Unlock()
+
+	for _, op := range ops {
 		kv.writeCh <- op
 	}
-	kv.flushCh <- struct{}{} // force flush
-	kv.lock.Lock()
-	kv.txBuffer = make(map[string]*string)
-	kv.inTx = false
-	kv.lock.Unlock()
-	fmt.Println("[DEBUG] Transaction committed") // [DEBUG]
 }
 
-func (kv *UltraKV) Abort() {
+// Scan returns the live entries with start <= key < end in key order, at
+// most limit of them (limit <= 0 means all). An empty end means no upper
+// bound. The B-tree is overlaid with writes still queued for writeFlusher,
+// so the result agrees with what Get would return for each key.
+func (kv *UltraKV) Scan(start, end []byte, limit int) []Entry {
+	return kv.scan(string(start), string(end), limit, nil)
+}
+
+// scan is Scan as the open transaction tx sees it, or as of now when tx is
+// nil. The tree cannot move while kv.lock is held, so the pending set and
+// versions read here cover every write it holds.
+func (kv *UltraKV) scan(start, end string, limit int, tx *Tx) []Entry {
 	kv.lock.Lock()
 	defer kv.lock.Unlock()
-	if !kv.inTx {
+
+	overlay := make(map[string]*string)
+	kv.cacheLock.RLock()
+	for k, p := range kv.pending {
+		if inRange(k, start, end) {
+			overlay[k] = p.value
+		}
+	}
+	if tx != nil {
+		for k, h := range kv.versions {
+			if v, ok := versionAt(h, tx.snap); ok && inRange(k, start, end) {
+				overlay[k] = v
+			}
+		}
+	}
+	kv.cacheLock.RUnlock()
+	if tx != nil {
+		for k, v := range tx.writes {
+			if inRange(k, start, end) {
+				overlay[k] = v
+			}
+		}
+	}
+	keys := make([]string, 0, len(overlay))
+	for k := range overlay {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var out []Entry
+	full := func() bool { return limit > 0 && len(out) >= limit }
+	emit := func(k string, v *string) {
+		if v != nil {
+			out = append(out, Entry{Key: []byte(k), Value: []byte(*v)})
+		}
+	}
+	var endKey []byte
+	if end != "" {
+		endKey = []byte(end)
+	}
+	kv.ascend([]byte(start), endKey, func(k, v []byte) bool {
+		key := string(k)
+		for len(keys) > 0 && keys[0] < key && !full() {
+			emit(keys[0], overlay[keys[0]])
+			keys = keys[1:]
+		}
+		if full() {
+			return false
+		}
+		if len(keys) > 0 && keys[0] == key {
+			emit(key, overlay[key])
+			keys = keys[1:]
+		} else {
+			out = append(out, Entry{Key: k, Value: v})
+		}
+		return !full()
+	})
+	for len(keys) > 0 && !full() {
+		emit(keys[0], overlay[keys[0]])
+		keys = keys[1:]
+	}
+	return out
+}
+
+// ascend calls fn for the tree's entries with start <= key < end in key
+// order until it returns false. An empty end means no upper bound.
+func (kv *UltraKV) ascend(start, end []byte, fn func(k, v []byte) bool) {
+	if kv.paged {
+		kv.ascendPages(start, end, fn)
 		return
 	}
-	kv.txBuffer = make(map[string]*string)
-	kv.inTx = false
+	kv.btree.Ascend(start, end, fn)
+}
+
+// ScanPrefix returns up to limit live entries whose key starts with prefix,
+// in key order. It seeks straight to the prefix range in the B-tree.
+func (kv *UltraKV) ScanPrefix(prefix []byte, limit int) []Entry {
+	p := string(prefix)
+	end := prefixEnd(p)
+	if p == "" || end == "" {
+		// empty or all-0xff prefix: nothing bounds the range from above
+		return kv.scan(p, "", limit, nil)
+	}
+	return kv.scan(p, end, limit, nil)
 }
 
-func (kv *UltraKV) writeWAL(op, key, value string) {
-	line := ""
-	if op == "SET" {
-		line = fmt.Sprintf("SET\t%s\t%s\n", key, value)
+// Keys returns every live key matching a Redis-style glob pattern, in key
+// order. Only the range covered by the pattern's literal prefix is read.
+func (kv *UltraKV) Keys(pattern string) [][]byte {
+	return matchKeys(kv.ScanPrefix([]byte(globPrefix(pattern)), 0), pattern)
+}
+
+// matchKeys returns the keys of entries that match pattern.
+func matchKeys(entries []Entry, pattern string) [][]byte {
+	var keys [][]byte
+	for _, e := range entries {
+		if globMatch(pattern, string(e.Key)) {
+			keys = append(keys, e.Key)
+		}
+	}
+	return keys
+}
+
+// Cursor returns a bidirectional cursor over the store's B-tree. Writes
+// queued before the call are applied to the tree first; later writes show
+// up once writeFlusher lands them, and the cursor re-seeks when it notices.
+// Uncommitted transaction writes are not visible through a cursor.
+func (kv *UltraKV) Cursor() *Cursor {
+	kv.syncTree()
+	if kv.paged {
+		return &Cursor{kv: kv}
+	}
+	return kv.btree.NewCursor()
+}
+
+// Count returns the number of live keys. Like Cursor, the order-statistic
+// queries apply queued writes first and do not see uncommitted transaction
+// writes. Over the page file, whose nodes keep no subtree sizes, all but
+// Count walk the keys they count.
+func (kv *UltraKV) Count() int {
+	kv.syncTree()
+	if kv.paged {
+		return kv.countPages()
+	}
+	return kv.btree.Count()
+}
+
+// Rank returns the zero-based position key has, or would have, in key
+// order and whether it exists.
+func (kv *UltraKV) Rank(key []byte) (int, bool) {
+	kv.syncTree()
+	if kv.paged {
+		if len(key) == 0 {
+			_, ok := kv.getPages("")
+			return 0, ok
+		}
+		_, ok := kv.getPages(string(key))
+		return kv.rangeCountPages(nil, key), ok
+	}
+	return kv.btree.Rank(key)
+}
+
+// Select returns the key and value at zero-based position i in key order.
+func (kv *UltraKV) Select(i int) (key, value []byte, ok bool) {
+	kv.syncTree()
+	if kv.paged {
+		return kv.selectPages(i)
+	}
+	return kv.btree.Select(i)
+}
+
+// RangeCount returns the number of live keys with start <= key < end. An
+// empty end means no upper bound.
+func (kv *UltraKV) RangeCount(start, end []byte) int {
+	kv.syncTree()
+	if kv.paged {
+		return kv.rangeCountPages(start, end)
+	}
+	return kv.btree.RangeCount(start, end)
+}
+
+// syncTree blocks until writeFlusher has applied every op queued so far.
+// It reports false if the store was closed first.
+func (kv *UltraKV) syncTree() bool {
+	ack := make(chan struct{})
+	select {
+	case kv.syncCh <- ack:
+		<-ack
+		return true
+	case <-kv.closeCh:
+		return false
+	}
+}
+
+// Import bulk-loads entries into the store, overwriting existing keys; when
+// a key appears more than once the last entry wins. Instead of logging one
+// SET per key it saves the merged contents as a checkpoint snapshot at the
+// LSN of a single CHECKPOINT record it then logs, which recovery loads the
+// snapshot for before replaying later records, and applies the entries to
+// the page file and commits it. An in-memory tree is instead rebuilt
+// bottom-up with the given fill factor (see BulkLoad).
+// Writes from other goroutines wait while the import runs.
+func (kv *UltraKV) Import(entries []Entry, fill float64) error {
+	kv.ckptMu.Lock()
+	defer kv.ckptMu.Unlock()
+	kv.ckptLock.Lock()
+	defer kv.ckptLock.Unlock()
+	if !kv.syncTree() {
+		return ErrClosed
+	}
+
+	sorted := make([]Entry, len(entries))
+	copy(sorted, entries)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return string(sorted[i].Key) < string(sorted[j].Key)
+	})
+	dedup := sorted[:0]
+	for _, e := range sorted {
+		if n := len(dedup); n > 0 && string(dedup[n-1].Key) == string(e.Key) {
+			dedup[n-1] = e
+			continue
+		}
+		dedup = append(dedup, e)
+	}
+
+	// the snapshot covers the CHECKPOINT record that is about to be written
+	lsn := kv.lastLSN() + 1
+	var loaded *BTree
+	var err error
+	if kv.paged {
+		// commit what is queued, which empties the pending set, and stream
+		// the page file merged with the import into the snapshot
+		if err := kv.commitPages(lsn-1, false); err != nil {
+			return err
+		}
+		err = writeSnapshotFile(kv.snapshotPath(lsn), kv.keys, func(w io.Writer) error {
+			return writeSnapshot(w, lsn, func(emit func(k, v []byte)) error {
+				rest := dedup
+				kv.ascendPages(nil, nil, func(k, v []byte) bool {
+					for len(rest) > 0 && string(rest[0].Key) < string(k) {
+						emit(rest[0].Key, rest[0].Value)
+						rest = rest[1:]
+					}
+					if len(rest) > 0 && string(rest[0].Key) == string(k) {
+						return true // the import's entry follows
+					}
+					emit(k, v)
+					return true
+				})
+				for _, e := range rest {
+					emit(e.Key, e.Value)
+				}
+				return kv.pagesError()
+			})
+		})
+	} else {
+		loaded, err = kv.importTree(dedup, fill)
+		if err == nil {
+			err = saveSnapshot(loaded, kv.snapshotPath(lsn), lsn, kv.keys)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	kv.writeWAL("CHECKPOINT", "", "")
+	kv.flushWALBuffer()
+	ops := make([]WriteOp, len(dedup))
+	for i, e := range dedup {
+		ops[i] = WriteOp{OpType: "set", Key: string(e.Key), Value: string(e.Value), lsn: lsn}
+	}
+
+	kv.lock.Lock()
+	kv.cacheLock.Lock()
+	if len(kv.snapshots) > 0 {
+		kv.recordVersions(lsn, ops)
+	}
+	if kv.paged {
+		// reads may catch the page file before or after the import lands
+		// in it, but stop caching what they read until it has
+		kv.pendingSeq++
+		for _, e := range dedup {
+			delete(kv.cache, string(e.Key))
+		}
+		kv.cacheLock.Unlock()
+		kv.applyPages(lsn, ops)
+		err = kv.commitPages(lsn, false)
+		kv.cacheLock.Lock()
 	} else {
-		line = fmt.Sprintf("DEL\t%s\n", key)
+		kv.btree.root.Store(loaded.root.Load())
+	}
+	kv.pendingSeq++
+	for _, e := range dedup {
+		delete(kv.cache, string(e.Key))
+		kv.keyLSN[string(e.Key)] = lsn
+	}
+	kv.visibleLSN = lsn
+	kv.cacheLock.Unlock()
+	kv.lock.Unlock()
+
+	kv.ckptLSN.Store(lsn)
+	kv.ckptBytes.Store(0)
+	if err != nil {
+		return err
 	}
+	return kv.pruneCheckpoints()
+}
+
+// importTree bulk-loads a new in-memory tree with the tree's entries merged
+// with dedup, which is sorted and free of duplicates; nothing is pending.
+func (kv *UltraKV) importTree(dedup []Entry, fill float64) (*BTree, error) {
+	current := kv.btree.Scan(nil, nil, 0)
+	i, j := 0, 0
+	loaded := NewBTree()
+	err := loaded.BulkLoad(func() ([]byte, []byte, bool) {
+		switch {
+		case i < len(current) && (j >= len(dedup) || string(current[i].Key) < string(dedup[j].Key)):
+			i++
+			return current[i-1].Key, current[i-1].Value, true
+		case j < len(dedup):
+			if i < len(current) && string(current[i].Key) == string(dedup[j].Key) {
+				i++
+			}
+			j++
+			return dedup[j-1].Key, dedup[j-1].Value, true
+		}
+		return nil, nil, false
+	}, fill)
+	return loaded, err
+}
+
+func inRange(key, start, end string) bool {
+	return key >= start && (end == "" || key < end)
+}
 
+// writeWAL appends a record to the WAL buffer and returns its LSN.
+func (kv *UltraKV) writeWAL(op, key, value string) uint64 {
 	// Double buffer WAL: Add to active buffer (fast, no fsync)
 	kv.walBufferMutex.Lock()
-	kv.walActiveBuffer = append(kv.walActiveBuffer, line)
+	kv.lsn++
+	lsn := kv.lsn
+	// the log's times never go backwards, even if the clock does
+	now := max(time.Now().UnixNano(), kv.lastTime)
+	kv.lastTime = now
+	kv.walActiveBuffer = append(kv.walActiveBuffer, walEntry{lsn, encodeWALRecord(lsn, now, op, key, value)})
 
 	if len(kv.walActiveBuffer) >= 500 {
-		kv.swapWALBuffers()
+		// only flushWALBuffer swaps: it may still be writing the other
+		// buffer, and swapping it back here would reorder the log
 		select {
 		case kv.walFlushCh <- struct{}{}:
 		default:
 		}
 	}
 	kv.walBufferMutex.Unlock()
-
-	// fmt.Printf("[DEBUG] WAL: %s", line)
+	return lsn
 }
 
 func (kv *UltraKV) swapWALBuffers() {
@@ -289,7 +860,7 @@ func (kv *UltraKV) swapWALBuffers() {
 
 func (kv *UltraKV) walBackgroundFlusher() {
 	defer kv.walFlusherWG.Done()
-	ticker := time.NewTicker(2 * time.Millisecond) // flush every 2ms
+	ticker := time.NewTicker(kv.opts.SyncEvery)
 	defer ticker.Stop()
 
 	for {
@@ -306,6 +877,15 @@ func (kv *UltraKV) walBackgroundFlusher() {
 }
 
 func (kv *UltraKV) flushWALBuffer() {
+	// the background flusher and Import both flush; one at a time
+	kv.walLock.Lock()
+	defer kv.walLock.Unlock()
+	kv.flushWALLocked()
+}
+
+// flushWALLocked writes out the buffered records and rotates the segment
+// once it is full or old enough; walLock is held.
+func (kv *UltraKV) flushWALLocked() {
 	kv.walBufferMutex.Lock()
 	if len(kv.walActiveBuffer) > 0 {
 		kv.swapWALBuffers()
@@ -315,67 +895,203 @@ func (kv *UltraKV) flushWALBuffer() {
 
 	if len(toFlush) > 0 {
 		// batching
-		for _, entry := range toFlush {
-			kv.walFile.WriteString(entry)
+		written := 0
+		var err error
+		if kv.walBlocks != nil {
+			written, err = kv.walFile.WriteString(kv.walBlocks.encode(toFlush))
+		} else {
+			for _, entry := range toFlush {
+				n, werr := kv.walFile.WriteString(entry.frame)
+				written += n
+				if err == nil {
+					err = werr
+				}
+			}
+		}
+		if err == nil && kv.opts.Sync != SyncNone {
+			err = kv.walFile.Sync()
+			kv.walSyncs.Add(1)
+		}
+		kv.walSegSize += int64(written)
+		kv.walFlushedLSN = toFlush[len(toFlush)-1].lsn
+		kv.markSynced(kv.walFlushedLSN, err)
+		if limit := kv.opts.CheckpointWALBytes; limit > 0 && kv.ckptBytes.Add(int64(written)) >= limit {
+			select {
+			case kv.ckptCh <- struct{}{}:
+			default:
+			}
 		}
-		kv.walFile.Sync()
 
 		// clear flush buffer
 		kv.walBufferMutex.Lock()
 		kv.walFlushBuffer = kv.walFlushBuffer[:0]
 		kv.walBufferMutex.Unlock()
+
+		full := kv.opts.SegmentBytes > 0 && kv.walSegSize >= kv.opts.SegmentBytes
+		old := kv.opts.SegmentAge > 0 && time.Since(kv.walSegOpened) >= kv.opts.SegmentAge
+		if full || old {
+			// on failure keep appending to the current segment
+			kv.rotateWALLocked()
+		}
 	}
 }
 
 // persist() - Now only used for backup snapshots, not for recovery
 func (kv *UltraKV) persist() {
-	if err := kv.btree.SaveToFile(kv.btreePath); err != nil {
+	var err error
+	if kv.paged {
+		// nothing writes meanwhile, so the snapshot need not be committed
+		kv.diskMu.Lock()
+		if err = kv.diskErr; err == nil && kv.disk != nil {
+			kv.diskSnap = &pageSnapshot{pre: make(map[string]*string)}
+		}
+		kv.diskMu.Unlock()
+		if err == nil && kv.disk != nil {
+			err = kv.savePages(kv.btreePath, 0)
+		}
+	} else {
+		err = saveSnapshot(kv.btree, kv.btreePath, 0, kv.keys)
+	}
+	if err != nil {
 		// fmt.Printf("[DEBUG] Error persisting B-tree snapshot: %v\n", err) // [DEBUG]
 	} else {
 		// fmt.Println("[DEBUG] B-tree snapshot saved") // [DEBUG]
 	}
 }
 
-// replayWAL - WAL-only recovery: replay entire WAL from beginning to rebuild B-Tree
-func (kv *UltraKV) replayWAL() error {
-	f, err := os.Open(kv.walPath)
+// replayWAL brings the tree up to date on startup: it starts from the page
+// file, or the newest valid snapshot when that is newer, and replays the
+// WAL records after it, reading the segments in order. A CHECKPOINT record
+// past that point (left by Import) stands for the snapshot at its LSN,
+// which replaces everything before it. A snapshot is streamed into a new
+// page file, or loaded into memory when the store is encrypted.
+// A torn final record in the newest segment is cut off the file; any other
+// damage fails the open with a *WALCorruptError.
+// legacy reports records in an older format or in the single-file log that
+// predates segments.
+func (kv *UltraKV) replayWAL() (legacy bool, err error) {
+	base, err := kv.loadBase()
 	if err != nil {
+		return false, err
+	}
+	kv.lsn = base
+
+	// first pass: find the last checkpoint record
+	from := base
+	logged, _, err := readSegments(kv.walPath, kv.keys, func(r walRecord) error {
+		if r.op == "CHECKPOINT" && r.lsn > base {
+			from = r.lsn
+		}
 		return nil
+	})
+	if err != nil {
+		return false, err
 	}
-	defer f.Close()
-	scanner := bufio.NewScanner(f)
-	count := 0
-	for scanner.Scan() {
-		line := scanner.Text()
-		if len(line) == 0 {
-			continue
+	// what was read back is on disk, so the page file may write pages
+	// holding it
+	kv.walSyncedLSN = max(logged.lastLSN, base)
+	if from > base {
+		ckptPath := kv.snapshotPath(from)
+		if _, err := kv.loadSnapshotFile(ckptPath); err != nil {
+			return false, fmt.Errorf("load checkpoint %s: %w", ckptPath, err)
+		}
+		kv.ckptLSN.Store(from)
+	}
+
+	var prev uint64
+	scan, last, err := readSegments(kv.walPath, kv.keys, func(r walRecord) error {
+		defer func() { prev = r.lsn }()
+		kv.lastTime = max(kv.lastTime, r.time)
+		if r.lsn <= from {
+			return nil
 		}
-		if len(line) >= 4 && line[:4] == "SET\t" {
-			var key, value string
-			parts := strings.SplitN(line, "\t", 3)
-			if len(parts) == 3 {
-				key = parts[1]
-				value = parts[2]
-				kv.btree.Insert([]byte(key), []byte(value))
-
-				kv.cache[key] = value
-				count++
-				// fmt.Printf("[DEBUG] WAL replay SET %q = %q\n", key, value) // [DEBUG]
+		// decode a whole transaction before applying any of it
+		ops, err := walOps(r, prev)
+		if err != nil {
+			return err
+		}
+		if kv.paged {
+			kv.disk.SetLSN(r.lsn)
+		}
+		for _, op := range ops {
+			var err error
+			if op.op == "SET" {
+				kv.keyLSN[op.key] = r.lsn
+				if !kv.paged {
+					kv.btree.Insert([]byte(op.key), []byte(op.value))
+				} else {
+					err = kv.disk.Put([]byte(op.key), []byte(op.value))
+				}
+			} else {
+				delete(kv.keyLSN, op.key)
+				if !kv.paged {
+					kv.btree.Delete([]byte(op.key))
+				} else {
+					_, err = kv.disk.Delete([]byte(op.key))
+				}
 			}
-		} else if len(line) >= 4 && line[:4] == "DEL\t" {
-			var key string
-			parts := strings.SplitN(line, "\t", 2)
-			if len(parts) == 2 {
-				key = parts[1]
-				kv.btree.Delete([]byte(key))
-				// Remove from cache during replay
-				delete(kv.cache, key)
-				count++
-				// fmt.Printf("[DEBUG] WAL replay DEL %q\n", key) // [DEBUG]
+			if err != nil {
+				return err
 			}
 		}
+		return nil
+	})
+	if err != nil {
+		return false, err
 	}
-	return nil
+	kv.lsn = max(scan.lastLSN, base)
+	kv.walFlushedLSN = kv.lsn
+	kv.baseVersion = max(from, 1)
+	if scan.torn {
+		if err := truncateFile(last, scan.end); err != nil {
+			return false, err
+		}
+	}
+	if kv.paged {
+		kv.diskLSN = kv.lsn
+		err = kv.disk.Commit(kv.lsn)
+	}
+	return scan.legacy && scan.records > 0, err
+}
+
+// loadBase readies the tree recovery starts from and returns the LSN it
+// covers: the page file's, unless a snapshot is newer, in which case the
+// newest readable snapshot is loaded instead.
+func (kv *UltraKV) loadBase() (uint64, error) {
+	snaps, err := kv.listSnapshots()
+	if err != nil {
+		return 0, err
+	}
+	if len(snaps) > 0 {
+		kv.ckptLSN.Store(snaps[0].lsn)
+	}
+	if kv.paged && (len(snaps) == 0 || kv.disk.LSN() >= snaps[0].lsn) {
+		return kv.disk.LSN(), nil
+	}
+	base, err := kv.loadNewestSnapshot()
+	kv.ckptLSN.Store(base)
+	return base, err
+}
+
+// loadSnapshotFile replaces the tree with the snapshot in path and returns
+// its LSN.
+func (kv *UltraKV) loadSnapshotFile(path string) (uint64, error) {
+	if kv.paged {
+		return kv.loadSnapshotPages(path)
+	}
+	return loadSnapshot(kv.btree, path, kv.keys)
+}
+
+func truncateFile(path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	return f.Sync()
 }
 
 func (kv *UltraKV) DebugPrint() {
@@ -395,24 +1111,49 @@ func (kv *UltraKV) writeFlusher() {
 			return
 		}
 
-		keys := make([]string, 0, len(batch))
-		for _, op := range batch {
-			keys = append(keys, op.Key)
-		}
-
-		// WAL written immediately, so we can safely batch updates to in-memory B-Tree
+		// WAL written immediately, so we can safely batch updates to the B-Tree
 		kv.lock.Lock()
-		for _, op := range batch {
-			if op.OpType == "set" {
-				kv.btree.Insert([]byte(op.Key), []byte(op.Value))
-			} else if op.OpType == "del" {
-				kv.btree.Delete([]byte(op.Key))
+		if kv.paged {
+			// the page file covers a record once all of its ops are in;
+			// they stay pending until it is committed
+			last := batch[len(batch)-1]
+			covered := last.lsn
+			if !last.last {
+				covered--
+			}
+			kv.dropPending(kv.applyPages(covered, batch))
+		} else {
+			// readers keep using the old root until the whole batch is published
+			tb := kv.btree.NewBatch()
+			for _, op := range batch {
+				if op.OpType == "set" {
+					tb.Insert([]byte(op.Key), []byte(op.Value))
+				} else if op.OpType == "del" {
+					tb.Delete([]byte(op.Key))
+				}
 			}
+			tb.Commit()
+			// REMOVED: B-Tree persistence during operations for better performance
+			// kv.persist() // Only persist on shutdown, not during operations
+
+			// the tree now reflects these ops; drop pending entries not superseded
+			kv.dropPending(batch)
 		}
-		// REMOVED: B-Tree persistence during operations for better performance
-		// kv.persist() // Only persist on shutdown, not during operations
-		batch = batch[:0]
 		kv.lock.Unlock()
+		batch = batch[:0]
+	}
+	drain := func() {
+		for {
+			select {
+			case op, ok := <-kv.writeCh:
+				if !ok {
+					return
+				}
+				batch = append(batch, op)
+			default:
+				return
+			}
+		}
 	}
 	for {
 		select {
@@ -427,29 +1168,96 @@ func (kv *UltraKV) writeFlusher() {
 			}
 		case <-kv.flushCh:
 			flush()
+		case ack := <-kv.syncCh:
+			// drain whatever was queued before the request, then apply it
+			drain()
+			flush()
+			close(ack)
 		case <-kv.closeCh:
+			drain()
 			flush()
 			return
 		case <-time.After(100 * time.Millisecond):
 			flush()
+			if kv.paged {
+				kv.tickPages()
+			}
 		}
 	}
 }
 
+// Clear deletes every key, and the log and snapshots with them. It commits
+// at an LSN of its own, which no record is written for, so open
+// transactions go on reading their snapshots from before it and conflict
+// on any key it deleted that they read, scan or write.
 func (kv *UltraKV) Clear() error {
+	kv.ckptMu.Lock()
+	defer kv.ckptMu.Unlock()
+	// land queued writes now, so none reach the tree after it is reset
+	kv.ckptLock.Lock()
+	defer kv.ckptLock.Unlock()
+	if !kv.syncTree() {
+		return ErrClosed
+	}
 	kv.lock.Lock()
 	defer kv.lock.Unlock()
-	kv.btree = NewBTree()
+	kv.walBufferMutex.Lock()
+	kv.lsn++
+	lsn := kv.lsn
+	kv.walBufferMutex.Unlock()
 	kv.cacheLock.Lock()
+	if len(kv.snapshots) > 0 {
+		// the tree holds every write now, so it has each live key's value
+		kv.ascend(nil, nil, func(k, v []byte) bool {
+			h := kv.versions[string(k)]
+			if len(h) == 0 {
+				s := string(v)
+				h = append(h, version{value: &s})
+			}
+			kv.versions[string(k)] = append(h, version{lsn: lsn})
+			return true
+		})
+	}
+	// reset in place: lock-free readers may be holding kv.btree
+	kv.btree.Reset()
 	kv.cache = make(map[string]string)
+	kv.pending = make(map[string]pendingWrite)
+	kv.pendingSeq++
+	kv.keyLSN = make(map[string]uint64)
+	kv.visibleLSN = lsn
 	kv.cacheLock.Unlock()
+	kv.diskMu.Lock()
+	err := kv.resetPages()
+	kv.diskMu.Unlock()
+	if err != nil {
+		return err
+	}
+	kv.walLock.Lock()
+	defer kv.walLock.Unlock()
+	// flush first so buffered records go with the old segments
+	kv.flushWALLocked()
+	// the next segment starts after the clear
+	kv.walFlushedLSN = lsn
+	kv.endSubscriptions(fmt.Errorf("%w: the store was cleared", ErrChangesUnavailable))
 	kv.walFile.Close()
-	os.Remove(kv.walPath)
+	kv.walFile = nil
+	if segs, err := kv.listSegments(); err == nil {
+		for _, s := range segs {
+			os.Remove(s.path)
+		}
+	}
 	os.Remove(kv.btreePath)
-	walFile, err := os.OpenFile(kv.walPath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
-	if err != nil {
+	if snaps, err := kv.listSnapshots(); err == nil {
+		for _, s := range snaps {
+			os.Remove(s.path)
+		}
+	}
+	kv.ckptLSN.Store(0)
+	if err := kv.openSegmentLocked(); err != nil {
+		// the old segments are gone: with nothing to log to, every later
+		// write fails
+		kv.markSynced(lsn, err)
 		return err
 	}
-	kv.walFile = walFile
 	return nil
 }
@@ -2,7 +2,7 @@
 $cliPath = Join-Path $PSScriptRoot 'ultra_cli.exe'
 if (-Not (Test-Path $cliPath)) {
     Write-Host 'Building ultra_cli.exe...'
-    go build -o ultra_cli.exe ultra_cli.go kvstore_ultra.go btree.go
+    go build -o ultra_cli.exe .
 }
 
 
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// --- Key locks ---
+//
+// A Tx can lock keys up front with LockShared and LockForUpdate instead of
+// relying on Commit's validation alone. Locks are held until Commit or
+// Rollback. A shared lock excludes exclusive ones; an exclusive lock
+// excludes both, and a Tx holding a key shared may upgrade it. Commit takes
+// an exclusive lock on every key it writes, in key order, so transactions
+// writing a key wait for those holding it. Plain and conditional writes
+// take the exclusive lock on their key while they commit, as a Tx of
+// their own, so they wait likewise and a Tx holding a key's lock sees no
+// commit to it but its own.
+//
+// Requests for a key are granted in arrival order, upgrades first. Every
+// waiting Tx has edges in a wait-for graph to the holders and earlier
+// requests it waits behind; a request that closes a cycle picks the
+// youngest Tx in the cycle (the last to Begin) as the victim and fails its
+// request with ErrDeadlock. A request also fails with ErrLockTimeout after
+// Options.LockTimeout. Either way the Tx that gets the error is rolled
+// back, releasing its locks, and can be retried from Begin.
+//
+// Get reads a key locked with LockShared or LockForUpdate as of the lock
+// being granted rather than as of Begin, and Commit's validation only
+// checks it for commits after that, so a Tx that locks a key before reading
+// it does not conflict over it.
+
+var (
+	// ErrDeadlock is returned when the transaction was chosen to break a
+	// deadlock.
+	ErrDeadlock = errors.New("godb: transaction aborted to break a deadlock")
+	// ErrLockTimeout is returned when a lock was not granted in time.
+	ErrLockTimeout = errors.New("godb: timed out waiting for a key lock")
+)
+
+type lockMode int
+
+const (
+	lockShared lockMode = iota + 1
+	lockExclusive
+)
+
+// heldLock is a lock a Tx holds and the last commit visible when it was
+// granted.
+type heldLock struct {
+	mode lockMode
+	at   uint64
+}
+
+// lockManager holds the key locks of a store's transactions.
+type lockManager struct {
+	mu      sync.Mutex
+	keys    map[string]*keyLock
+	waiting map[*Tx]*lockRequest // a Tx waits for one lock at a time
+}
+
+type keyLock struct {
+	holders map[*Tx]lockMode
+	queue   []*lockRequest
+}
+
+type lockRequest struct {
+	tx   *Tx
+	key  string
+	mode lockMode
+	done chan error // receives nil once granted
+}
+
+// LockShared locks key against writers until the transaction ends.
+func (tx *Tx) LockShared(key []byte) error {
+	return tx.lock(string(key), lockShared, true)
+}
+
+// LockForUpdate locks key against readers and writers that lock until the
+// transaction ends.
+func (tx *Tx) LockForUpdate(key []byte) error {
+	return tx.lock(string(key), lockExclusive, true)
+}
+
+// lock acquires key in mode, rolling the transaction back on failure. With
+// latest set, a key not already locked is read from then on as of the
+// grant; Commit's own locks leave it as of the snapshot.
+func (tx *Tx) lock(key string, mode lockMode, latest bool) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	held, ok := tx.locks[key]
+	if held.mode >= mode {
+		return nil
+	}
+	if err := tx.kv.keyLocks.acquire(tx, key, mode, tx.kv.opts.LockTimeout); err != nil {
+		tx.Rollback()
+		return err
+	}
+	at := tx.snap
+	switch {
+	case ok:
+		at = held.at // an upgrade: keep reading what was read before
+	case latest:
+		tx.kv.cacheLock.RLock()
+		at = tx.kv.visibleLSN
+		tx.kv.cacheLock.RUnlock()
+	}
+	tx.locks[key] = heldLock{mode: mode, at: at}
+	return nil
+}
+
+// acquire grants tx the lock on key in mode, waiting up to timeout
+// (negative: indefinitely) behind conflicting holders and requests.
+func (lm *lockManager) acquire(tx *Tx, key string, mode lockMode, timeout time.Duration) error {
+	lm.mu.Lock()
+	if lm.keys == nil {
+		lm.keys = make(map[string]*keyLock)
+		lm.waiting = make(map[*Tx]*lockRequest)
+	}
+	kl := lm.keys[key]
+	if kl == nil {
+		kl = &keyLock{holders: make(map[*Tx]lockMode)}
+		lm.keys[key] = kl
+	}
+	_, upgrade := kl.holders[tx]
+	if (upgrade || len(kl.queue) == 0) && kl.compatible(tx, mode) {
+		kl.holders[tx] = mode
+		lm.mu.Unlock()
+		return nil
+	}
+
+	req := &lockRequest{tx: tx, key: key, mode: mode, done: make(chan error, 1)}
+	if upgrade {
+		kl.queue = append([]*lockRequest{req}, kl.queue...)
+	} else {
+		kl.queue = append(kl.queue, req)
+	}
+	lm.waiting[tx] = req
+	if cycle := lm.cycle(tx); cycle != nil {
+		victim := cycle[0]
+		for _, t := range cycle[1:] {
+			if t.id > victim.id {
+				victim = t
+			}
+		}
+		lm.fail(lm.waiting[victim], ErrDeadlock)
+	}
+	lm.mu.Unlock()
+
+	var expired <-chan time.Time
+	if timeout >= 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case err := <-req.done:
+		return err
+	case <-expired:
+		lm.mu.Lock()
+		defer lm.mu.Unlock()
+		select {
+		case err := <-req.done: // granted or failed meanwhile
+			return err
+		default:
+		}
+		lm.fail(req, ErrLockTimeout)
+		return <-req.done
+	}
+}
+
+// writeKey is logAndQueue for a write to key alone, holding the key's
+// exclusive lock meanwhile. It fails with ErrLockTimeout, writing nothing,
+// if the lock is not granted in time.
+func (kv *UltraKV) writeKey(check func() error, op, key, value string, w WriteOp) (uint64, error) {
+	owner := &Tx{kv: kv, id: kv.txSeq.Add(1)}
+	// it holds nothing while it waits, so it is never on a deadlock cycle
+	if err := kv.keyLocks.acquire(owner, key, lockExclusive, kv.opts.LockTimeout); err != nil {
+		return 0, err
+	}
+	defer kv.keyLocks.release(owner, map[string]heldLock{key: {mode: lockExclusive}})
+	return kv.logAndQueue(check, op, key, value, w)
+}
+
+// compatible reports whether tx may hold the key in mode alongside the
+// other holders.
+func (kl *keyLock) compatible(tx *Tx, mode lockMode) bool {
+	for h, m := range kl.holders {
+		if h != tx && (mode == lockExclusive || m == lockExclusive) {
+			return false
+		}
+	}
+	return true
+}
+
+// blockers returns the transactions req waits for: conflicting holders and
+// the owners of conflicting requests ahead of it.
+func (lm *lockManager) blockers(req *lockRequest) []*Tx {
+	kl := lm.keys[req.key]
+	var out []*Tx
+	for h, m := range kl.holders {
+		if h != req.tx && (req.mode == lockExclusive || m == lockExclusive) {
+			out = append(out, h)
+		}
+	}
+	for _, r := range kl.queue {
+		if r == req {
+			break
+		}
+		if r.tx != req.tx && (req.mode == lockExclusive || r.mode == lockExclusive) {
+			out = append(out, r.tx)
+		}
+	}
+	return out
+}
+
+// cycle returns the transactions on a wait-for cycle through tx, or nil.
+func (lm *lockManager) cycle(tx *Tx) []*Tx {
+	visited := make(map[*Tx]bool)
+	var path []*Tx
+	var visit func(t *Tx) bool
+	visit = func(t *Tx) bool {
+		req := lm.waiting[t]
+		if req == nil {
+			return false
+		}
+		path = append(path, t)
+		for _, b := range lm.blockers(req) {
+			if b == tx {
+				return true
+			}
+			if !visited[b] {
+				visited[b] = true
+				if visit(b) {
+					return true
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		return false
+	}
+	if visit(tx) {
+		return path
+	}
+	return nil
+}
+
+// fail removes a waiting request and completes it with err; lm.mu is held.
+func (lm *lockManager) fail(req *lockRequest, err error) {
+	kl := lm.keys[req.key]
+	for i, r := range kl.queue {
+		if r == req {
+			kl.queue = append(kl.queue[:i], kl.queue[i+1:]...)
+			break
+		}
+	}
+	delete(lm.waiting, req.tx)
+	req.done <- err
+	lm.grant(req.key)
+}
+
+// grant hands the lock on key to the requests at the head of its queue
+// that no longer conflict; lm.mu is held.
+func (lm *lockManager) grant(key string) {
+	kl := lm.keys[key]
+	for len(kl.queue) > 0 && kl.compatible(kl.queue[0].tx, kl.queue[0].mode) {
+		req := kl.queue[0]
+		kl.queue = kl.queue[1:]
+		kl.holders[req.tx] = req.mode
+		delete(lm.waiting, req.tx)
+		req.done <- nil
+	}
+	if len(kl.holders) == 0 && len(kl.queue) == 0 {
+		delete(lm.keys, key)
+	}
+}
+
+// release drops tx's locks on keys.
+func (lm *lockManager) release(tx *Tx, keys map[string]heldLock) {
+	if len(keys) == 0 {
+		return
+	}
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	for key := range keys {
+		delete(lm.keys[key].holders, tx)
+		lm.grant(key)
+	}
+}
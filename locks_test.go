@@ -0,0 +1,220 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// awaitLockWait blocks until tx is queued for a lock.
+func awaitLockWait(t *testing.T, kv *UltraKV, tx *Tx) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		kv.keyLocks.mu.Lock()
+		_, waiting := kv.keyLocks.waiting[tx]
+		kv.keyLocks.mu.Unlock()
+		if waiting {
+			return
+		}
+	}
+	t.Fatal("transaction never waited for a lock")
+}
+
+// lockAsync runs lock in the background and returns its result channel.
+func lockAsync(lock func([]byte) error, key string) chan error {
+	ch := make(chan error, 1)
+	go func() { ch <- lock([]byte(key)) }()
+	return ch
+}
+
+func TestLockForUpdateReadsLatest(t *testing.T) {
+	kv := openTestKV(t)
+	kv.Set([]byte("a"), []byte("1"))
+	t1, t2 := kv.Begin(), kv.Begin()
+	t2.Set([]byte("a"), []byte("2"))
+	if err := t2.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := t1.LockForUpdate([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	v, _ := t1.Get([]byte("a"))
+	if string(v) != "2" {
+		t.Fatalf("Get after LockForUpdate = %q, want the latest value", v)
+	}
+	t1.Set([]byte("a"), append(v, '+'))
+	if err := t1.Commit(); err != nil {
+		t.Fatalf("Commit = %v", err)
+	}
+	if v, _ := kv.Get([]byte("a")); string(v) != "2+" {
+		t.Fatalf("a = %q", v)
+	}
+}
+
+func TestLocksBlock(t *testing.T) {
+	kv := openTestKV(t)
+	t1, t2 := kv.Begin(), kv.Begin()
+	if err := t1.LockForUpdate([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	got := lockAsync(t2.LockShared, "a")
+	awaitLockWait(t, kv, t2)
+	t1.Set([]byte("a"), []byte("1"))
+	t1.Commit()
+	if err := <-got; err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := t2.Get([]byte("a")); string(v) != "1" {
+		t.Fatalf("t2.Get(a) = %q, want the commit it waited for", v)
+	}
+
+	// shared locks coexist and hold off a writer's commit
+	t3, t4 := kv.Begin(), kv.Begin()
+	if err := t3.LockShared([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	t4.Set([]byte("a"), []byte("2"))
+	committed := make(chan error, 1)
+	go func() { committed <- t4.Commit() }()
+	awaitLockWait(t, kv, t4)
+	t2.Rollback()
+	select {
+	case err := <-committed:
+		t.Fatalf("Commit = %v with a shared lock held", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	t3.Rollback()
+	if err := <-committed; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeadlockAbortsYoungest(t *testing.T) {
+	kv := openTestKV(t)
+
+	// the requester closing the cycle is the youngest
+	t1, t2 := kv.Begin(), kv.Begin()
+	t1.LockForUpdate([]byte("a"))
+	t2.LockForUpdate([]byte("b"))
+	got := lockAsync(t1.LockForUpdate, "b")
+	awaitLockWait(t, kv, t1)
+	if err := t2.LockForUpdate([]byte("a")); err != ErrDeadlock {
+		t.Fatalf("closing the cycle = %v, want ErrDeadlock", err)
+	}
+	if err := t2.Set([]byte("x"), nil); err != ErrTxDone {
+		t.Fatalf("victim not rolled back: %v", err)
+	}
+	if err := <-got; err != nil {
+		t.Fatal(err)
+	}
+	t1.Commit()
+
+	// the victim is already waiting
+	t3, t4 := kv.Begin(), kv.Begin()
+	t4.LockForUpdate([]byte("a"))
+	t3.LockForUpdate([]byte("b"))
+	got = lockAsync(t4.LockForUpdate, "b")
+	awaitLockWait(t, kv, t4)
+	if err := t3.LockForUpdate([]byte("a")); err != nil {
+		t.Fatalf("older transaction = %v", err)
+	}
+	if err := <-got; err != ErrDeadlock {
+		t.Fatalf("younger transaction = %v, want ErrDeadlock", err)
+	}
+	t3.Commit()
+
+	// two shared holders upgrading
+	t5, t6 := kv.Begin(), kv.Begin()
+	t5.LockShared([]byte("a"))
+	t6.LockShared([]byte("a"))
+	got = lockAsync(t5.LockForUpdate, "a")
+	awaitLockWait(t, kv, t5)
+	if err := t6.LockForUpdate([]byte("a")); err != ErrDeadlock {
+		t.Fatalf("second upgrade = %v, want ErrDeadlock", err)
+	}
+	if err := <-got; err != nil {
+		t.Fatal(err)
+	}
+	t5.Commit()
+
+	kv.keyLocks.mu.Lock()
+	defer kv.keyLocks.mu.Unlock()
+	if len(kv.keyLocks.keys) != 0 || len(kv.keyLocks.waiting) != 0 {
+		t.Fatalf("%d keys locked, %d waiting after every transaction ended", len(kv.keyLocks.keys), len(kv.keyLocks.waiting))
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	kv := openCheckpointKV(t, t.TempDir(), &Options{LockTimeout: 30 * time.Millisecond})
+	defer kv.Close()
+	t1, t2 := kv.Begin(), kv.Begin()
+	t1.LockShared([]byte("a"))
+	start := time.Now()
+	if err := t2.LockForUpdate([]byte("a")); err != ErrLockTimeout {
+		t.Fatalf("LockForUpdate = %v, want ErrLockTimeout", err)
+	}
+	if d := time.Since(start); d < 30*time.Millisecond {
+		t.Fatalf("gave up after %v", d)
+	}
+	if err := t2.Commit(); err != ErrTxDone {
+		t.Fatalf("Commit after a timeout = %v", err)
+	}
+	if err := t1.LockForUpdate([]byte("a")); err != nil {
+		t.Fatalf("upgrade after the waiter left = %v", err)
+	}
+	t1.Rollback()
+}
+
+func TestPlainWritesWaitForLocks(t *testing.T) {
+	kv := openCheckpointKV(t, t.TempDir(), &Options{LockTimeout: time.Second})
+	defer kv.Close()
+	kv.Set([]byte("a"), []byte("1"))
+	tx := kv.Begin()
+	if err := tx.LockForUpdate([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	set := make(chan error, 1)
+	go func() { set <- kv.Set([]byte("a"), []byte("plain")) }()
+	swapped := make(chan bool, 1)
+	go func() {
+		ok, _ := kv.CompareAndSwap([]byte("a"), []byte("1"), []byte("cas"))
+		swapped <- ok
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		kv.keyLocks.mu.Lock()
+		waiting := len(kv.keyLocks.waiting)
+		kv.keyLocks.mu.Unlock()
+		if waiting == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d writes waiting for the lock, want 2", waiting)
+		}
+	}
+
+	v, _ := tx.Get([]byte("a"))
+	tx.Set([]byte("a"), append(v, '+'))
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit with the key locked = %v", err)
+	}
+	if err := <-set; err != nil {
+		t.Fatal(err)
+	}
+	if <-swapped {
+		t.Fatal("CompareAndSwap saw the value from before the Tx")
+	}
+	if v, _ := kv.Get([]byte("a")); string(v) != "plain" {
+		t.Fatalf("a = %q", v)
+	}
+
+	// a write that waits too long gives up without writing
+	tx = kv.Begin()
+	tx.LockShared([]byte("a"))
+	kv.opts.LockTimeout = 20 * time.Millisecond
+	if err := kv.Del([]byte("a")); err != ErrLockTimeout {
+		t.Fatalf("Del = %v, want ErrLockTimeout", err)
+	}
+	tx.Rollback()
+	if _, ok := kv.Get([]byte("a")); !ok {
+		t.Fatal("Del wrote after timing out")
+	}
+}
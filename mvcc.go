@@ -0,0 +1,134 @@
+package main
+
+import "sort"
+
+// --- Multi-version reads ---
+//
+// Every commit is stamped with the LSN of its WAL record. Begin takes a
+// snapshot: the LSN of the last commit queued, and the transaction reads
+// the store as it was then, however many commits land meanwhile.
+//
+// The cache, the pending set and the B-tree hold only the latest value of
+// each key, so while any snapshot is open each commit also records, per key
+// it writes, the value it replaces and the one it writes, tagged with its
+// LSN. A snapshot read of a key whose versions run past the snapshot takes
+// the newest one at or before it. When the oldest snapshot is released the
+// versions no open snapshot can read are pruned, and with none open nothing
+// is kept.
+
+// version is a key's value from a commit on; value is nil for a delete.
+type version struct {
+	lsn   uint64
+	value *string
+}
+
+// versionAt returns the value h holds at snapshot ts. ok is false when no
+// version is newer than ts, so the latest value is the one to read.
+func versionAt(h []version, ts uint64) (value *string, ok bool) {
+	if len(h) == 0 || h[len(h)-1].lsn <= ts {
+		return nil, false
+	}
+	// h starts at or before every open snapshot
+	i := sort.Search(len(h), func(i int) bool { return h[i].lsn > ts }) - 1
+	return h[i].value, true
+}
+
+// recordVersions keeps what ops replace and what they write at lsn when a
+// snapshot is open; cacheLock is held and ops are not yet applied.
+func (kv *UltraKV) recordVersions(lsn uint64, ops []WriteOp) {
+	if len(kv.snapshots) == 0 {
+		return
+	}
+	for _, op := range ops {
+		h := kv.versions[op.Key]
+		if len(h) == 0 {
+			h = append(h, version{value: kv.latestLocked(op.Key)})
+		}
+		var value *string
+		if op.OpType == "set" {
+			v := op.Value
+			value = &v
+		}
+		kv.versions[op.Key] = append(h, version{lsn: lsn, value: value})
+	}
+}
+
+// latestLocked returns the latest value of key, nil if there is none;
+// cacheLock is held. The tree may be ahead of the pending set but never
+// behind it, so pending is consulted first.
+func (kv *UltraKV) latestLocked(key string) *string {
+	if p, ok := kv.pending[key]; ok {
+		return p.value
+	}
+	if v, ok := kv.cache[key]; ok {
+		return &v
+	}
+	if v, ok := kv.treeGet(key); ok {
+		s := string(v)
+		return &s
+	}
+	return nil
+}
+
+// getAt is get as of snapshot ts.
+func (kv *UltraKV) getAt(key string, ts uint64) (string, bool) {
+	kv.cacheLock.RLock()
+	defer kv.cacheLock.RUnlock()
+	v, ok := versionAt(kv.versions[key], ts)
+	if !ok {
+		v = kv.latestLocked(key)
+	}
+	if v == nil {
+		return "", false
+	}
+	return *v, true
+}
+
+// acquireSnapshot opens a snapshot of the last commit and returns its LSN.
+func (kv *UltraKV) acquireSnapshot() uint64 {
+	kv.cacheLock.Lock()
+	defer kv.cacheLock.Unlock()
+	ts := kv.visibleLSN
+	kv.snapshots[ts]++
+	return ts
+}
+
+// releaseSnapshot closes a snapshot from acquireSnapshot. If it was the
+// oldest, the versions nothing can read any more are pruned.
+func (kv *UltraKV) releaseSnapshot(ts uint64) {
+	kv.cacheLock.Lock()
+	defer kv.cacheLock.Unlock()
+	if kv.snapshots[ts]--; kv.snapshots[ts] > 0 {
+		return
+	}
+	delete(kv.snapshots, ts)
+	for open := range kv.snapshots {
+		if open < ts {
+			return
+		}
+	}
+	kv.pruneVersionsLocked()
+}
+
+// pruneVersionsLocked drops versions older than the oldest open snapshot,
+// keeping for each key the one that snapshot reads, and forgets keys whose
+// latest value every snapshot reads; cacheLock is held.
+func (kv *UltraKV) pruneVersionsLocked() {
+	if len(kv.snapshots) == 0 {
+		kv.versions = make(map[string][]version)
+		return
+	}
+	oldest := uint64(1<<64 - 1)
+	for ts := range kv.snapshots {
+		oldest = min(oldest, ts)
+	}
+	for k, h := range kv.versions {
+		i := sort.Search(len(h), func(i int) bool { return h[i].lsn > oldest }) - 1
+		switch {
+		case i == len(h)-1:
+			delete(kv.versions, k)
+		case i > 0:
+			kv.versions[k] = append([]version(nil), h[i:]...)
+		}
+	}
+}
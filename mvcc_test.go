@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestTxReadsSnapshot(t *testing.T) {
+	kv := openTestKV(t)
+	kv.Set([]byte("a"), []byte("1"))
+	kv.Set([]byte("b"), []byte("1"))
+	tx := kv.Begin()
+	kv.Set([]byte("a"), []byte("2"))
+	kv.Del([]byte("b"))
+	kv.Set([]byte("c"), []byte("2"))
+	kv.syncTree() // the snapshot must not depend on writes staying pending
+
+	if v, _ := kv.Get([]byte("a")); string(v) != "2" {
+		t.Fatalf("Get(a) = %q", v)
+	}
+	if v, _ := tx.Get([]byte("a")); string(v) != "1" {
+		t.Fatalf("tx.Get(a) = %q, want the value at Begin", v)
+	}
+	if _, ok := tx.Get([]byte("c")); ok {
+		t.Fatal("tx sees a key created after Begin")
+	}
+	if got := tx.Scan(nil, nil, 0); fmt.Sprint(scanKeys(got)) != "[a b]" || string(got[0].Value) != "1" {
+		t.Fatalf("tx.Scan = %v", scanKeys(got))
+	}
+	if st := kv.Stats(); st.Snapshots != 1 || st.Versions != 6 {
+		t.Fatalf("%d snapshots, %d versions", st.Snapshots, st.Versions)
+	}
+	tx.Rollback()
+	if st := kv.Stats(); st.Snapshots != 0 || st.Versions != 0 {
+		t.Fatalf("after Rollback: %d snapshots, %d versions", st.Snapshots, st.Versions)
+	}
+}
+
+func TestVersionGC(t *testing.T) {
+	kv := openTestKV(t)
+	kv.Set([]byte("a"), []byte("1"))
+	t1 := kv.Begin()
+	kv.Set([]byte("a"), []byte("2"))
+	t2 := kv.Begin()
+	kv.Set([]byte("a"), []byte("3"))
+	kv.Set([]byte("b"), []byte("3"))
+	if n := kv.Stats().Versions; n != 5 {
+		t.Fatalf("%d versions, want a's 1, 2, 3 and b's none, 3", n)
+	}
+
+	t2.Rollback() // t1 still reads everything
+	if n := kv.Stats().Versions; n != 5 {
+		t.Fatalf("%d versions after releasing the newer snapshot", n)
+	}
+	t3 := kv.Begin()
+	t1.Rollback() // t3 reads the latest values, so nothing is kept
+	if n := kv.Stats().Versions; n != 0 {
+		t.Fatalf("%d versions kept for a snapshot of the latest state", n)
+	}
+	kv.Set([]byte("a"), []byte("4"))
+	if v, _ := t3.Get([]byte("a")); string(v) != "3" {
+		t.Fatalf("t3.Get(a) = %q", v)
+	}
+	t3.Commit()
+}
+
+func TestSnapshotAcrossImport(t *testing.T) {
+	kv := openTestKV(t)
+	kv.Set([]byte("a"), []byte("old"))
+	tx := kv.Begin()
+	defer tx.Rollback()
+	if err := kv.Import([]Entry{{Key: []byte("a"), Value: []byte("new")}, {Key: []byte("z"), Value: []byte("new")}}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := tx.Get([]byte("a")); string(v) != "old" {
+		t.Fatalf("tx.Get(a) = %q", v)
+	}
+	if got := scanKeys(tx.Scan(nil, nil, 0)); fmt.Sprint(got) != "[a]" {
+		t.Fatalf("tx.Scan = %v", got)
+	}
+}
+
+func TestSnapshotAcrossClear(t *testing.T) {
+	kv := openTestKV(t)
+	kv.Set([]byte("a"), []byte("old"))
+	kv.Set([]byte("b"), []byte("old"))
+	tx := kv.Begin()
+	if v, _ := tx.Get([]byte("a")); string(v) != "old" {
+		t.Fatalf("tx.Get(a) = %q", v)
+	}
+	if err := kv.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := tx.Get([]byte("b")); !ok || string(v) != "old" {
+		t.Fatalf("tx.Get(b) after Clear = %q, %v", v, ok)
+	}
+	if got := scanKeys(tx.Scan(nil, nil, 0)); fmt.Sprint(got) != "[a b]" {
+		t.Fatalf("tx.Scan after Clear = %v", got)
+	}
+
+	// what the transaction read is gone, so its write must not land
+	tx.Set([]byte("c"), []byte("from a"))
+	if err := tx.Commit(); err != ErrConflict {
+		t.Fatalf("Commit after Clear = %v, want ErrConflict", err)
+	}
+	if _, ok := kv.Get([]byte("c")); ok {
+		t.Fatal("conflicting write landed")
+	}
+
+	// a transaction begun after the clear commits as usual
+	tx = kv.Begin()
+	if _, ok := tx.Get([]byte("a")); ok {
+		t.Fatal("new transaction reads a cleared key")
+	}
+	tx.Set([]byte("a"), []byte("new"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if st := kv.Stats(); st.Snapshots != 0 || st.Versions != 0 {
+		t.Fatalf("%d snapshots, %d versions left", st.Snapshots, st.Versions)
+	}
+}
+
+// TestSnapshotsSeeWholeCommits moves units between two keys in transactions
+// while other transactions check that the total never changes.
+func TestSnapshotsSeeWholeCommits(t *testing.T) {
+	kv := openTestKV(t)
+	kv.Set([]byte("x"), []byte("100"))
+	kv.Set([]byte("y"), []byte("100"))
+	read := func(tx *Tx, key string) int {
+		v, _ := tx.Get([]byte(key))
+		n, _ := strconv.Atoi(string(v))
+		return n
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				tx := kv.Begin()
+				tx.Set([]byte("x"), []byte(strconv.Itoa(read(tx, "x")-1)))
+				tx.Set([]byte("y"), []byte(strconv.Itoa(read(tx, "y")+1)))
+				tx.Commit()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				tx := kv.Begin()
+				x := read(tx, "x")
+				kv.syncTree()
+				if sum := x + read(tx, "y"); sum != 200 {
+					t.Errorf("snapshot sum = %d", sum)
+				}
+				tx.Rollback()
+			}
+		}()
+	}
+	wg.Wait()
+	if st := kv.Stats(); st.Snapshots != 0 || st.Versions != 0 {
+		t.Fatalf("%d snapshots, %d versions left", st.Snapshots, st.Versions)
+	}
+}
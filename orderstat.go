@@ -0,0 +1,72 @@
+package main
+
+// --- Order-statistic queries ---
+//
+// Every node records how many keys its subtree holds, so positions can be
+// computed on the way down instead of by scanning: the keys left of child i
+// in a node number i plus the sizes of children 0..i-1. Each query touches
+// one node per level.
+
+// Count returns the number of keys in the tree.
+func (t *BTree) Count() int {
+	return t.root.Load().size
+}
+
+// Rank returns the number of keys less than key, which is key's zero-based
+// position when it is present, and whether it is present.
+func (t *BTree) Rank(key []byte) (int, bool) {
+	return btreeRank(t.root.Load(), string(key))
+}
+
+func btreeRank(n *btreeNode, key string) (int, bool) {
+	rank := 0
+	for {
+		i, found := n.search(key)
+		rank += i
+		if n.leaf {
+			return rank, found
+		}
+		for _, c := range n.child[:i] {
+			rank += c.size
+		}
+		if found {
+			return rank + n.child[i].size, true
+		}
+		n = n.child[i]
+	}
+}
+
+// Select returns the entry at zero-based position i in key order; ok is
+// false when i is out of range.
+func (t *BTree) Select(i int) (key, value []byte, ok bool) {
+	n := t.root.Load()
+	if i < 0 || i >= n.size {
+		return nil, nil, false
+	}
+	for {
+		if n.leaf {
+			return []byte(n.keys[i]), []byte(n.values[i]), true
+		}
+		j := 0
+		for ; i >= n.child[j].size; j++ {
+			i -= n.child[j].size
+			if i == 0 {
+				return []byte(n.keys[j]), []byte(n.values[j]), true
+			}
+			i-- // the separator after child j
+		}
+		n = n.child[j]
+	}
+}
+
+// RangeCount returns the number of keys with start <= key < end. An empty
+// end means no upper bound.
+func (t *BTree) RangeCount(start, end []byte) int {
+	root := t.root.Load()
+	lo, _ := btreeRank(root, string(start))
+	hi := root.size
+	if len(end) > 0 {
+		hi, _ = btreeRank(root, string(end))
+	}
+	return max(0, hi-lo)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// checkOrderStats compares every order-statistic query against the sorted
+// model keys.
+func checkOrderStats(t *testing.T, tree *BTree, keys []string) {
+	t.Helper()
+	if n := tree.Count(); n != len(keys) {
+		t.Fatalf("Count = %d, want %d", n, len(keys))
+	}
+	for i, k := range keys {
+		if r, ok := tree.Rank([]byte(k)); !ok || r != i {
+			t.Fatalf("Rank(%q) = %d, %v; want %d", k, r, ok, i)
+		}
+		if got, _, ok := tree.Select(i); !ok || string(got) != k {
+			t.Fatalf("Select(%d) = %q, %v; want %q", i, got, ok, k)
+		}
+		// a key just after k is absent and ranks after it
+		if r, ok := tree.Rank([]byte(k + "\x00")); ok || r != i+1 {
+			t.Fatalf("Rank(%q+0) = %d, %v; want %d", k, r, ok, i+1)
+		}
+	}
+	if _, _, ok := tree.Select(len(keys)); ok {
+		t.Fatal("Select past the end succeeded")
+	}
+	if _, _, ok := tree.Select(-1); ok {
+		t.Fatal("Select(-1) succeeded")
+	}
+}
+
+func TestOrderStatsRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(9))
+	tree := NewBTree()
+	model := map[string]bool{}
+	for round := 0; round < 4; round++ {
+		for i := 0; i < 3000; i++ {
+			k := fmt.Sprintf("k%05d", rng.Intn(6000))
+			if rng.Intn(3) == 0 {
+				tree.Delete([]byte(k))
+				delete(model, k)
+			} else {
+				tree.Insert([]byte(k), []byte("v"))
+				model[k] = true
+			}
+		}
+		keys := make([]string, 0, len(model))
+		for k := range model {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		checkBTree(t, tree)
+		checkOrderStats(t, tree, keys)
+
+		for i := 0; i < 50; i++ {
+			a, b := fmt.Sprintf("k%05d", rng.Intn(6000)), fmt.Sprintf("k%05d", rng.Intn(6000))
+			want := sort.SearchStrings(keys, b) - sort.SearchStrings(keys, a)
+			if got := tree.RangeCount([]byte(a), []byte(b)); got != max(0, want) {
+				t.Fatalf("RangeCount(%s, %s) = %d, want %d", a, b, got, max(0, want))
+			}
+		}
+		if got := tree.RangeCount([]byte("k03000"), nil); got != len(keys)-sort.SearchStrings(keys, "k03000") {
+			t.Fatalf("unbounded RangeCount = %d", got)
+		}
+	}
+}
+
+func TestOrderStatsAfterLoad(t *testing.T) {
+	tree := NewBTree()
+	var keys []string
+	for i := 0; i < 4000; i++ {
+		k := fmt.Sprintf("k%05d", i*2)
+		keys = append(keys, k)
+		tree.Insert([]byte(k), []byte("v"))
+	}
+	path := filepath.Join(t.TempDir(), "tree.snap")
+	if err := tree.SaveToFile(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewBTree()
+	if err := loaded.LoadFromFile(path); err != nil {
+		t.Fatal(err)
+	}
+	checkOrderStats(t, loaded, keys)
+
+	// counts stay right for writes on top of a bulk-loaded tree
+	loaded.Insert([]byte("k00001"), []byte("v"))
+	loaded.Delete([]byte("k07998"))
+	keys = append([]string{keys[0], "k00001"}, keys[1:len(keys)-1]...)
+	checkBTree(t, loaded)
+	checkOrderStats(t, loaded, keys)
+}
+
+func TestUltraKVOrderStats(t *testing.T) {
+	kv := openTestKV(t)
+	for i := 0; i < 100; i++ {
+		kv.Set([]byte(fmt.Sprintf("score:%03d", i)), []byte(fmt.Sprint(i)))
+	}
+	kv.Del([]byte("score:050"))
+	if n := kv.Count(); n != 99 {
+		t.Fatalf("Count = %d, want 99", n)
+	}
+	if r, ok := kv.Rank([]byte("score:060")); !ok || r != 59 {
+		t.Fatalf("Rank(score:060) = %d, %v", r, ok)
+	}
+	// page 3 of 10 per page
+	if k, v, ok := kv.Select(20); !ok || string(k) != "score:020" || string(v) != "20" {
+		t.Fatalf("Select(20) = %q, %q, %v", k, v, ok)
+	}
+	if n := kv.RangeCount([]byte("score:040"), []byte("score:060")); n != 19 {
+		t.Fatalf("RangeCount = %d, want 19", n)
+	}
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// --- The store's page file ---
+//
+// Unless the store is encrypted, its tree is a DiskBTree page file
+// (<btreePath>.pages) rather than the in-memory BTree: reads that miss the
+// cache and the pending set search it through its buffer pool, so only the
+// pages in use are in memory, and startup does not load it. writeFlusher
+// applies every batch to it, tagging each change with the LSN of the
+// record it came from, and commits it every pageCommitEvery, at every
+// checkpoint and Import and on Close. A write stays in the pending set
+// until a commit covers it. A page is only written once the WAL is durable
+// through every record that changed it (see bufferpool.go). The LSN a
+// commit records says how much of the log the page file covers: startup
+// replays only the records after it. When a snapshot is newer (after a
+// restore, or when the page file was lost) the snapshot is streamed into a
+// new page file and the log replayed from there.
+//
+// A checkpoint streams its snapshot out of the page file while writes keep
+// landing in it: the page file is committed at the checkpoint's LSN, and
+// until the snapshot has been read past a key, the first write to it saves
+// the entry it replaces for the snapshot to use instead.
+//
+// The page file is not encrypted, so a store with EncryptionKeys keeps
+// none and holds its tree in memory, recovering from its snapshots and WAL.
+//
+// If updating the page file fails, it is rolled back to its last commit,
+// the writes since stay in the pending set, and every later write fails
+// with the error until Clear replaces the page file or the store is
+// reopened. Recovery can still start from it: the WAL after its LSN is
+// retained, as checkpoints fail too.
+
+// pageCommitEvery is how often the page file is committed while writes
+// keep coming.
+const pageCommitEvery = time.Second
+
+// pageScanChunk is how many entries a scan reads from the page file per
+// visit, letting writeFlusher and readers in between.
+const pageScanChunk = 256
+
+// pageSnapshot tracks a snapshot being read out of the page file.
+type pageSnapshot struct {
+	from string             // keys below it have been read
+	done bool               // every key has been read
+	pre  map[string]*string // entries as of the snapshot, nil when absent
+}
+
+func (kv *UltraKV) pagesPath() string {
+	return pagesPath(kv.btreePath)
+}
+
+func pagesPath(btreePath string) string {
+	return btreePath + ".pages"
+}
+
+// openPages opens the page file. An encrypted store keeps none, and
+// deletes one left in the clear from before it was encrypted.
+func (kv *UltraKV) openPages() error {
+	if kv.keys != nil {
+		return removePages(kv.btreePath)
+	}
+	disk, err := OpenDiskBTree(kv.pagesPath(), &DiskOptions{
+		PoolBytes: kv.opts.PoolBytes,
+		FlushWAL:  kv.flushWALThrough,
+	})
+	if err != nil {
+		return err
+	}
+	kv.disk = disk
+	return nil
+}
+
+// resetPages replaces the page file with an empty one, which also ends a
+// failure; diskMu is held.
+func (kv *UltraKV) resetPages() error {
+	if kv.disk != nil {
+		kv.disk.Close()
+		kv.disk = nil
+	}
+	kv.diskOps, kv.diskErr = nil, nil
+	kv.diskFailed.Store(false)
+	err := removePages(kv.btreePath)
+	if err == nil {
+		err = kv.openPages()
+	}
+	if err != nil {
+		kv.failPagesLocked(err)
+	}
+	return err
+}
+
+// removePages deletes the page file of the store at btreePath.
+func removePages(btreePath string) error {
+	for _, path := range []string{pagesPath(btreePath), pagesPath(btreePath) + "-journal"} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadSnapshotPages replaces the page file with the snapshot in path and
+// returns its LSN.
+func (kv *UltraKV) loadSnapshotPages(path string) (uint64, error) {
+	if err := kv.resetPages(); err != nil {
+		return 0, err
+	}
+	return readSnapshotFile(path, kv.keys, func(r io.Reader) (uint64, error) {
+		d, err := newSnapshotDecoder(r)
+		if err != nil {
+			return 0, err
+		}
+		for k, v, ok := d.next(); ok; k, v, ok = d.next() {
+			if err := kv.disk.Put(k, v); err != nil {
+				return 0, err
+			}
+		}
+		return d.lsn, d.finish()
+	})
+}
+
+// getPages looks key up in the page file.
+func (kv *UltraKV) getPages(key string) ([]byte, bool) {
+	kv.diskMu.Lock()
+	defer kv.diskMu.Unlock()
+	if kv.disk == nil {
+		return nil, false
+	}
+	v, ok, err := kv.disk.Get([]byte(key))
+	if err != nil {
+		kv.failPagesLocked(err)
+		return nil, false
+	}
+	return v, ok
+}
+
+// ascendPages calls fn for the page file's entries with start <= key < end
+// in key order until it returns false. An empty end means no upper bound.
+// The page file changes under kv.lock, which the caller holds to see it
+// hold still.
+func (kv *UltraKV) ascendPages(start, end []byte, fn func(k, v []byte) bool) {
+	for {
+		kv.diskMu.Lock()
+		var chunk []Entry
+		var err error
+		if kv.disk != nil {
+			chunk, err = kv.disk.Scan(start, end, pageScanChunk)
+		}
+		if err != nil {
+			kv.failPagesLocked(err)
+		}
+		kv.diskMu.Unlock()
+		for _, e := range chunk {
+			if !fn(e.Key, e.Value) {
+				return
+			}
+		}
+		if len(chunk) < pageScanChunk {
+			return
+		}
+		last := chunk[len(chunk)-1].Key
+		start = append(last[:len(last):len(last)], 0)
+	}
+}
+
+// findPages returns the entry find picks out of the page file.
+func (kv *UltraKV) findPages(find func(d *DiskBTree) (k, v []byte, ok bool, err error)) ([]byte, []byte, bool) {
+	kv.diskMu.Lock()
+	defer kv.diskMu.Unlock()
+	if kv.disk == nil {
+		return nil, nil, false
+	}
+	k, v, ok, err := find(kv.disk)
+	if err != nil {
+		kv.failPagesLocked(err)
+		return nil, nil, false
+	}
+	return k, v, ok
+}
+
+// countPages returns the number of keys in the page file.
+func (kv *UltraKV) countPages() int {
+	kv.diskMu.Lock()
+	defer kv.diskMu.Unlock()
+	if kv.disk == nil {
+		return 0
+	}
+	return int(kv.disk.Len())
+}
+
+// rangeCountPages counts the keys with start <= key < end by walking them:
+// the page file's nodes do not record subtree sizes. An empty end means no
+// upper bound.
+func (kv *UltraKV) rangeCountPages(start, end []byte) int {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	n := 0
+	kv.ascendPages(start, end, func(k, v []byte) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// selectPages walks to the entry at position i.
+func (kv *UltraKV) selectPages(i int) (key, value []byte, ok bool) {
+	if i < 0 {
+		return nil, nil, false
+	}
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	kv.ascendPages(nil, nil, func(k, v []byte) bool {
+		if i > 0 {
+			i--
+			return true
+		}
+		key, value, ok = k, v, true
+		return false
+	})
+	return key, value, ok
+}
+
+// applyPages applies ops, which cover the log through lsn, to the page
+// file; kv.lock is held. It is committed at lsn once pageCommitEvery has
+// passed since its last commit or half the buffer pool is dirty, which
+// bounds how much of the log recovery replays without paying for a commit
+// per batch. applyPages returns the writes a commit covered, which no
+// longer need their pending entries.
+func (kv *UltraKV) applyPages(lsn uint64, ops []WriteOp) []WriteOp {
+	kv.diskMu.Lock()
+	defer kv.diskMu.Unlock()
+	if kv.disk == nil || kv.diskErr != nil {
+		return nil
+	}
+	for _, op := range ops {
+		err := kv.preserveLocked(op.Key)
+		if err == nil {
+			kv.disk.SetLSN(op.lsn)
+			if op.OpType == "set" {
+				err = kv.disk.Put([]byte(op.Key), []byte(op.Value))
+			} else {
+				_, err = kv.disk.Delete([]byte(op.Key))
+			}
+		}
+		if err != nil {
+			kv.failPagesLocked(err)
+			return nil
+		}
+	}
+	kv.diskOps = append(kv.diskOps, ops...)
+	kv.diskLSN = lsn
+	st := kv.disk.Stats()
+	if time.Since(kv.diskCommitted) >= pageCommitEvery || 2*st.Dirty >= st.Frames {
+		return kv.commitPagesLocked(lsn)
+	}
+	return nil
+}
+
+// commitPages commits the page file at lsn, through which it holds the
+// whole log, and drops the pending entries that were waiting for it. With
+// freeze set a snapshot of it as committed is started (see savePages).
+func (kv *UltraKV) commitPages(lsn uint64, freeze bool) error {
+	kv.diskMu.Lock()
+	var done []WriteOp
+	if kv.disk != nil && kv.diskErr == nil {
+		kv.diskLSN = lsn
+		done = kv.commitPagesLocked(lsn)
+	}
+	err := kv.diskErr
+	if err == nil && freeze {
+		kv.diskSnap = &pageSnapshot{pre: make(map[string]*string)}
+	}
+	kv.diskMu.Unlock()
+	kv.dropPending(done)
+	return err
+}
+
+// tickPages commits the page file once writes applied to it have waited
+// pageCommitEvery, so they do not stay pending while the store is idle.
+func (kv *UltraKV) tickPages() {
+	kv.diskMu.Lock()
+	var done []WriteOp
+	if kv.disk != nil && kv.diskErr == nil && len(kv.diskOps) > 0 && time.Since(kv.diskCommitted) >= pageCommitEvery {
+		done = kv.commitPagesLocked(kv.diskLSN)
+	}
+	kv.diskMu.Unlock()
+	kv.dropPending(done)
+}
+
+func (kv *UltraKV) commitPagesLocked(lsn uint64) []WriteOp {
+	if err := kv.disk.Commit(lsn); err != nil {
+		kv.failPagesLocked(err)
+		return nil
+	}
+	kv.diskCommitted = time.Now()
+	done := kv.diskOps
+	kv.diskOps = nil
+	return done
+}
+
+// preserveLocked saves key's entry for the snapshot being read out of the
+// page file before a write changes it, unless the snapshot is past the key
+// or already has it; diskMu is held.
+func (kv *UltraKV) preserveLocked(key string) error {
+	s := kv.diskSnap
+	if s == nil || s.done || key < s.from {
+		return nil
+	}
+	if _, ok := s.pre[key]; ok {
+		return nil
+	}
+	v, ok, err := kv.disk.Get([]byte(key))
+	if err != nil {
+		return err
+	}
+	var old *string
+	if ok {
+		str := string(v)
+		old = &str
+	}
+	s.pre[key] = old
+	return nil
+}
+
+// savePages writes the snapshot commitPages froze to path, tagged with lsn,
+// and ends it.
+func (kv *UltraKV) savePages(path string, lsn uint64) error {
+	defer func() {
+		kv.diskMu.Lock()
+		kv.diskSnap = nil
+		kv.diskMu.Unlock()
+	}()
+	return writeSnapshotFile(path, kv.keys, func(w io.Writer) error {
+		return writeSnapshot(w, lsn, func(emit func(k, v []byte)) error {
+			for {
+				kv.diskMu.Lock()
+				chunk, err := kv.snapshotChunkLocked()
+				done := kv.diskSnap.done
+				kv.diskMu.Unlock()
+				if err != nil {
+					return err
+				}
+				for _, e := range chunk {
+					emit(e.Key, e.Value)
+				}
+				if done {
+					return nil
+				}
+			}
+		})
+	})
+}
+
+// snapshotChunkLocked reads the snapshot's next entries: the page file's,
+// with the entries writes have saved since it was frozen put back in their
+// place. diskMu is held.
+func (kv *UltraKV) snapshotChunkLocked() ([]Entry, error) {
+	if kv.diskErr != nil {
+		return nil, kv.diskErr
+	}
+	s := kv.diskSnap
+	chunk, err := kv.disk.Scan([]byte(s.from), nil, pageScanChunk)
+	if err != nil {
+		kv.failPagesLocked(err)
+		return nil, kv.diskErr
+	}
+	// the chunk ends at its last key, or covers the rest when it is short
+	s.done = len(chunk) < pageScanChunk
+	var last string
+	if !s.done {
+		last = string(chunk[len(chunk)-1].Key)
+	}
+	var saved []string
+	for k := range s.pre {
+		if k >= s.from && (s.done || k <= last) {
+			saved = append(saved, k)
+		}
+	}
+	sort.Strings(saved)
+
+	out := make([]Entry, 0, len(chunk)+len(saved))
+	put := func(k string) {
+		if v := s.pre[k]; v != nil {
+			out = append(out, Entry{Key: []byte(k), Value: []byte(*v)})
+		}
+		delete(s.pre, k)
+	}
+	for _, e := range chunk {
+		for len(saved) > 0 && saved[0] < string(e.Key) {
+			put(saved[0])
+			saved = saved[1:]
+		}
+		if len(saved) > 0 && saved[0] == string(e.Key) {
+			put(saved[0])
+			saved = saved[1:]
+			continue
+		}
+		out = append(out, e)
+	}
+	for _, k := range saved {
+		put(k)
+	}
+	s.from = last + "\x00"
+	return out, nil
+}
+
+// flushWALThrough makes the WAL durable through lsn. The page file's
+// buffer pool calls it before writing a page that record changed.
+func (kv *UltraKV) flushWALThrough(lsn uint64) error {
+	kv.walSyncMu.Lock()
+	synced, err := kv.walSyncedLSN, kv.walErr
+	kv.walSyncMu.Unlock()
+	if err != nil || synced >= lsn {
+		return err
+	}
+	kv.flushWALBuffer()
+	kv.walSyncMu.Lock()
+	defer kv.walSyncMu.Unlock()
+	if kv.walErr == nil && kv.walSyncedLSN < lsn {
+		return fmt.Errorf("godb: WAL not flushed through LSN %d", lsn)
+	}
+	return kv.walErr
+}
+
+// failPagesLocked stops updating the page file after err; diskMu is held.
+// What changed since its last commit is rolled back, so the writes since
+// stay pending.
+func (kv *UltraKV) failPagesLocked(err error) {
+	if kv.diskErr != nil {
+		return
+	}
+	if kv.disk != nil {
+		kv.disk.Rollback()
+	}
+	kv.diskErr = fmt.Errorf("godb: page file failed: %w", err)
+	kv.diskFailed.Store(true)
+}
+
+// pagesError returns the page file's failure, if it had one.
+func (kv *UltraKV) pagesError() error {
+	if !kv.diskFailed.Load() {
+		return nil
+	}
+	kv.diskMu.Lock()
+	defer kv.diskMu.Unlock()
+	return kv.diskErr
+}
+
+// closePages commits and closes the page file.
+func (kv *UltraKV) closePages() {
+	kv.diskMu.Lock()
+	defer kv.diskMu.Unlock()
+	if kv.disk != nil && kv.diskErr == nil {
+		kv.commitPagesLocked(kv.diskLSN)
+	}
+	if kv.disk != nil {
+		kv.disk.Close()
+		kv.disk = nil
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPageFileRecovery(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{CheckpointWALBytes: -1}
+	kv := openCheckpointKV(t, dir, opts)
+	for i := 0; i < 300; i++ {
+		kv.Set([]byte(fmt.Sprintf("k%03d", i)), []byte(strings.Repeat("v", i)))
+	}
+	for i := 0; i < 300; i += 3 {
+		kv.Del([]byte(fmt.Sprintf("k%03d", i)))
+	}
+	kv.Close()
+
+	pages, err := OpenDiskBTree(filepath.Join(dir, "test.db.pages"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pages.LSN() != 400 || pages.Len() != 200 {
+		t.Fatalf("page file at LSN %d with %d keys, want 400 and 200", pages.LSN(), pages.Len())
+	}
+	pages.Close()
+
+	// the page file covers the whole log, so startup does not need it
+	segs, _ := listSegments(filepath.Join(dir, "test.db.wal"))
+	for _, s := range segs {
+		os.Remove(s.path)
+	}
+	kv = openCheckpointKV(t, dir, opts)
+	if n := kv.Count(); n != 200 {
+		t.Fatalf("Count from the page file = %d, want 200", n)
+	}
+	if v, _ := kv.Get([]byte("k299")); len(v) != 299 {
+		t.Fatalf("k299 holds %d bytes", len(v))
+	}
+	if st := kv.Stats(); st.LSN != 400 {
+		t.Fatalf("log resumes after LSN %d, want 400", st.LSN)
+	}
+	kv.Set([]byte("tail"), []byte("v"))
+	kv.Checkpoint()
+	kv.Close()
+
+	// a lost page file is rebuilt from the checkpoint
+	removePages(filepath.Join(dir, "test.db"))
+	kv = openCheckpointKV(t, dir, opts)
+	defer kv.Close()
+	if n := kv.Count(); n != 201 {
+		t.Fatalf("Count after losing the page file = %d, want 201", n)
+	}
+	kv.diskMu.Lock()
+	lsn, keys := kv.disk.LSN(), kv.disk.Len()
+	kv.diskMu.Unlock()
+	if lsn != 401 || keys != 201 {
+		t.Fatalf("rebuilt page file at LSN %d with %d keys", lsn, keys)
+	}
+}
+
+func TestLongKeys(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{CheckpointWALBytes: -1}
+	kv := openCheckpointKV(t, dir, opts)
+	long := func(i int) []byte {
+		return []byte(fmt.Sprintf("%03d", i) + strings.Repeat("k", diskMaxInlineKey+i*100))
+	}
+	var entries []Entry
+	for i := 0; i < 40; i++ {
+		entries = append(entries, Entry{Key: long(i), Value: []byte{byte(i)}})
+	}
+	if err := kv.Import(entries, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Set(long(40), []byte{40}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := kv.SetIfAbsent(long(41), []byte{41}); !ok || err != nil {
+		t.Fatalf("SetIfAbsent = %v, %v", ok, err)
+	}
+	tx := kv.Begin()
+	tx.Set(long(42), []byte{42})
+	tx.Del(long(0))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < 40; i += 2 {
+		kv.Del(long(i))
+	}
+	kv.Close()
+
+	// read them back from the page file alone
+	segs, _ := listSegments(filepath.Join(dir, "test.db.wal"))
+	for _, s := range segs {
+		os.Remove(s.path)
+	}
+	kv = openCheckpointKV(t, dir, opts)
+	defer kv.Close()
+	var want []int
+	for i := 2; i < 43; i++ {
+		if i >= 40 || i%2 == 0 {
+			want = append(want, i)
+		}
+	}
+	got := kv.Scan(nil, nil, 0)
+	if len(got) != len(want) {
+		t.Fatalf("Scan returned %d keys, want %d", len(got), len(want))
+	}
+	for j, i := range want {
+		if string(got[j].Key) != string(long(i)) || got[j].Value[0] != byte(i) {
+			t.Fatalf("entry %d is %.8q", j, got[j].Key)
+		}
+		if v, ok := kv.Get(long(i)); !ok || v[0] != byte(i) {
+			t.Fatalf("Get(long(%d)) = %v, %v", i, v, ok)
+		}
+	}
+	if _, ok := kv.Get(long(0)); ok {
+		t.Fatal("deleted long key still present")
+	}
+}
+
+func TestPageFileWaitsForWAL(t *testing.T) {
+	// nothing flushes the log but the page file needing it
+	kv := openCheckpointKV(t, t.TempDir(), &Options{Sync: SyncNone, SyncEvery: time.Hour, PoolBytes: 8 * pageSize})
+	defer kv.Close()
+	for i := 0; i < 300; i++ {
+		kv.Set([]byte(fmt.Sprintf("k%03d", i)), []byte(strings.Repeat("v", 200)))
+	}
+	if st := kv.Stats(); st.SyncedLSN != 0 {
+		t.Fatalf("log flushed to %d before the page file asked", st.SyncedLSN)
+	}
+	kv.Count() // lands the writes in the tree and the page file
+	st := kv.Stats()
+	if st.SyncedLSN != 300 {
+		t.Fatalf("page file written with the log flushed to %d of 300", st.SyncedLSN)
+	}
+	if p := st.Pool; p.Frames != 8 || p.Used == 0 || p.Evictions == 0 || p.WriteBacks == 0 {
+		t.Fatalf("pool stats %+v", p)
+	}
+}
+
+func TestPageFileServesReads(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{PoolBytes: 16 * pageSize, CacheEntries: 100}
+	kv := openCheckpointKV(t, dir, opts)
+	for i := 0; i < 2000; i++ {
+		kv.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(strings.Repeat("v", i%300)))
+	}
+	kv.Close()
+
+	kv = openCheckpointKV(t, dir, opts)
+	defer kv.Close()
+	if n := kv.btree.Count(); n != 0 {
+		t.Fatalf("startup loaded %d keys into memory", n)
+	}
+	for i := 0; i < 2000; i++ {
+		if v, ok := kv.Get([]byte(fmt.Sprintf("k%04d", i))); !ok || len(v) != i%300 {
+			t.Fatalf("Get(k%04d) = %d bytes, %v", i, len(v), ok)
+		}
+	}
+	st := kv.Stats()
+	if st.CacheEntries > 100 || st.TreeHits != 2000 {
+		t.Fatalf("%d cached values after %d tree hits", st.CacheEntries, st.TreeHits)
+	}
+	if p := st.Pool; p.Misses == 0 || p.Used > 16 {
+		t.Fatalf("pool stats %+v", p)
+	}
+	if n := kv.Count(); n != 2000 {
+		t.Fatalf("Count = %d", n)
+	}
+	if got := kv.Scan([]byte("k0100"), []byte("k0200"), 0); len(got) != 100 {
+		t.Fatalf("Scan returned %d entries", len(got))
+	}
+}
+
+func TestCheckpointDuringWrites(t *testing.T) {
+	dir := t.TempDir()
+	kv := openCheckpointKV(t, dir, &Options{Sync: SyncNone, CheckpointWALBytes: -1})
+	defer kv.Close()
+	want := make(map[string]string)
+	for i := 0; i < 5000; i++ {
+		k, v := fmt.Sprintf("k%05d", 2*i), fmt.Sprint(i)
+		kv.Set([]byte(k), []byte(v))
+		want[k] = v
+	}
+
+	// Checkpoint's steps, with writes landing while the snapshot is read
+	kv.ckptMu.Lock()
+	kv.ckptLock.Lock()
+	kv.syncTree()
+	lsn := kv.lastLSN()
+	if err := kv.commitPages(lsn, true); err != nil {
+		t.Fatal(err)
+	}
+	kv.ckptLock.Unlock()
+	write := func(i int) {
+		k := []byte(fmt.Sprintf("k%05d", (i*7919)%10000))
+		if i%3 == 0 {
+			kv.Del(k)
+		} else {
+			kv.Set(k, []byte("new"))
+		}
+		if i%50 == 0 {
+			kv.syncTree()
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		write(i)
+	}
+	kv.syncTree()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1000; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			write(i)
+		}
+	}()
+	path := kv.snapshotPath(lsn)
+	err := kv.savePages(path, lsn)
+	close(stop)
+	<-done
+	kv.ckptMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snap := NewBTree()
+	if got, err := loadSnapshot(snap, path, nil); err != nil || got != lsn {
+		t.Fatalf("snapshot at LSN %d, %v; want %d", got, err, lsn)
+	}
+	if n := snap.Count(); n != len(want) {
+		t.Fatalf("snapshot has %d keys, want %d", n, len(want))
+	}
+	for k, v := range want {
+		if got, ok := snap.Get([]byte(k)); !ok || string(got) != v {
+			t.Fatalf("snapshot has %s = %q, want %q", k, got, v)
+		}
+	}
+}
+
+func TestPageFileFailureIsSticky(t *testing.T) {
+	kv := openTestKV(t)
+	kv.Set([]byte("a"), []byte("1"))
+	kv.Checkpoint()
+	kv.Set([]byte("a"), []byte("2"))
+	kv.Set([]byte("b"), []byte("1"))
+	kv.syncTree()
+
+	// rolls back the uncommitted writes, which stay readable
+	kv.diskMu.Lock()
+	kv.failPagesLocked(errors.New("disk on fire"))
+	kv.diskMu.Unlock()
+	for k, want := range map[string]string{"a": "2", "b": "1"} {
+		if v, ok := kv.Get([]byte(k)); !ok || string(v) != want {
+			t.Fatalf("Get(%s) = %q, %v; want %q", k, v, ok, want)
+		}
+	}
+	if got := scanKeys(kv.Scan(nil, nil, 0)); fmt.Sprint(got) != "[a b]" {
+		t.Fatalf("Scan = %v", got)
+	}
+	if err := kv.Set([]byte("c"), nil); err == nil || !strings.Contains(err.Error(), "disk on fire") {
+		t.Fatalf("Set after the failure = %v", err)
+	}
+	if err := kv.Checkpoint(); err == nil {
+		t.Fatal("Checkpoint after the failure succeeded")
+	}
+
+	// Clear starts over with a new page file
+	if err := kv.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Set([]byte("c"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+}
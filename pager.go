@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// --- Page file ---
+//
+// The file is a sequence of pageSize pages. Page 0 is the meta page; every
+// other page is a B+tree node, an overflow page holding part of a large
+// value, or a free page threaded onto the free list.
+//
+// Pages are updated in place. Before a page that existed at the last commit
+// is overwritten, its committed image is copied to a rollback journal
+// (<path>-journal) and the journal is fsynced. Commit writes the dirty pages
+// and the meta page, fsyncs the file and removes the journal. Opening a file
+// with a journal left behind by a crash copies those images back, so the
+// file always reflects the last successful commit.
+
+const (
+	pageSize = 4096
+
+	pageMagic    = "GODBPAG1"
+	journalMagic = "GODBJRN1"
+)
+
+const (
+	pageTypeLeaf byte = iota + 1
+	pageTypeInternal
+	pageTypeOverflow
+	pageTypeFree
+)
+
+var (
+	ErrBadPageFile = errors.New("godb: not a page file or unsupported page size")
+	ErrCorruptMeta = errors.New("godb: page file meta page checksum mismatch")
+)
+
+// pageMeta is the content of page 0.
+type pageMeta struct {
+	root      uint32 // root node page, 0 for an empty tree
+	freeHead  uint32 // first page on the free list, 0 when empty
+	pageCount uint32 // pages in the file, including the meta page
+	lsn       uint64 // caller-supplied log position covered by the last commit
+	entries   uint64 // number of keys in the tree
+}
+
+const metaSize = 8 + 4 + 4 + 4 + 4 + 8 + 8 + 4
+
+func (m pageMeta) encode() []byte {
+	buf := make([]byte, pageSize)
+	copy(buf, pageMagic)
+	binary.LittleEndian.PutUint32(buf[8:], pageSize)
+	binary.LittleEndian.PutUint32(buf[12:], m.root)
+	binary.LittleEndian.PutUint32(buf[16:], m.freeHead)
+	binary.LittleEndian.PutUint32(buf[20:], m.pageCount)
+	binary.LittleEndian.PutUint64(buf[24:], m.lsn)
+	binary.LittleEndian.PutUint64(buf[32:], m.entries)
+	binary.LittleEndian.PutUint32(buf[40:], crc32.ChecksumIEEE(buf[:40]))
+	return buf
+}
+
+func decodeMeta(buf []byte) (pageMeta, error) {
+	if len(buf) < metaSize || string(buf[:8]) != pageMagic ||
+		binary.LittleEndian.Uint32(buf[8:]) != pageSize {
+		return pageMeta{}, ErrBadPageFile
+	}
+	if crc32.ChecksumIEEE(buf[:40]) != binary.LittleEndian.Uint32(buf[40:]) {
+		return pageMeta{}, ErrCorruptMeta
+	}
+	return pageMeta{
+		root:      binary.LittleEndian.Uint32(buf[12:]),
+		freeHead:  binary.LittleEndian.Uint32(buf[16:]),
+		pageCount: binary.LittleEndian.Uint32(buf[20:]),
+		lsn:       binary.LittleEndian.Uint64(buf[24:]),
+		entries:   binary.LittleEndian.Uint64(buf[32:]),
+	}, nil
+}
+
+// DiskOptions configures a DiskBTree.
+type DiskOptions struct {
+	// PoolBytes bounds the memory used for cached pages (default 8 MiB).
+	PoolBytes int
+	// FlushWAL, when set, is called with an LSN before any page changed by
+	// that log record is written to the page file, and must not return
+	// until the log is durable through it.
+	FlushWAL func(lsn uint64) error
+}
+
+type pager struct {
+	file        *os.File
+	journalPath string
+	pool        *bufferPool
+
+	meta      pageMeta // working state, becomes durable at commit
+	committed pageMeta
+	lsn       uint64 // log record behind the changes being made now
+
+	journal   *os.File // open once a page has been journaled this commit
+	journaled map[uint32]bool
+}
+
+func openPager(path string, opts *DiskOptions) (*pager, error) {
+	if opts == nil {
+		opts = &DiskOptions{}
+	}
+	poolBytes := opts.PoolBytes
+	if poolBytes <= 0 {
+		poolBytes = defaultPoolBytes
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	p := &pager{
+		file:        f,
+		journalPath: path + "-journal",
+		pool:        newBufferPool(poolBytes),
+		journaled:   make(map[uint32]bool),
+	}
+	p.pool.load = p.loadPage
+	p.pool.store = p.storePage
+	p.pool.flushWAL = opts.FlushWAL
+	if err := p.recoverJournal(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if st.Size() == 0 {
+		// fresh file: just the meta page
+		p.meta = pageMeta{pageCount: 1}
+		if _, err := f.WriteAt(p.meta.encode(), 0); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	} else {
+		buf := make([]byte, pageSize)
+		if _, err := f.ReadAt(buf, 0); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if p.meta, err = decodeMeta(buf); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	p.committed = p.meta
+	return p, nil
+}
+
+// read returns a copy of the current image of page id.
+func (p *pager) read(id uint32) ([]byte, error) {
+	f, err := p.pool.pin(id)
+	if err != nil {
+		return nil, err
+	}
+	buf := append([]byte(nil), f.data...)
+	p.pool.unpin(f, false, 0)
+	return buf, nil
+}
+
+// write replaces page id. The buffer pool holds it until it is evicted or
+// the next commit.
+func (p *pager) write(id uint32, buf []byte) error {
+	f, err := p.pool.pinNew(id)
+	if err != nil {
+		return err
+	}
+	copy(f.data, buf)
+	p.pool.unpin(f, true, p.lsn)
+	return nil
+}
+
+// alloc returns a page for new content, reusing the free list first.
+func (p *pager) alloc() (uint32, error) {
+	if id := p.meta.freeHead; id != 0 {
+		buf, err := p.read(id)
+		if err != nil {
+			return 0, err
+		}
+		p.meta.freeHead = binary.LittleEndian.Uint32(buf[4:])
+		return id, nil
+	}
+	id := p.meta.pageCount
+	p.meta.pageCount++
+	return id, nil
+}
+
+// free puts page id on the free list.
+func (p *pager) free(id uint32) error {
+	buf := make([]byte, pageSize)
+	buf[0] = pageTypeFree
+	binary.LittleEndian.PutUint32(buf[4:], p.meta.freeHead)
+	if err := p.write(id, buf); err != nil {
+		return err
+	}
+	p.meta.freeHead = id
+	return nil
+}
+
+func (p *pager) loadPage(id uint32, buf []byte) error {
+	_, err := p.file.ReadAt(buf, int64(id)*pageSize)
+	return err
+}
+
+// storePage writes a page in place, journaling its committed image first
+// when it is evicted before commit.
+func (p *pager) storePage(id uint32, buf []byte) error {
+	if id < p.committed.pageCount && !p.journaled[id] {
+		if err := p.journalPages([]uint32{id}); err != nil {
+			return err
+		}
+	}
+	_, err := p.file.WriteAt(buf, int64(id)*pageSize)
+	return err
+}
+
+// commit makes every page written since the last commit durable, together
+// with the meta page recording lsn.
+func (p *pager) commit(lsn uint64) error {
+	p.meta.lsn = lsn
+	dirty := p.pool.dirtyFrames()
+	if len(dirty) == 0 && p.journal == nil && p.meta == p.committed {
+		return nil
+	}
+	ids := []uint32{0}
+	for _, f := range dirty {
+		ids = append(ids, f.id)
+	}
+	if err := p.journalPages(ids); err != nil {
+		return err
+	}
+	if p.pool.flushWAL != nil {
+		if err := p.pool.flushWAL(lsn); err != nil {
+			return err
+		}
+	}
+	if err := p.pool.flushAll(); err != nil {
+		return err
+	}
+	if _, err := p.file.WriteAt(p.meta.encode(), 0); err != nil {
+		return err
+	}
+	if err := p.file.Sync(); err != nil {
+		return err
+	}
+	if err := p.closeJournal(); err != nil {
+		return err
+	}
+	p.committed = p.meta
+	return nil
+}
+
+// rollback discards every change since the last commit, including pages
+// the buffer pool already wrote back early.
+func (p *pager) rollback() error {
+	p.pool.discard()
+	p.meta = p.committed
+	if p.journal != nil {
+		p.journal.Close()
+		p.journal = nil
+		p.journaled = make(map[uint32]bool)
+		return p.recoverJournal()
+	}
+	return p.file.Truncate(int64(p.committed.pageCount) * pageSize)
+}
+
+// journalPages saves the committed image of each page that existed at the
+// last commit and has not been saved yet, then fsyncs the journal.
+func (p *pager) journalPages(ids []uint32) error {
+	if p.journal == nil {
+		j, err := os.OpenFile(p.journalPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		hdr := make([]byte, 16)
+		copy(hdr, journalMagic)
+		binary.LittleEndian.PutUint32(hdr[8:], p.committed.pageCount)
+		binary.LittleEndian.PutUint32(hdr[12:], pageSize)
+		if _, err := j.Write(hdr); err != nil {
+			j.Close()
+			return err
+		}
+		p.journal = j
+	}
+	rec := make([]byte, 4+pageSize+4)
+	for _, id := range ids {
+		if id >= p.committed.pageCount || p.journaled[id] {
+			continue
+		}
+		binary.LittleEndian.PutUint32(rec, id)
+		if _, err := p.file.ReadAt(rec[4:4+pageSize], int64(id)*pageSize); err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint32(rec[4+pageSize:], crc32.ChecksumIEEE(rec[:4+pageSize]))
+		if _, err := p.journal.Write(rec); err != nil {
+			return err
+		}
+		p.journaled[id] = true
+	}
+	return p.journal.Sync()
+}
+
+func (p *pager) closeJournal() error {
+	if p.journal == nil {
+		return nil
+	}
+	p.journal.Close()
+	p.journal = nil
+	p.journaled = make(map[uint32]bool)
+	return os.Remove(p.journalPath)
+}
+
+// recoverJournal rolls the page file back to its last commit if a crash
+// left a journal behind. Records that fail their checksum were still being
+// written when the crash happened, before any page was touched in place.
+func (p *pager) recoverJournal() error {
+	j, err := os.Open(p.journalPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer j.Close()
+
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(j, hdr); err != nil || string(hdr[:8]) != journalMagic {
+		// the header never made it to disk, so neither did any page write
+		j.Close()
+		return os.Remove(p.journalPath)
+	}
+	pageCount := binary.LittleEndian.Uint32(hdr[8:])
+	rec := make([]byte, 4+pageSize+4)
+	for {
+		if _, err := io.ReadFull(j, rec); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(rec[:4+pageSize]) != binary.LittleEndian.Uint32(rec[4+pageSize:]) {
+			break
+		}
+		id := binary.LittleEndian.Uint32(rec)
+		if _, err := p.file.WriteAt(rec[4:4+pageSize], int64(id)*pageSize); err != nil {
+			return err
+		}
+	}
+	if err := p.file.Truncate(int64(pageCount) * pageSize); err != nil {
+		return err
+	}
+	if err := p.file.Sync(); err != nil {
+		return err
+	}
+	j.Close()
+	return os.Remove(p.journalPath)
+}
+
+func (p *pager) close() error {
+	if p.journal != nil {
+		p.journal.Close()
+	}
+	return p.file.Close()
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// --- Point-in-time recovery ---
+//
+// Restore rebuilds a store as it was at an earlier point of its log and
+// opens the result as a new database in another directory, leaving the
+// source untouched. The point is an LSN, a wall-clock time (every record
+// carries the time it was logged) or a named marker written with Mark.
+//
+// Replay starts from the newest snapshot at or before the target, so the
+// reachable window reaches back to the oldest retained checkpoint, or
+// further when retired segments were kept in an archive directory.
+
+// RecoveryTarget says where Restore stops replaying. Set exactly one of
+// LSN, Time and Mark.
+type RecoveryTarget struct {
+	LSN  uint64    // keep records up to and including this LSN
+	Time time.Time // keep records logged at or before this time
+	Mark string    // keep records up to the last MARK with this name
+
+	// ArchiveDir is also searched for segments, for stores that archive
+	// retired segments (Options.WALArchiveDir).
+	ArchiveDir string
+}
+
+// ErrTargetUnreachable is returned when the snapshots and log available do
+// not cover the recovery target.
+var ErrTargetUnreachable = errors.New("godb: recovery target is outside the available log")
+
+// Mark logs a named marker that Restore can stop at, and returns its LSN
+// once it is as durable as a write.
+func (kv *UltraKV) Mark(name string) (uint64, error) {
+	kv.ckptLock.RLock()
+	lsn := kv.writeWAL("MARK", name, "")
+	kv.ckptLock.RUnlock()
+	return lsn, kv.waitDurable(lsn)
+}
+
+// Restore writes the store at btreePath and walPath, as of target, into
+// dir under the same file names and opens it with opts. dir must be empty
+// or not exist yet.
+func Restore(btreePath, walPath string, target RecoveryTarget, dir string, opts *Options) (*UltraKV, error) {
+	set := 0
+	for _, ok := range []bool{target.LSN > 0, !target.Time.IsZero(), target.Mark != ""} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, errors.New("godb: set exactly one of LSN, Time and Mark in the recovery target")
+	}
+	if ents, err := os.ReadDir(dir); err == nil && len(ents) > 0 {
+		return nil, fmt.Errorf("godb: restore directory %s is not empty", dir)
+	}
+	kr, err := newKeyring(opts.withDefaults().EncryptionKeys)
+	if err != nil {
+		return nil, err
+	}
+	segs, err := restoreSegments(walPath, target.ArchiveDir)
+	if err != nil {
+		return nil, err
+	}
+	snaps, err := listSnapshots(btreePath)
+	if err != nil {
+		return nil, err
+	}
+
+	stop := target.LSN
+	if stop == 0 {
+		if stop, err = resolveTarget(segs, snaps, target, kr); err != nil {
+			return nil, err
+		}
+	}
+	tree, base, err := restoreBase(snaps, stop, kr)
+	if err != nil {
+		return nil, err
+	}
+
+	// LSNs are consecutive, so a jump means a segment is missing
+	errStop := errors.New("stop")
+	reached := base
+	var prev uint64
+	_, _, err = readSegmentList(segs, kr, func(r walRecord) error {
+		defer func() { prev = r.lsn }()
+		switch {
+		case r.lsn <= base:
+			return nil
+		case r.lsn > reached+1 && reached < stop:
+			return fmt.Errorf("%w: the log jumps from LSN %d to %d", ErrTargetUnreachable, reached, r.lsn)
+		case r.lsn > stop:
+			return errStop
+		}
+		reached = r.lsn
+		if r.op == "CHECKPOINT" {
+			// an Import: its snapshot replaces everything before it
+			tree = NewBTree()
+			path := snapshotPath(btreePath, r.lsn)
+			if _, err := loadSnapshot(tree, path, kr); err != nil {
+				return fmt.Errorf("load checkpoint %s: %w", path, err)
+			}
+			return nil
+		}
+		ops, err := walOps(r, prev)
+		if err != nil {
+			return err
+		}
+		for _, op := range ops {
+			if op.op == "SET" {
+				tree.Insert([]byte(op.key), []byte(op.value))
+			} else {
+				tree.Delete([]byte(op.key))
+			}
+		}
+		return nil
+	})
+	if err != nil && err != errStop {
+		return nil, err
+	}
+	if reached < stop {
+		return nil, fmt.Errorf("%w: the log ends at LSN %d, before %d", ErrTargetUnreachable, reached, stop)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	dstBtree := filepath.Join(dir, filepath.Base(btreePath))
+	dstWAL := filepath.Join(dir, filepath.Base(walPath))
+	if err := saveSnapshot(tree, snapshotPath(dstBtree, stop), stop, kr); err != nil {
+		return nil, err
+	}
+	return NewUltraKVWithOptions(dstBtree, dstWAL, opts)
+}
+
+// resolveTarget finds the last LSN to keep for a Time or Mark target.
+// Reading stops once a Time target is passed, so damage later in the log
+// does not matter.
+func resolveTarget(segs []walSegment, snaps []snapshotFile, target RecoveryTarget, kr *keyring) (uint64, error) {
+	errStop := errors.New("stop")
+	var stop, first uint64
+	found := false
+	_, _, err := readSegmentList(segs, kr, func(r walRecord) error {
+		if first == 0 {
+			first = r.lsn
+		}
+		if target.Mark != "" {
+			if r.op == "MARK" && r.key == target.Mark {
+				stop, found = r.lsn, true
+			}
+			return nil
+		}
+		// times never decrease along the log
+		if r.time > target.Time.UnixNano() {
+			found = true
+			return errStop
+		}
+		stop = r.lsn
+		return nil
+	})
+	if err == errStop {
+		err = nil
+	}
+	switch {
+	case target.Mark != "" && !found:
+		return 0, errors.Join(fmt.Errorf("%w: no MARK named %q", ErrTargetUnreachable, target.Mark), err)
+	case target.Mark == "" && !found && err != nil:
+		// the damage may hide records from before the target
+		return 0, err
+	case stop == 0 && (first > 1 || first == 0 && len(snaps) > 0):
+		// earlier history is only in snapshots, which have no times
+		return 0, fmt.Errorf("%w: %s is before the oldest record in the log", ErrTargetUnreachable,
+			target.Time.Format(time.RFC3339))
+	}
+	return stop, nil
+}
+
+// restoreBase loads the newest readable snapshot at or before stop, or
+// returns an empty tree at LSN 0.
+func restoreBase(snaps []snapshotFile, stop uint64, kr *keyring) (*BTree, uint64, error) {
+	for _, s := range snaps {
+		if s.lsn > stop {
+			continue
+		}
+		tree := NewBTree()
+		lsn, err := loadSnapshot(tree, s.path, kr)
+		if errors.Is(err, ErrKeyNotFound) {
+			return nil, 0, err
+		}
+		if err == nil {
+			return tree, lsn, nil
+		}
+	}
+	return NewBTree(), 0, nil
+}
+
+// restoreSegments lists the store's segments together with those retired
+// into archiveDir.
+func restoreSegments(walPath, archiveDir string) ([]walSegment, error) {
+	segs, err := listSegments(walPath)
+	if err != nil {
+		return nil, err
+	}
+	if archiveDir == "" {
+		return segs, nil
+	}
+	archived, err := listSegments(filepath.Join(archiveDir, filepath.Base(walPath)))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	live := make(map[uint64]bool, len(segs))
+	for _, s := range segs {
+		live[s.start] = true
+	}
+	for _, s := range archived {
+		if !live[s.start] {
+			segs = append(segs, s)
+		}
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i].start < segs[j].start })
+	return segs, nil
+}
+
+const restoreUsage = "usage: godb restore -lsn N | -time RFC3339 | -mark NAME [-archive DIR] <dir>"
+
+// runRestore runs `godb restore` against the store at btreePath and
+// walPath, whose files keys decrypt.
+func runRestore(args []string, btreePath, walPath string, keys []EncryptionKey, out io.Writer) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	fs.SetOutput(out)
+	var target RecoveryTarget
+	var at string
+	fs.Uint64Var(&target.LSN, "lsn", 0, "restore up to and including this LSN")
+	fs.StringVar(&at, "time", "", "restore writes logged at or before this RFC 3339 time")
+	fs.StringVar(&target.Mark, "mark", "", "restore up to the last marker with this name")
+	fs.StringVar(&target.ArchiveDir, "archive", "", "also read retired WAL segments from this directory")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New(restoreUsage)
+	}
+	if at != "" {
+		t, err := time.Parse(time.RFC3339Nano, at)
+		if err != nil {
+			return err
+		}
+		target.Time = t
+	}
+	kv, err := Restore(btreePath, walPath, target, fs.Arg(0), &Options{EncryptionKeys: keys})
+	if err != nil {
+		return err
+	}
+	defer kv.Close()
+	fmt.Fprintf(out, "restored %d keys as of LSN %d into %s\n", kv.Count(), kv.Stats().LSN, fs.Arg(0))
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func restoreAt(t *testing.T, src *UltraKV, target RecoveryTarget) *UltraKV {
+	t.Helper()
+	kv, err := Restore(src.btreePath, src.walPath, target, filepath.Join(t.TempDir(), "restored"), nil)
+	if err != nil {
+		t.Fatalf("Restore(%+v): %v", target, err)
+	}
+	return kv
+}
+
+func TestRestoreToLSNTimeAndMark(t *testing.T) {
+	dir := t.TempDir()
+	src := openCheckpointKV(t, dir, &Options{CheckpointWALBytes: -1})
+	for i := 0; i < 10; i++ {
+		src.Set([]byte(fmt.Sprintf("k%d", i)), []byte("good"))
+	}
+	src.Checkpoint()
+	src.Set([]byte("k0"), []byte("still good")) // LSN 11
+	if lsn, err := src.Mark("before-deploy"); err != nil || lsn != 12 {
+		t.Fatalf("Mark = %d, %v", lsn, err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	cut := time.Now()
+	time.Sleep(2 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		src.Set([]byte(fmt.Sprintf("k%d", i)), []byte("garbage"))
+	}
+	src.Del([]byte("k9"))
+	src.Close()
+
+	check := func(kv *UltraKV, lsn uint64, want map[string]string) {
+		t.Helper()
+		defer kv.Close()
+		if st := kv.Stats(); st.LSN != lsn {
+			t.Fatalf("restored at LSN %d, want %d", st.LSN, lsn)
+		}
+		if n := kv.Count(); n != len(want) {
+			t.Fatalf("restored %d keys, want %d", n, len(want))
+		}
+		for k, v := range want {
+			if got, _ := kv.Get([]byte(k)); string(got) != v {
+				t.Fatalf("Get(%s) = %q, want %q", k, got, v)
+			}
+		}
+		// the copy is a working store of its own
+		kv.Set([]byte("new"), []byte("x"))
+	}
+	good := map[string]string{"k0": "still good", "k5": "good", "k9": "good"}
+	for i := 0; i < 10; i++ {
+		if k := fmt.Sprintf("k%d", i); good[k] == "" {
+			good[k] = "good"
+		}
+	}
+	check(restoreAt(t, src, RecoveryTarget{Mark: "before-deploy"}), 12, good)
+	check(restoreAt(t, src, RecoveryTarget{Time: cut}), 12, good)
+
+	// mid-way through the garbage, replayed on top of the checkpoint
+	mid := restoreAt(t, src, RecoveryTarget{LSN: 15})
+	if v, _ := mid.Get([]byte("k2")); string(v) != "garbage" {
+		t.Fatalf("Get(k2) at LSN 15 = %q", v)
+	}
+	if v, _ := mid.Get([]byte("k3")); string(v) != "good" {
+		t.Fatalf("Get(k3) at LSN 15 = %q", v)
+	}
+	mid.Close()
+
+	// the source is untouched
+	src = openCheckpointKV(t, dir, nil)
+	defer src.Close()
+	if _, ok := src.Get([]byte("k9")); ok {
+		t.Fatal("source changed by restore")
+	}
+}
+
+func TestRestoreUnreachableTargets(t *testing.T) {
+	dir := t.TempDir()
+	src := openCheckpointKV(t, dir, &Options{CheckpointsKept: 1, CheckpointWALBytes: -1})
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		src.Set([]byte(fmt.Sprintf("k%d", i)), []byte("v"))
+	}
+	src.Checkpoint() // retires LSNs 1..10
+	src.Set([]byte("k"), []byte("v"))
+	src.Close()
+
+	for _, target := range []RecoveryTarget{
+		{LSN: 5},  // only a snapshot at 10 remains
+		{LSN: 99}, // past the end
+		{Time: start},
+		{Mark: "nope"},
+	} {
+		_, err := Restore(src.btreePath, src.walPath, target, filepath.Join(t.TempDir(), "r"), nil)
+		if !errors.Is(err, ErrTargetUnreachable) {
+			t.Fatalf("Restore(%+v) = %v, want ErrTargetUnreachable", target, err)
+		}
+	}
+	if _, err := Restore(src.btreePath, src.walPath, RecoveryTarget{LSN: 1, Mark: "x"}, t.TempDir(), nil); err == nil {
+		t.Fatal("two targets accepted")
+	}
+	busy := t.TempDir()
+	os.WriteFile(filepath.Join(busy, "f"), nil, 0644)
+	if _, err := Restore(src.btreePath, src.walPath, RecoveryTarget{LSN: 10}, busy, nil); err == nil {
+		t.Fatal("restored into a non-empty directory")
+	}
+}
+
+func TestRestoreFromArchive(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive")
+	src := openCheckpointKV(t, dir, &Options{CheckpointsKept: 1, CheckpointWALBytes: -1, WALArchiveDir: archive})
+	for i := 0; i < 10; i++ {
+		src.Set([]byte(fmt.Sprintf("k%d", i)), []byte("v"))
+	}
+	src.Checkpoint()
+	src.Set([]byte("k"), []byte("v"))
+	src.Close()
+
+	kv := restoreAt(t, src, RecoveryTarget{LSN: 5, ArchiveDir: archive})
+	defer kv.Close()
+	if n := kv.Count(); n != 5 {
+		t.Fatalf("Count at LSN 5 = %d", n)
+	}
+}
+
+func TestRestoreCommand(t *testing.T) {
+	dir := t.TempDir()
+	src := openCheckpointKV(t, dir, nil)
+	src.Set([]byte("a"), []byte("1"))
+	src.Mark("m")
+	src.Set([]byte("b"), []byte("2"))
+	src.Close()
+
+	var out bytes.Buffer
+	dst := filepath.Join(dir, "restored")
+	if err := runRestore([]string{"-mark", "m", dst}, src.btreePath, src.walPath, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "restored 1 keys as of LSN 2") {
+		t.Fatalf("restore printed %q", out.String())
+	}
+	if err := runRestore([]string{dst}, src.btreePath, src.walPath, nil, &out); err == nil {
+		t.Fatal("restore without a target succeeded")
+	}
+}
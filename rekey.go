@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// --- godb rekey ---
+//
+// `godb rekey -new-key-file F` rewrites every snapshot and WAL segment of a
+// closed store encrypted under a new key, or encrypts a store that was
+// plaintext. The current key comes from GODB_KEY or GODB_KEY_FILE as for
+// the store itself. Each file is replaced atomically, so an interrupted
+// rekey leaves a store that opens with both keys and can be rekeyed again.
+
+const rekeyUsage = "usage: godb rekey -new-key-file FILE [-archive DIR]"
+
+// runRekey runs `godb rekey` against the store at btreePath and walPath,
+// whose files keys decrypt.
+func runRekey(args []string, btreePath, walPath string, keys []EncryptionKey, out io.Writer) error {
+	fs := flag.NewFlagSet("rekey", flag.ContinueOnError)
+	fs.SetOutput(out)
+	keyFile := fs.String("new-key-file", "", "file holding the hex-encoded new key")
+	archive := fs.String("archive", "", "also rekey WAL segments retired into this directory")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *keyFile == "" || fs.NArg() != 0 {
+		return errors.New(rekeyUsage)
+	}
+	newKey, err := LoadKeyFile(*keyFile)
+	if err != nil {
+		return err
+	}
+	snaps, segs, err := rekeyStore(btreePath, walPath, *archive, newKey, keys)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "re-encrypted %d snapshots and %d WAL segments under key ID %s\n", snaps, segs, newKey.ID)
+	return nil
+}
+
+// rekeyStore rewrites the store's files under newKey, reading them with
+// newKey or any of old. The store must be closed.
+func rekeyStore(btreePath, walPath, archiveDir string, newKey EncryptionKey, old []EncryptionKey) (snaps, segs int, err error) {
+	kr, err := newKeyring(append([]EncryptionKey{newKey}, old...))
+	if err != nil {
+		return 0, 0, err
+	}
+	snapFiles, err := listSnapshots(btreePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	paths := make([]string, 0, len(snapFiles)+1)
+	for _, s := range snapFiles {
+		paths = append(paths, s.path)
+	}
+	if _, err := os.Stat(btreePath); err == nil {
+		paths = append(paths, btreePath) // the copy saved on Close
+	}
+	for _, path := range paths {
+		tree := NewBTree()
+		lsn, err := loadSnapshot(tree, path, kr)
+		if err != nil {
+			return snaps, segs, fmt.Errorf("%s: %w", path, err)
+		}
+		if err := saveSnapshot(tree, path, lsn, kr); err != nil {
+			return snaps, segs, err
+		}
+		snaps++
+	}
+
+	// the page file is plaintext; an encrypted store keeps none
+	if err := removePages(btreePath); err != nil {
+		return snaps, segs, err
+	}
+
+	segments, err := restoreSegments(walPath, archiveDir)
+	if err != nil {
+		return snaps, segs, err
+	}
+	for _, s := range segments {
+		if s.start == 0 {
+			return snaps, segs, errors.New("the log predates segments; open the store once to upgrade it first")
+		}
+		if err := rekeySegment(s.path, kr); err != nil {
+			return snaps, segs, fmt.Errorf("%s: %w", s.path, err)
+		}
+		segs++
+	}
+	return snaps, segs, nil
+}
+
+// rekeySegment rewrites a segment under kr's write key, keeping its codec.
+// A torn tail is dropped, as recovery would.
+func rekeySegment(path string, kr *keyring) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	head := make([]byte, len(walMagicBlock)+1)
+	n, _ := io.ReadFull(f, head)
+	codec := WALCodecNone
+	if n == len(head) && (bytes.HasPrefix(head, []byte(walMagicBlock)) || bytes.HasPrefix(head, []byte(walMagicSealed))) {
+		codec = WALCodec(head[len(walMagicBlock)])
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	var frames []walEntry
+	scan, err := readWAL(f, st.Size(), kr, func(r walRecord) error {
+		frames = append(frames, walEntry{r.lsn, encodeWALRecord(r.lsn, r.time, r.op, r.key, r.value)})
+		return nil
+	})
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if scan.legacy {
+		return errors.New("the log predates segments; open the store once to upgrade it first")
+	}
+
+	header := walHeader(codec, kr)
+	enc, err := newWALBlockEncoder(codec, kr, header)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, func(w io.Writer) error {
+		if _, err := io.WriteString(w, header); err != nil {
+			return err
+		}
+		for len(frames) > 0 {
+			batch := frames[:min(len(frames), 500)]
+			frames = frames[len(batch):]
+			if _, err := io.WriteString(w, enc.encode(batch)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- WAL segments ---
+//
+// The log is a set of segment files <walPath>.<first LSN>, each starting
+// with the WAL magic. Records are appended to the newest segment until it
+// reaches SegmentBytes or SegmentAge, when it is fsynced and sealed and a
+// new one is started; checkpoints also start a new segment. A segment is no
+// longer needed once a retained checkpoint covers its last record, which is
+// one before the next segment's first LSN. Such segments are deleted, or
+// moved to WALArchiveDir when one is configured.
+//
+// A store created before segments has a single file at walPath. It is read
+// as the oldest segment and retired by the checkpoint taken at open.
+
+type walSegment struct {
+	start uint64 // first LSN the segment may hold; 0 for the old single file
+	path  string
+}
+
+func (kv *UltraKV) segmentPath(start uint64) string {
+	return segmentPath(kv.walPath, start)
+}
+
+func (kv *UltraKV) listSegments() ([]walSegment, error) {
+	return listSegments(kv.walPath)
+}
+
+func segmentPath(walPath string, start uint64) string {
+	return fmt.Sprintf("%s.%020d", walPath, start)
+}
+
+// listSegments returns the WAL segments named after walPath, oldest first.
+func listSegments(walPath string) ([]walSegment, error) {
+	dir, base := filepath.Split(walPath)
+	if dir == "" {
+		dir = "."
+	}
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segs []walSegment
+	for _, e := range ents {
+		if e.Name() == base && e.Type().IsRegular() {
+			segs = append(segs, walSegment{path: walPath})
+			continue
+		}
+		num, ok := strings.CutPrefix(e.Name(), base+".")
+		if !ok || len(num) != 20 {
+			continue
+		}
+		start, err := strconv.ParseUint(num, 10, 64)
+		if err != nil {
+			continue
+		}
+		segs = append(segs, walSegment{start: start, path: filepath.Join(dir, e.Name())})
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i].start < segs[j].start })
+	return segs, nil
+}
+
+// readSegments calls fn for every record in every segment, in LSN order.
+// Only the newest segment may end in a torn record; the returned scan
+// describes that segment, and seg is its path ("" when there are none). A
+// *WALCorruptError, including one returned by fn, names its segment.
+func readSegments(walPath string, kr *keyring, fn func(walRecord) error) (scan walScan, seg string, err error) {
+	segs, err := listSegments(walPath)
+	if err != nil {
+		return walScan{}, "", err
+	}
+	return readSegmentList(segs, kr, fn)
+}
+
+// readSegmentList is readSegments over a given list of segments.
+func readSegmentList(segs []walSegment, kr *keyring, fn func(walRecord) error) (scan walScan, seg string, err error) {
+	var last uint64
+	for i, s := range segs {
+		f, err := os.Open(s.path)
+		if err != nil {
+			return walScan{}, "", err
+		}
+		st, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return walScan{}, "", err
+		}
+		sc, err := readWAL(f, st.Size(), kr, func(r walRecord) error {
+			if r.lsn <= last {
+				// readWAL checks order within a segment, so this is its first record
+				return &WALCorruptError{Path: s.path, Offset: r.off, LastLSN: last,
+					Reason: fmt.Sprintf("LSN %d does not follow %d from the previous segment", r.lsn, last)}
+			}
+			last = r.lsn
+			return fn(r)
+		})
+		f.Close()
+		if err != nil {
+			var ce *WALCorruptError
+			if errors.As(err, &ce) && ce.Path == "" {
+				ce.Path = s.path
+			}
+			return walScan{}, "", err
+		}
+		if sc.torn && i < len(segs)-1 {
+			return walScan{}, "", &WALCorruptError{Path: s.path, Offset: sc.end, LastLSN: last,
+				Reason: "sealed segment ends in a partial record"}
+		}
+		scan.legacy = scan.legacy || sc.legacy || s.start == 0
+		scan.records += sc.records
+		scan.end, scan.torn = sc.end, sc.torn
+		seg = s.path
+	}
+	scan.lastLSN = last
+	return scan, seg, nil
+}
+
+// openSegmentLocked makes the newest segment the active one, starting a
+// new segment at the next LSN when there is none or the newest is written
+// with another codec or under another key. walLock is held.
+func (kv *UltraKV) openSegmentLocked() error {
+	segs, err := kv.listSegments()
+	if err != nil {
+		return err
+	}
+	path := kv.segmentPath(kv.walFlushedLSN + 1)
+	if n := len(segs); n > 0 && segs[n-1].start != 0 {
+		current, err := hasHeader(segs[n-1].path, kv.walHeader)
+		if err != nil {
+			return err
+		}
+		switch {
+		case current:
+			path = segs[n-1].path
+		case segs[n-1].path == path:
+			// an old segment with no records yet: start it over
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+	return kv.switchSegmentLocked(path)
+}
+
+// hasHeader reports whether the file at path is a log starting with
+// header, the one new segments are written with.
+func hasHeader(path, header string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	head := make([]byte, len(header))
+	n, _ := io.ReadFull(f, head)
+	// an empty or torn header is rewritten by openWAL
+	return strings.HasPrefix(header, string(head[:n])), nil
+}
+
+func (kv *UltraKV) switchSegmentLocked(path string) error {
+	f, err := openWAL(path, kv.walHeader)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if kv.walFile != nil {
+		kv.walFile.Sync()
+		kv.walFile.Close()
+	}
+	kv.walFile = f
+	kv.walSegSize = st.Size()
+	kv.walSegOpened = time.Now()
+	return nil
+}
+
+// rotateWALLocked seals the active segment and starts a new one after the
+// last flushed record, unless the active one is still empty. walLock is
+// held and the buffers have just been flushed.
+func (kv *UltraKV) rotateWALLocked() error {
+	if kv.walSegSize <= int64(len(kv.walHeader)) {
+		return nil
+	}
+	return kv.switchSegmentLocked(kv.segmentPath(kv.walFlushedLSN + 1))
+}
+
+// retireSegments seals the active segment, so the next checkpoint can
+// retire it, and deletes or archives every sealed segment whose records all
+// have LSNs up to keep and have been read by every open subscription.
+func (kv *UltraKV) retireSegments(keep uint64) error {
+	kv.walLock.Lock()
+	defer kv.walLock.Unlock()
+	keep = min(keep, kv.subscriberFloor())
+	kv.flushWALLocked()
+	if err := kv.rotateWALLocked(); err != nil {
+		return err
+	}
+	segs, err := kv.listSegments()
+	if err != nil {
+		return err
+	}
+	for i := 0; i+1 < len(segs); i++ {
+		if segs[i+1].start-1 > keep {
+			break
+		}
+		if err := kv.retireSegment(segs[i].path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (kv *UltraKV) retireSegment(path string) error {
+	if kv.opts.WALArchiveDir == "" {
+		return os.Remove(path)
+	}
+	if err := os.MkdirAll(kv.opts.WALArchiveDir, 0755); err != nil {
+		return err
+	}
+	dst := filepath.Join(kv.opts.WALArchiveDir, filepath.Base(path))
+	if err := os.Rename(path, dst); err == nil {
+		return nil
+	}
+	// across file systems: copy, then remove
+	if err := copyFile(path, dst); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(dst+".tmp", dst)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSegmentsRotateBySize(t *testing.T) {
+	dir := t.TempDir()
+	kv := openCheckpointKV(t, dir, &Options{SegmentBytes: 2 << 10, CheckpointWALBytes: -1})
+	for i := 0; i < 500; i++ {
+		kv.Set([]byte(fmt.Sprintf("k%04d", i)), make([]byte, 32))
+		if i%50 == 0 {
+			kv.flushWALBuffer()
+		}
+	}
+	kv.Close()
+
+	segs, err := kv.listSegments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segs) < 5 {
+		t.Fatalf("%d segments, want the log split by size", len(segs))
+	}
+	if lsns := walLSNs(t, kv.walPath); len(lsns) != 500 || lsns[0] != 1 || lsns[499] != 500 {
+		t.Fatalf("segments hold %d records", len(lsns))
+	}
+
+	kv = openCheckpointKV(t, dir, &Options{SegmentBytes: 2 << 10})
+	defer kv.Close()
+	if n := kv.Count(); n != 500 {
+		t.Fatalf("Count after replaying segments = %d, want 500", n)
+	}
+}
+
+func TestSegmentsRetiredByCheckpoint(t *testing.T) {
+	for _, archive := range []bool{false, true} {
+		dir := t.TempDir()
+		opts := &Options{CheckpointsKept: 1, CheckpointWALBytes: -1}
+		if archive {
+			opts.WALArchiveDir = filepath.Join(dir, "archive")
+		}
+		kv := openCheckpointKV(t, dir, opts)
+		for i := 0; i < 100; i++ {
+			kv.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("v"))
+		}
+		if err := kv.Checkpoint(); err != nil {
+			t.Fatal(err)
+		}
+		kv.Set([]byte("tail"), []byte("v"))
+		kv.Close()
+
+		segs, _ := kv.listSegments()
+		if len(segs) != 1 || segs[0].start != 101 {
+			t.Fatalf("archive=%v: segments after checkpoint %+v, want one from LSN 101", archive, segs)
+		}
+		_, err := os.Stat(filepath.Join(dir, "archive", filepath.Base(kv.segmentPath(1))))
+		if archive != (err == nil) {
+			t.Fatalf("archive=%v: archived copy: %v", archive, err)
+		}
+
+		kv = openCheckpointKV(t, dir, opts)
+		if n := kv.Count(); n != 101 {
+			t.Fatalf("archive=%v: Count = %d, want 101", archive, n)
+		}
+		kv.Close()
+	}
+}
+
+func TestSegmentsTornSealedSegmentIsReported(t *testing.T) {
+	dir := t.TempDir()
+	kv := openCheckpointKV(t, dir, &Options{CheckpointsKept: 2, CheckpointWALBytes: -1})
+	kv.Set([]byte("a"), []byte("1"))
+	kv.Checkpoint()
+	kv.Set([]byte("b"), []byte("2"))
+	kv.Checkpoint()
+	kv.Set([]byte("c"), []byte("3"))
+	kv.Close()
+
+	// the segment from LSN 2 is sealed and still needed by the older snapshot
+	sealed := kv.segmentPath(2)
+	st, err := os.Stat(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Truncate(sealed, st.Size()-1)
+	_, err = NewUltraKVWithOptions(kv.btreePath, kv.walPath, nil)
+	var ce *WALCorruptError
+	if !errors.As(err, &ce) || ce.Path != sealed {
+		t.Fatalf("open = %v, want corruption in %s", err, sealed)
+	}
+}
+
+func TestSegmentsClear(t *testing.T) {
+	dir := t.TempDir()
+	kv := openCheckpointKV(t, dir, &Options{SegmentBytes: 256})
+	for i := 0; i < 50; i++ {
+		kv.Set([]byte(fmt.Sprintf("k%02d", i)), []byte("v"))
+		kv.flushWALBuffer()
+	}
+	if err := kv.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	kv.Set([]byte("x"), []byte("1"))
+	kv.Close()
+
+	if segs, _ := kv.listSegments(); len(segs) != 1 {
+		t.Fatalf("%d segments after Clear, want 1", len(segs))
+	}
+	kv = openCheckpointKV(t, dir, nil)
+	defer kv.Close()
+	if got := fmt.Sprintf("%q", kv.Scan(nil, nil, 0)); got != `[{"x" "1"}]` {
+		t.Fatalf("after Clear and reopen: %s", got)
+	}
+}
+
+func TestClearWithoutNewSegment(t *testing.T) {
+	dir := t.TempDir()
+	// SyncNone acknowledges writes before flushing them, so only a sticky
+	// error stops them
+	kv := openCheckpointKV(t, dir, &Options{Sync: SyncNone})
+	defer kv.Close()
+	kv.Set([]byte("a"), []byte("1"))
+	// a non-empty directory where Clear's new segment goes
+	blocked := kv.segmentPath(kv.lastLSN() + 2)
+	if err := os.MkdirAll(filepath.Join(blocked, "x"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Clear(); err == nil {
+		t.Fatal("Clear succeeded with no segment to open")
+	}
+	if err := kv.Set([]byte("b"), []byte("2")); err == nil {
+		t.Fatal("Set succeeded with no segment to log to")
+	}
+	if err := kv.Del([]byte("b")); err == nil {
+		t.Fatal("Del succeeded with no segment to log to")
+	}
+}
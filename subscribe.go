@@ -0,0 +1,319 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- Change data capture ---
+//
+// Subscribe streams committed writes in LSN order, read back from the WAL:
+// first from the segments already on disk, then from each flush as it
+// lands. Only records as durable as Options.Sync makes them are delivered,
+// so under the default policy a consumer never sees a write a crash could
+// undo.
+//
+// Events wait in a buffered channel. When a consumer falls behind, the
+// subscription stops reading the log until there is room again; writers
+// never wait for it. While a subscription is open, the segments it has yet
+// to read are not retired by checkpoints.
+//
+// To resume after a reconnect, subscribe again from one past the last LSN
+// the consumer processed.
+
+// ErrChangesUnavailable is returned when the log no longer holds the
+// records a subscription needs.
+var ErrChangesUnavailable = errors.New("godb: changes from that LSN are no longer in the log")
+
+// Change is one write in a ChangeEvent.
+type Change struct {
+	Op    string // "SET" or "DEL"
+	Key   []byte
+	Value []byte // nil for DEL
+}
+
+// ChangeEvent is one committed WAL record: a single write, or every write
+// of a transaction.
+type ChangeEvent struct {
+	LSN     uint64
+	Time    time.Time // zero for records logged before records had times
+	Changes []Change
+	// Reset is set for an Import, which replaced the whole contents of the
+	// store; Changes is empty and the consumer must re-read the store.
+	Reset bool
+}
+
+const subscriptionBuffer = 256
+
+// Subscription is a stream of ChangeEvents opened by Subscribe.
+type Subscription struct {
+	kv   *UltraKV
+	ch   chan ChangeEvent
+	done chan struct{}
+	stop sync.Once
+	next atomic.Uint64 // first LSN not yet delivered
+
+	mu  sync.Mutex
+	err error // why the stream ended
+
+	// the follower's read position
+	seg walSegment
+	off int64 // 0 for the start of seg
+}
+
+// Subscribe delivers the committed records from LSN from onward, or from
+// the next write when from is 0.
+func (kv *UltraKV) Subscribe(from uint64) (*Subscription, error) {
+	select {
+	case <-kv.closeCh:
+		return nil, ErrClosed
+	default:
+	}
+	// walLock keeps checkpoints from retiring segments until the
+	// subscription is registered
+	kv.walLock.Lock()
+	defer kv.walLock.Unlock()
+	kv.walSyncMu.Lock()
+	synced := kv.walSyncedLSN
+	kv.walSyncMu.Unlock()
+	if from == 0 {
+		from = synced + 1
+	}
+	segs, err := kv.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	if from <= synced && (len(segs) == 0 || segs[0].start > from) {
+		return nil, ErrChangesUnavailable
+	}
+
+	s := &Subscription{kv: kv, ch: make(chan ChangeEvent, subscriptionBuffer), done: make(chan struct{})}
+	s.next.Store(from)
+	kv.subMu.Lock()
+	kv.subs[s] = struct{}{}
+	kv.subMu.Unlock()
+	kv.subWG.Add(1)
+	go s.run()
+	return s, nil
+}
+
+// Events returns the stream. It is closed when the subscription ends; Err
+// then says why.
+func (s *Subscription) Events() <-chan ChangeEvent { return s.ch }
+
+// Err returns the error that ended the subscription: nil after Close,
+// ErrClosed after the store was closed, ErrChangesUnavailable when the log
+// no longer has the records, or a WAL error.
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close ends the subscription.
+func (s *Subscription) Close() {
+	s.cancel(nil)
+}
+
+func (s *Subscription) cancel(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+	s.stop.Do(func() { close(s.done) })
+}
+
+func (s *Subscription) run() {
+	defer s.kv.subWG.Done()
+	err := s.follow()
+	s.kv.subMu.Lock()
+	delete(s.kv.subs, s)
+	s.kv.subMu.Unlock()
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+	close(s.ch)
+}
+
+var errSubscriptionDone = errors.New("subscription closed")
+
+// follow reads the log up to the synced LSN and waits for the next flush,
+// until the subscription or the store is closed.
+func (s *Subscription) follow() error {
+	kv := s.kv
+	for {
+		kv.walSyncMu.Lock()
+		synced, werr, ch := kv.walSyncedLSN, kv.walErr, kv.walSyncedCh
+		kv.walSyncMu.Unlock()
+		if werr != nil {
+			return werr
+		}
+		if s.next.Load() <= synced {
+			if err := s.readUpTo(synced); err != nil {
+				if err == errSubscriptionDone {
+					return nil
+				}
+				return err
+			}
+			continue
+		}
+		select {
+		case <-ch:
+		case <-s.done:
+			return nil
+		case <-kv.closeCh:
+			return ErrClosed
+		}
+	}
+}
+
+// readUpTo delivers the records from s.next through upTo, continuing from
+// where the last call stopped.
+func (s *Subscription) readUpTo(upTo uint64) error {
+	errStop := errors.New("stop")
+	for s.next.Load() <= upTo {
+		if s.seg.path == "" {
+			seg, err := s.findSegment()
+			if err != nil {
+				return err
+			}
+			s.seg, s.off = seg, 0
+		}
+		f, err := os.Open(s.seg.path)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: segment %s was removed", ErrChangesUnavailable, s.seg.path)
+		}
+		if err != nil {
+			return err
+		}
+		st, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		stopped := false
+		scan, err := readWALFrom(f, s.off, st.Size(), s.kv.keys, func(r walRecord) error {
+			next := s.next.Load()
+			switch {
+			case r.lsn > upTo:
+				// not synced yet: read it again next time
+				s.off, stopped = r.off, true
+				return errStop
+			case r.lsn < next:
+				return nil
+			case r.lsn > next:
+				return fmt.Errorf("%w: the log jumps from LSN %d to %d", ErrChangesUnavailable, next-1, r.lsn)
+			}
+			ev, ok, err := changeEvent(r, next-1)
+			if err != nil {
+				return err
+			}
+			if ok {
+				select {
+				case s.ch <- ev:
+				case <-s.done:
+					return errSubscriptionDone
+				case <-s.kv.closeCh:
+					return ErrClosed
+				}
+			}
+			s.next.Store(r.lsn + 1)
+			return nil
+		})
+		f.Close()
+		if err == errStop {
+			err = nil
+		}
+		if err != nil {
+			var ce *WALCorruptError
+			if errors.As(err, &ce) && ce.Path == "" {
+				ce.Path = s.seg.path
+			}
+			return err
+		}
+		if !stopped {
+			s.off = scan.end
+			if s.next.Load() <= upTo {
+				// the rest is in a later segment
+				seg, err := s.findSegment()
+				if err != nil {
+					return err
+				}
+				if seg.path == s.seg.path {
+					return fmt.Errorf("%w: LSN %d is missing", ErrChangesUnavailable, s.next.Load())
+				}
+				s.seg, s.off = seg, 0
+			}
+		}
+	}
+	return nil
+}
+
+// findSegment returns the segment holding the next LSN to deliver.
+func (s *Subscription) findSegment() (walSegment, error) {
+	segs, err := s.kv.listSegments()
+	if err != nil {
+		return walSegment{}, err
+	}
+	next := s.next.Load()
+	for i := len(segs) - 1; i >= 0; i-- {
+		if segs[i].start <= next {
+			return segs[i], nil
+		}
+	}
+	return walSegment{}, ErrChangesUnavailable
+}
+
+// changeEvent turns a record into the event for it; ok is false for
+// records that change nothing, such as MARK. prev is the LSN before it.
+func changeEvent(r walRecord, prev uint64) (ChangeEvent, bool, error) {
+	ev := ChangeEvent{LSN: r.lsn}
+	if r.time != 0 {
+		ev.Time = time.Unix(0, r.time)
+	}
+	if r.op == "CHECKPOINT" {
+		ev.Reset = true
+		return ev, true, nil
+	}
+	ops, err := walOps(r, prev)
+	if err != nil || len(ops) == 0 {
+		return ev, false, err
+	}
+	for _, op := range ops {
+		c := Change{Op: op.op, Key: []byte(op.key)}
+		if op.op == "SET" {
+			c.Value = []byte(op.value)
+		}
+		ev.Changes = append(ev.Changes, c)
+	}
+	return ev, true, nil
+}
+
+// subscriberFloor is the last LSN every open subscription has read past;
+// checkpoints keep the segments after it.
+func (kv *UltraKV) subscriberFloor() uint64 {
+	kv.subMu.Lock()
+	defer kv.subMu.Unlock()
+	floor := uint64(math.MaxUint64)
+	for s := range kv.subs {
+		floor = min(floor, s.next.Load()-1)
+	}
+	return floor
+}
+
+// endSubscriptions ends every open subscription with err.
+func (kv *UltraKV) endSubscriptions(err error) {
+	kv.subMu.Lock()
+	defer kv.subMu.Unlock()
+	for s := range kv.subs {
+		s.cancel(err)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// nextEvents receives n events from s, failing the test if they are slow
+// to come.
+func nextEvents(t *testing.T, s *Subscription, n int) []ChangeEvent {
+	t.Helper()
+	var evs []ChangeEvent
+	for len(evs) < n {
+		select {
+		case ev, ok := <-s.Events():
+			if !ok {
+				t.Fatalf("stream ended after %d of %d events: %v", len(evs), n, s.Err())
+			}
+			evs = append(evs, ev)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d of %d events", len(evs), n)
+		}
+	}
+	return evs
+}
+
+func TestSubscribeCatchUpThenLive(t *testing.T) {
+	for _, codec := range []WALCodec{WALCodecNone, WALCodecFlate} {
+		t.Run(codec.String(), func(t *testing.T) { testSubscribeCatchUpThenLive(t, codec) })
+	}
+}
+
+func testSubscribeCatchUpThenLive(t *testing.T, codec WALCodec) {
+	kv := openCheckpointKV(t, t.TempDir(), &Options{SegmentBytes: 200, CheckpointWALBytes: -1, WALCodec: codec})
+	defer kv.Close()
+	for i := 0; i < 30; i++ {
+		kv.Set([]byte(fmt.Sprintf("k%02d", i)), []byte("v"))
+	}
+	if segs, _ := kv.listSegments(); len(segs) < 3 {
+		t.Fatalf("want the catch-up to span segments, got %d", len(segs))
+	}
+	sub, err := kv.Subscribe(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	evs := nextEvents(t, sub, 30)
+
+	kv.Mark("skipped") // LSN 31 changes nothing
+	tx := kv.Begin()
+	tx.Set([]byte("a"), []byte("1"))
+	tx.Del([]byte("k00"))
+	tx.Commit()
+	kv.Del([]byte("k01"))
+	evs = append(evs, nextEvents(t, sub, 2)...)
+
+	for i, ev := range evs[:30] {
+		if ev.LSN != uint64(i+1) || len(ev.Changes) != 1 || string(ev.Changes[0].Key) != fmt.Sprintf("k%02d", i) {
+			t.Fatalf("event %d = %+v", i, ev)
+		}
+	}
+	txn := evs[30]
+	if txn.LSN != 32 || len(txn.Changes) != 2 || txn.Changes[0].Op == txn.Changes[1].Op || txn.Time.IsZero() {
+		t.Fatalf("transaction event = %+v", txn)
+	}
+	if del := evs[31]; del.LSN != 33 || del.Changes[0].Op != "DEL" || del.Changes[0].Value != nil {
+		t.Fatalf("delete event = %+v", del)
+	}
+}
+
+func TestSubscribeResume(t *testing.T) {
+	kv := openCheckpointKV(t, t.TempDir(), nil)
+	defer kv.Close()
+	for i := 0; i < 10; i++ {
+		kv.Set([]byte(fmt.Sprint(i)), []byte("v"))
+	}
+	sub, err := kv.Subscribe(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev := nextEvents(t, sub, 1)[0]; ev.LSN != 7 {
+		t.Fatalf("resumed at LSN %d", ev.LSN)
+	}
+	sub.Close()
+	for range sub.Events() {
+	}
+	if err := sub.Err(); err != nil {
+		t.Fatalf("Err after Close = %v", err)
+	}
+
+	live, err := kv.Subscribe(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.Close()
+	kv.Set([]byte("new"), []byte("v"))
+	if ev := nextEvents(t, live, 1)[0]; ev.LSN != 11 {
+		t.Fatalf("live subscription started at LSN %d", ev.LSN)
+	}
+}
+
+func TestSubscribeSlowConsumerPinsLog(t *testing.T) {
+	kv := openCheckpointKV(t, t.TempDir(), &Options{SegmentBytes: 200, CheckpointsKept: 1, CheckpointWALBytes: -1})
+	defer kv.Close()
+	sub, err := kv.Subscribe(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// far more than the buffer holds: writers must not wait for the consumer
+	n := 3 * subscriptionBuffer
+	for i := 0; i < n; i++ {
+		if err := kv.Set([]byte(fmt.Sprint(i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := kv.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	evs := nextEvents(t, sub, n)
+	if last := evs[n-1].LSN; last != uint64(n) {
+		t.Fatalf("last event LSN %d", last)
+	}
+
+	// once the subscription is gone the checkpoint may retire its segments
+	sub.Close()
+	for range sub.Events() {
+	}
+	kv.Set([]byte("x"), []byte("v"))
+	kv.Checkpoint()
+	if _, err := kv.Subscribe(1); !errors.Is(err, ErrChangesUnavailable) {
+		t.Fatalf("Subscribe(1) after retirement = %v", err)
+	}
+}
+
+func TestSubscribeEnds(t *testing.T) {
+	kv := openCheckpointKV(t, t.TempDir(), nil)
+	sub, _ := kv.Subscribe(0)
+	kv.Clear()
+	for range sub.Events() {
+	}
+	if !errors.Is(sub.Err(), ErrChangesUnavailable) {
+		t.Fatalf("Err after Clear = %v", sub.Err())
+	}
+
+	sub, _ = kv.Subscribe(0)
+	kv.Close()
+	for range sub.Events() {
+	}
+	if sub.Err() != ErrClosed {
+		t.Fatalf("Err after store Close = %v", sub.Err())
+	}
+	if _, err := kv.Subscribe(0); err != ErrClosed {
+		t.Fatalf("Subscribe after Close = %v", err)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"sort"
+)
+
+// --- Transactions ---
+//
+// Begin returns a Tx that buffers its writes privately: they are visible
+// through the Tx alone until Commit logs them as a single TXN record, so
+// any number of goroutines can run transactions side by side while plain
+// Set, Get and Del on the store go on unaffected. A Tx reads a snapshot of
+// the store taken at Begin (see mvcc.go), and holds it, with the old
+// versions it needs, until Commit or Rollback. A Tx itself is meant for one
+// goroutine at a time.
+//
+// Concurrency control is optimistic: a Tx remembers the keys it reads and
+// the ranges it scans, and Commit fails with ErrConflict if any of them, or
+// any key it writes, was committed by someone else after its snapshot. The
+// versions kept for the snapshot record exactly those commits. Transactions
+// that commit are therefore serializable in commit order; a read-only Tx
+// reads a consistent snapshot and never conflicts.
+
+// ErrTxDone is returned by operations on a Tx after Commit or Rollback.
+var ErrTxDone = errors.New("godb: transaction has already been committed or rolled back")
+
+// ErrConflict is returned by Commit when a concurrent commit changed what
+// the transaction read or writes. Nothing was written; retry the whole
+// transaction with a new Begin.
+var ErrConflict = errors.New("godb: transaction conflicts with a concurrent commit")
+
+// Tx is a transaction begun with Begin.
+type Tx struct {
+	kv     *UltraKV
+	id     uint64             // Begin order
+	snap   uint64             // LSN of the last commit it reads
+	writes map[string]*string // nil means delete
+	reads  map[string]uint64  // the LSN each key was read as of
+	ranges []keyRange         // scanned
+	locks  map[string]heldLock
+	done   bool
+}
+
+// keyRange is the keys from start up to, not including, end; an empty end
+// means no upper bound.
+type keyRange struct {
+	start, end string
+}
+
+// Begin starts a transaction reading the store as of now. It must end with
+// Commit or Rollback.
+func (kv *UltraKV) Begin() *Tx {
+	return &Tx{
+		kv:     kv,
+		id:     kv.txSeq.Add(1),
+		snap:   kv.acquireSnapshot(),
+		writes: make(map[string]*string),
+		reads:  make(map[string]uint64),
+		locks:  make(map[string]heldLock),
+	}
+}
+
+// Set stores value under key when the transaction commits.
+func (tx *Tx) Set(key, value []byte) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	v := string(value)
+	tx.writes[string(key)] = &v
+	return nil
+}
+
+// Del removes key when the transaction commits.
+func (tx *Tx) Del(key []byte) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.writes[string(key)] = nil
+	return nil
+}
+
+// Get returns the value of key as the transaction sees it: its own writes
+// over its snapshot. After Commit or Rollback it reads the latest value.
+func (tx *Tx) Get(key []byte) ([]byte, bool) {
+	if tx.done {
+		return tx.kv.Get(key)
+	}
+	if v, ok := tx.writes[string(key)]; ok {
+		if v == nil {
+			return nil, false
+		}
+		return []byte(*v), true
+	}
+	ts := tx.since(string(key))
+	if _, ok := tx.reads[string(key)]; !ok {
+		tx.reads[string(key)] = ts
+	}
+	v, ok := tx.kv.getAt(string(key), ts)
+	if !ok {
+		return nil, false
+	}
+	return []byte(v), true
+}
+
+// Scan is UltraKV.Scan as the transaction sees it, like Get.
+func (tx *Tx) Scan(start, end []byte, limit int) []Entry {
+	if tx.done {
+		return tx.kv.Scan(start, end, limit)
+	}
+	entries := tx.kv.scan(string(start), string(end), limit, tx)
+	r := keyRange{string(start), string(end)}
+	if limit > 0 && len(entries) == limit {
+		// the keys past the last one returned were not looked at
+		r.end = string(entries[len(entries)-1].Key) + "\x00"
+	}
+	tx.ranges = append(tx.ranges, r)
+	return entries
+}
+
+// ScanPrefix is UltraKV.ScanPrefix as the transaction sees it, like Scan.
+func (tx *Tx) ScanPrefix(prefix []byte, limit int) []Entry {
+	return tx.Scan(prefix, []byte(prefixEnd(string(prefix))), limit)
+}
+
+// Keys is UltraKV.Keys as the transaction sees it, like Scan.
+func (tx *Tx) Keys(pattern string) [][]byte {
+	return matchKeys(tx.ScanPrefix([]byte(globPrefix(pattern)), 0), pattern)
+}
+
+// Commit applies the transaction's writes and acknowledges them together
+// like Set, or returns ErrConflict (see above). Either way the transaction
+// is over.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	keys := make([]string, 0, len(tx.writes))
+	for k := range tx.writes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	// wait for the transactions holding locks on the keys written
+	for _, k := range keys {
+		if err := tx.lock(k, lockExclusive, false); err != nil {
+			return err
+		}
+	}
+	tx.done = true
+	kv := tx.kv
+	defer tx.end()
+	if len(keys) == 0 {
+		return nil
+	}
+	ops := make([]WriteOp, len(keys))
+	recs := make([]walRecord, len(keys))
+	for i, k := range keys {
+		if v := tx.writes[k]; v != nil {
+			ops[i] = WriteOp{OpType: "set", Key: k, Value: *v}
+			recs[i] = walRecord{op: "SET", key: k, value: *v}
+		} else {
+			ops[i] = WriteOp{OpType: "del", Key: k}
+			recs[i] = walRecord{op: "DEL", key: k}
+		}
+	}
+
+	// the whole transaction is one WAL record, so recovery applies all of
+	// it or none of it
+	lsn, err := kv.logAndQueue(tx.validate, "TXN", "", encodeTxnOps(recs), ops...)
+	if err != nil {
+		return err
+	}
+	select {
+	case kv.flushCh <- struct{}{}: // force flush
+	default:
+	}
+	return kv.waitDurable(lsn)
+}
+
+// Rollback discards the transaction's writes. It is a no-op after Commit,
+// so it can be deferred.
+func (tx *Tx) Rollback() {
+	if tx.done {
+		return
+	}
+	tx.done = true
+	tx.writes = nil
+	tx.end()
+}
+
+// end releases the transaction's locks and snapshot.
+func (tx *Tx) end() {
+	tx.kv.keyLocks.release(tx, tx.locks)
+	tx.kv.releaseSnapshot(tx.snap)
+}
+
+// since returns the LSN key is read as of: the snapshot, or the commit
+// visible when an explicit lock on it was granted.
+func (tx *Tx) since(key string) uint64 {
+	if l, ok := tx.locks[key]; ok {
+		return l.at
+	}
+	return tx.snap
+}
+
+// validate returns ErrConflict if a key the transaction read, scanned or
+// writes has a version newer than it was read as of. It runs inside
+// logAndQueue, so no commit lands between it and the transaction's own.
+func (tx *Tx) validate() error {
+	kv := tx.kv
+	kv.cacheLock.RLock()
+	defer kv.cacheLock.RUnlock()
+	changed := func(key string, since uint64) bool {
+		h := kv.versions[key]
+		return len(h) > 0 && h[len(h)-1].lsn > since
+	}
+	for k, ts := range tx.reads {
+		if changed(k, ts) {
+			return ErrConflict
+		}
+	}
+	for k := range tx.writes {
+		if changed(k, tx.since(k)) {
+			return ErrConflict
+		}
+	}
+	if len(tx.ranges) == 0 {
+		return nil
+	}
+	for k := range kv.versions {
+		if !changed(k, tx.snap) {
+			continue
+		}
+		for _, r := range tx.ranges {
+			if inRange(k, r.start, r.end) {
+				return ErrConflict
+			}
+		}
+	}
+	return nil
+}
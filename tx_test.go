@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestTxIsolatedFromStore(t *testing.T) {
+	kv := openTestKV(t)
+	kv.Set([]byte("a"), []byte("1"))
+	tx := kv.Begin()
+	tx.Set([]byte("a"), []byte("tx"))
+	tx.Del([]byte("missing"))
+
+	// plain operations bypass the open transaction
+	kv.Set([]byte("b"), []byte("2"))
+	if v, _ := kv.Get([]byte("a")); string(v) != "1" {
+		t.Fatalf("store sees uncommitted write: %q", v)
+	}
+	if v, _ := tx.Get([]byte("a")); string(v) != "tx" {
+		t.Fatalf("tx.Get(a) = %q", v)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := kv.Get([]byte("a")); string(v) != "tx" {
+		t.Fatalf("Get(a) after Commit = %q", v)
+	}
+	if v, _ := tx.Get([]byte("b")); string(v) != "2" {
+		t.Fatalf("tx.Get(b) after Commit = %q, want the latest value", v)
+	}
+
+	if err := tx.Set([]byte("c"), []byte("3")); err != ErrTxDone {
+		t.Fatalf("Set after Commit = %v", err)
+	}
+	if err := tx.Commit(); err != ErrTxDone {
+		t.Fatalf("second Commit = %v", err)
+	}
+	tx.Rollback() // harmless after Commit
+
+	tx = kv.Begin()
+	tx.Del([]byte("a"))
+	tx.Rollback()
+	if err := tx.Commit(); err != ErrTxDone {
+		t.Fatalf("Commit after Rollback = %v", err)
+	}
+	if v, _ := kv.Get([]byte("a")); string(v) != "tx" {
+		t.Fatalf("Get(a) after Rollback = %q", v)
+	}
+}
+
+func TestConcurrentTransactions(t *testing.T) {
+	kv := openTestKV(t)
+	const workers, keys = 8, 20
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			tx := kv.Begin()
+			for i := 0; i < keys; i++ {
+				tx.Set([]byte(fmt.Sprintf("w%d-%02d", w, i)), []byte("v"))
+			}
+			kv.Set([]byte(fmt.Sprintf("plain%d", w)), []byte("v"))
+			if w%2 == 1 {
+				tx.Rollback()
+				return
+			}
+			if err := tx.Commit(); err != nil {
+				t.Error(err)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if n := kv.Count(); n != workers/2*keys+workers {
+		t.Fatalf("Count = %d, want %d", n, workers/2*keys+workers)
+	}
+	if got := kv.ScanPrefix([]byte("w1-"), 0); len(got) != 0 {
+		t.Fatalf("rolled back writes visible: %v", scanKeys(got))
+	}
+}
+
+func TestTxConflicts(t *testing.T) {
+	kv := openTestKV(t)
+	kv.Set([]byte("n"), []byte("0"))
+	kv.Set([]byte("user:1"), []byte("v"))
+
+	// lost update: both read n, the second to commit must fail
+	t1, t2 := kv.Begin(), kv.Begin()
+	t1.Get([]byte("n"))
+	t2.Get([]byte("n"))
+	t1.Set([]byte("n"), []byte("1"))
+	t2.Set([]byte("n"), []byte("1"))
+	if err := t1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := t2.Commit(); err != ErrConflict {
+		t.Fatalf("second Commit = %v, want ErrConflict", err)
+	}
+	if err := t2.Set([]byte("x"), nil); err != ErrTxDone {
+		t.Fatalf("Set after a conflict = %v", err)
+	}
+
+	// a blind write over a newer commit
+	tx := kv.Begin()
+	tx.Set([]byte("n"), []byte("9"))
+	kv.Set([]byte("n"), []byte("2"))
+	if err := tx.Commit(); err != ErrConflict {
+		t.Fatalf("blind write Commit = %v", err)
+	}
+
+	// a key inserted into a scanned range
+	tx = kv.Begin()
+	tx.Scan([]byte("user:"), []byte("user;"), 0)
+	tx.Set([]byte("users"), []byte("1"))
+	kv.Set([]byte("user:2"), []byte("v"))
+	if err := tx.Commit(); err != ErrConflict {
+		t.Fatalf("Commit after a phantom = %v", err)
+	}
+
+	// writes outside everything the transaction looked at
+	tx = kv.Begin()
+	tx.Scan([]byte("user:"), nil, 1)
+	tx.Get([]byte("n"))
+	tx.Set([]byte("m"), []byte("1"))
+	kv.Set([]byte("user:3"), []byte("v"))
+	kv.Set([]byte("other"), []byte("v"))
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit = %v", err)
+	}
+	if v, _ := kv.Get([]byte("n")); string(v) != "2" {
+		t.Fatalf("n = %q", v)
+	}
+	if st := kv.Stats(); st.Snapshots != 0 || st.Versions != 0 {
+		t.Fatalf("%d snapshots, %d versions left", st.Snapshots, st.Versions)
+	}
+}
+
+func TestTxCounterIsSerializable(t *testing.T) {
+	kv := openTestKV(t)
+	const workers, incs = 8, 25
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < incs; i++ {
+				for {
+					tx := kv.Begin()
+					v, _ := tx.Get([]byte("counter"))
+					n, _ := strconv.Atoi(string(v))
+					tx.Set([]byte("counter"), []byte(strconv.Itoa(n+1)))
+					err := tx.Commit()
+					if err == nil {
+						break
+					}
+					if err != ErrConflict {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if v, _ := kv.Get([]byte("counter")); string(v) != strconv.Itoa(workers*incs) {
+		t.Fatalf("counter = %s, want %d", v, workers*incs)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 )
 
@@ -11,7 +12,44 @@ import (
 func main() {
 	const dbFile = "ultra_interactive.db.btree"
 	const walFile = "ultra_interactive.db.wal"
-	kv, err := NewUltraKV(dbFile, walFile)
+	keys, err := keysFromEnv()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if len(os.Args) > 1 && (os.Args[1] == "wal" || os.Args[1] == "restore" || os.Args[1] == "rekey") {
+		switch os.Args[1] {
+		case "wal":
+			err = runWALTool(os.Args[2:], walFile, keys, os.Stdout)
+		case "restore":
+			err = runRestore(os.Args[2:], dbFile, walFile, keys, os.Stdout)
+		default:
+			err = runRekey(os.Args[2:], dbFile, walFile, keys, os.Stdout)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	opts := Options{EncryptionKeys: keys}
+	if s := os.Getenv("GODB_SYNC"); s != "" {
+		p, err := ParseSyncPolicy(s)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		opts.Sync = p
+	}
+	if s := os.Getenv("GODB_WAL_CODEC"); s != "" {
+		c, err := ParseWALCodec(s)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		opts.WALCodec = c
+	}
+	kv, err := NewUltraKVWithOptions(dbFile, walFile, &opts)
 	if err != nil {
 		fmt.Printf("Failed to open UltraKV: %v\n", err) // [DEBUG]
 		return
@@ -30,8 +68,18 @@ $$ |  $$ |$$ |  $$ |$$ |  $$ |        $$ |  $$ |
                  
                                                 
                                                 `)
-	fmt.Println("UltraKV CLI. Commands: set <k> <v>, get <k>, del <k>, begin, commit, abort, debug, clear, exit") // [DEBUG]
+	fmt.Println("UltraKV CLI. Arguments may be \"quoted\" with Go escapes (\\n, \\t, \\x00). Commands: set <k> <v>, get <k>, del <k>, cas <k> <old> <new>, setnx <k> <v>, setxx <k> <v>, getver <k>, putver <k> <version> <v>, scan <start> [end] [limit], prefix <p> [limit], keys <pattern>, list, stats, checkpoint, mark <name>, begin, commit, abort, debug, clear, exit") // [DEBUG]
 	reader := bufio.NewReader(os.Stdin)
+	// reads and writes go to the open transaction, if any
+	var tx *Tx
+	var rw interface {
+		Set(key, value []byte) error
+		Get(key []byte) ([]byte, bool)
+		Del(key []byte) error
+		Scan(start, end []byte, limit int) []Entry
+		ScanPrefix(prefix []byte, limit int) []Entry
+		Keys(pattern string) [][]byte
+	} = kv
 	for {
 		fmt.Print("> ") // [DEBUG]
 		line, err := reader.ReadString('\n')
@@ -43,7 +91,11 @@ $$ |  $$ |$$ |  $$ |$$ |  $$ |        $$ |  $$ |
 		if line == "" {
 			continue
 		}
-		parts := strings.Fields(line)
+		parts, err := splitArgs(line)
+		if err != nil {
+			fmt.Println("Bad quoting:", err)
+			continue
+		}
 		if len(parts) == 0 {
 			continue
 		}
@@ -53,7 +105,9 @@ $$ |  $$ |$$ |  $$ |$$ |  $$ |        $$ |  $$ |
 				// fmt.Println("Usage: set <key> <value>")
 				continue
 			}
-			kv.Set(parts[1], strings.Join(parts[2:], " "))
+			if err := rw.Set([]byte(parts[1]), []byte(strings.Join(parts[2:], " "))); err != nil {
+				fmt.Println("Set failed:", err)
+			}
 			// Force immediate flush for CLI operations
 			kv.flushCh <- struct{}{}
 		case "get":
@@ -61,7 +115,7 @@ $$ |  $$ |$$ |  $$ |$$ |  $$ |        $$ |  $$ |
 				// fmt.Println("Usage: get <key>")
 				continue
 			}
-			v, ok := kv.Get(parts[1])
+			v, ok := rw.Get([]byte(parts[1]))
 			if ok {
 				fmt.Printf("%q\n", v)
 			} else {
@@ -72,17 +126,159 @@ $$ |  $$ |$$ |  $$ |$$ |  $$ |        $$ |  $$ |
 				// fmt.Println("Usage: del <key>")
 				continue
 			}
-			kv.Del(parts[1])
+			if err := rw.Del([]byte(parts[1])); err != nil {
+				fmt.Println("Del failed:", err)
+			}
+			// Force immediate flush for CLI operations
+			kv.flushCh <- struct{}{}
+		case "cas", "setnx", "setxx", "putver":
+			var applied bool
+			var err error
+			switch {
+			case parts[0] == "cas" && len(parts) == 4:
+				applied, err = kv.CompareAndSwap([]byte(parts[1]), []byte(parts[2]), []byte(parts[3]))
+			case parts[0] == "setnx" && len(parts) >= 3:
+				applied, err = kv.SetIfAbsent([]byte(parts[1]), []byte(strings.Join(parts[2:], " ")))
+			case parts[0] == "setxx" && len(parts) >= 3:
+				applied, err = kv.SetIfExists([]byte(parts[1]), []byte(strings.Join(parts[2:], " ")))
+			case parts[0] == "putver" && len(parts) >= 4:
+				version, perr := strconv.ParseUint(parts[2], 10, 64)
+				if perr != nil {
+					fmt.Println("Usage: putver <key> <version> <value>")
+					continue
+				}
+				applied, err = kv.PutIfVersion([]byte(parts[1]), []byte(strings.Join(parts[3:], " ")), version)
+			default:
+				fmt.Println("Usage: cas <key> <old> <new> | setnx <key> <value> | setxx <key> <value> | putver <key> <version> <value>")
+				continue
+			}
+			if err != nil {
+				fmt.Println("Set failed:", err)
+			} else if applied {
+				fmt.Println("OK")
+			} else {
+				fmt.Println("(not set)")
+			}
 			// Force immediate flush for CLI operations
 			kv.flushCh <- struct{}{}
+		case "getver":
+			if len(parts) != 2 {
+				fmt.Println("Usage: getver <key>")
+				continue
+			}
+			if v, version, ok := kv.GetVersion([]byte(parts[1])); ok {
+				fmt.Printf("%q (version %d)\n", v, version)
+			} else {
+				fmt.Println("(nil)")
+			}
+		case "scan":
+			if len(parts) < 2 || len(parts) > 4 {
+				fmt.Println("Usage: scan <start> [end] [limit]")
+				continue
+			}
+			end, limit := "", 0
+			if len(parts) >= 3 {
+				end = parts[2]
+			}
+			if len(parts) == 4 {
+				n, err := strconv.Atoi(parts[3])
+				if err != nil {
+					fmt.Println("Usage: scan <start> [end] [limit]")
+					continue
+				}
+				limit = n
+			}
+			entries := rw.Scan([]byte(parts[1]), []byte(end), limit)
+			for _, e := range entries {
+				fmt.Printf("%q => %q\n", e.Key, e.Value)
+			}
+			fmt.Printf("(%d entries)\n", len(entries))
+		case "prefix":
+			if len(parts) < 2 || len(parts) > 3 {
+				fmt.Println("Usage: prefix <prefix> [limit]")
+				continue
+			}
+			limit := 0
+			if len(parts) == 3 {
+				n, err := strconv.Atoi(parts[2])
+				if err != nil {
+					fmt.Println("Usage: prefix <prefix> [limit]")
+					continue
+				}
+				limit = n
+			}
+			entries := rw.ScanPrefix([]byte(parts[1]), limit)
+			for _, e := range entries {
+				fmt.Printf("%q => %q\n", e.Key, e.Value)
+			}
+			fmt.Printf("(%d entries)\n", len(entries))
+		case "keys", "list":
+			pattern := "*"
+			if parts[0] == "keys" {
+				if len(parts) != 2 {
+					fmt.Println("Usage: keys <pattern>")
+					continue
+				}
+				pattern = parts[1]
+			}
+			keys := rw.Keys(pattern)
+			for _, k := range keys {
+				fmt.Printf("%q\n", k)
+			}
+			fmt.Printf("(%d keys)\n", len(keys))
 		case "begin":
-			kv.Begin()
+			if tx != nil {
+				fmt.Println("Transaction already in progress")
+				continue
+			}
+			tx = kv.Begin()
+			rw = tx
 		case "commit":
-			kv.Commit()
+			if tx == nil {
+				continue
+			}
+			if err := tx.Commit(); err != nil {
+				fmt.Println("Commit failed:", err)
+			} else {
+				fmt.Println("Transaction committed")
+			}
+			tx, rw = nil, kv
 		case "abort":
-			kv.Abort()
+			if tx != nil {
+				tx.Rollback()
+				tx, rw = nil, kv
+			}
 		case "debug":
 			kv.DebugPrint()
+		case "stats":
+			st := kv.Stats()
+			fmt.Printf("Keys: %d\n", kv.Count())
+			fmt.Printf("Cache entries: %d\n", st.CacheEntries)
+			fmt.Printf("Pending writes: %d\n", st.PendingWrites)
+			fmt.Printf("Open transactions: %d (%d old versions kept)\n", st.Snapshots, st.Versions)
+			fmt.Printf("Reads: %d cache, %d tree, %d missing\n", st.CacheHits, st.TreeHits, st.Misses)
+			fmt.Printf("Cache Hit Rate: %.1f%%\n", 100*st.CacheHitRate())
+			fmt.Printf("WAL LSN: %d (synced to %d, checkpoint at %d)\n", st.LSN, st.SyncedLSN, st.CheckpointLSN)
+			fmt.Printf("WAL fsyncs: %d\n", st.WALSyncs)
+			fmt.Printf("Buffer pool: %d of %d pages used, %d dirty, %d pinned\n", st.Pool.Used, st.Pool.Frames, st.Pool.Dirty, st.Pool.Pinned)
+			fmt.Printf("Page reads: %d hits, %d misses (%.1f%% hit rate), %d evictions, %d write-backs\n",
+				st.Pool.Hits, st.Pool.Misses, 100*st.Pool.HitRate(), st.Pool.Evictions, st.Pool.WriteBacks)
+		case "mark":
+			if len(parts) != 2 {
+				fmt.Println("Usage: mark <name>")
+				continue
+			}
+			if lsn, err := kv.Mark(parts[1]); err != nil {
+				fmt.Println("Mark failed:", err)
+			} else {
+				fmt.Printf("Mark %q at LSN %d\n", parts[1], lsn)
+			}
+		case "checkpoint":
+			if err := kv.Checkpoint(); err != nil {
+				fmt.Println("Checkpoint failed:", err)
+			} else {
+				fmt.Printf("Checkpoint written at LSN %d\n", kv.Stats().CheckpointLSN)
+			}
 		case "exit", "quit":
 			// fmt.Println("Exiting.") // [DEBUG]
 			return
@@ -106,3 +302,32 @@ $$ |  $$ |$$ |  $$ |$$ |  $$ |        $$ |  $$ |
 		}
 	}
 }
+
+// splitArgs splits a command line on whitespace. An argument written as a
+// Go double-quoted string may hold spaces and escapes such as \n, \t and
+// \x00, so any bytes can be typed; results are printed back the same way.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	for {
+		line = strings.TrimLeft(line, " \t\r\n")
+		if line == "" {
+			return args, nil
+		}
+		if line[0] == '"' {
+			quoted, err := strconv.QuotedPrefix(line)
+			if err != nil {
+				return nil, err
+			}
+			arg, _ := strconv.Unquote(quoted)
+			args = append(args, arg)
+			line = line[len(quoted):]
+			continue
+		}
+		end := strings.IndexAny(line, " \t\r\n")
+		if end < 0 {
+			end = len(line)
+		}
+		args = append(args, line[:end])
+		line = line[end:]
+	}
+}
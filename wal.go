@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+)
+
+// --- WAL format ---
+//
+// The log is the magic "GODBWAL4" followed by framed records:
+//
+//   length uint32 | crc32 uint32 | lsn uint64 | time int64 | op byte | uvarint klen | key | value
+//
+// length counts the bytes after the checksum and the checksum covers those
+// same bytes. Every record carries a log sequence number (LSN); they start
+// at 1 and only ever increase. time is when the record was logged, in Unix
+// nanoseconds, and never decreases along the log; point-in-time recovery
+// stops replay by it.
+//
+// A committed transaction is a single TXN record whose value packs all of
+// its operations (see encodeTxnOps), so the checksum covers the whole
+// transaction and recovery applies all of it or, if the frame is torn,
+// none of it.
+//
+// Recovery reads frames up to the end of the file. A frame that runs past
+// the end, a final frame failing its checksum or too short for a record,
+// or zeros from a frame to the end of the file, is a write torn by a crash
+// and the log is truncated before it. Damage anywhere else is
+// reported as a *WALCorruptError instead of being skipped, since dropping a
+// record from the middle of the log would silently lose committed writes.
+//
+// The log is split into segment files; see segments.go. Segments may
+// instead hold compressed blocks of these frames; see walcodec.go.
+//
+// The original tab-separated lines are still read, so the store can replay
+// them once and rewrite them as a checkpoint.
+
+const (
+	walMagic = "GODBWAL4"
+
+	walFrameHeader = 8             // length + crc
+	walMinRecord   = 8 + 8 + 1 + 1 // lsn + time + op + klen
+	maxWALRecord   = 1 << 30
+)
+
+const (
+	walOpSet byte = iota + 1
+	walOpDel
+	walOpCheckpoint
+	walOpTxn
+	walOpMark
+)
+
+var walOpCodes = map[string]byte{
+	"SET":        walOpSet,
+	"DEL":        walOpDel,
+	"CHECKPOINT": walOpCheckpoint,
+	"TXN":        walOpTxn,
+	"MARK":       walOpMark,
+}
+
+var walOpNames = map[byte]string{
+	walOpSet:        "SET",
+	walOpDel:        "DEL",
+	walOpCheckpoint: "CHECKPOINT",
+	walOpTxn:        "TXN",
+	walOpMark:       "MARK",
+}
+
+// ErrWALCorrupt matches every *WALCorruptError with errors.Is.
+var ErrWALCorrupt = errors.New("godb: WAL is corrupt")
+
+// WALCorruptError reports a damaged record that is not a torn tail.
+type WALCorruptError struct {
+	Path    string // segment file, when known
+	Offset  int64  // file offset of the damaged record
+	LastLSN uint64 // last intact record before it
+	Reason  string
+}
+
+func (e *WALCorruptError) Error() string {
+	if e.Path != "" {
+		return fmt.Sprintf("godb: WAL segment %s corrupt at offset %d (after LSN %d): %s", e.Path, e.Offset, e.LastLSN, e.Reason)
+	}
+	return fmt.Sprintf("godb: WAL corrupt at offset %d (after LSN %d): %s", e.Offset, e.LastLSN, e.Reason)
+}
+
+func (e *WALCorruptError) Unwrap() error { return ErrWALCorrupt }
+
+type walRecord struct {
+	lsn            uint64
+	time           int64 // Unix nanoseconds; 0 when the format has none
+	op, key, value string
+
+	off, size int64 // where readWAL found the record in its file
+}
+
+func encodeWALRecord(lsn uint64, time int64, op, key, value string) string {
+	var kl [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(kl[:], uint64(len(key)))
+	size := 8 + 8 + 1 + n + len(key) + len(value)
+	buf := make([]byte, walFrameHeader, walFrameHeader+size)
+	buf = binary.LittleEndian.AppendUint64(buf, lsn)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(time))
+	buf = append(buf, walOpCodes[op])
+	buf = append(buf, kl[:n]...)
+	buf = append(buf, key...)
+	buf = append(buf, value...)
+	binary.LittleEndian.PutUint32(buf[0:], uint32(size))
+	binary.LittleEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(buf[walFrameHeader:]))
+	return string(buf)
+}
+
+// decodeWALRecord decodes a frame's payload.
+func decodeWALRecord(payload []byte) (walRecord, error) {
+	const head = 8 + 8
+	if len(payload) < walMinRecord {
+		return walRecord{}, errors.New("record too short")
+	}
+	rec := walRecord{
+		lsn:  binary.LittleEndian.Uint64(payload),
+		time: int64(binary.LittleEndian.Uint64(payload[8:])),
+	}
+	op, ok := walOpNames[payload[head]]
+	if !ok {
+		return walRecord{}, fmt.Errorf("unknown op %d", payload[head])
+	}
+	rec.op = op
+	klen, n := binary.Uvarint(payload[head+1:])
+	if n <= 0 || klen > uint64(len(payload)-head-1-n) {
+		return walRecord{}, errors.New("bad key length")
+	}
+	body := payload[head+1+n:]
+	rec.key, rec.value = string(body[:klen]), string(body[klen:])
+	return rec, nil
+}
+
+// encodeTxnOps packs a transaction's SET and DEL records into the value of
+// a TXN record: per op, op byte | uvarint klen | key | uvarint vlen | value.
+func encodeTxnOps(ops []walRecord) string {
+	var buf []byte
+	for _, op := range ops {
+		buf = append(buf, walOpCodes[op.op])
+		buf = binary.AppendUvarint(buf, uint64(len(op.key)))
+		buf = append(buf, op.key...)
+		buf = binary.AppendUvarint(buf, uint64(len(op.value)))
+		buf = append(buf, op.value...)
+	}
+	return string(buf)
+}
+
+func decodeTxnOps(data string) ([]walRecord, error) {
+	var ops []walRecord
+	b := []byte(data)
+	field := func() (string, bool) {
+		n, w := binary.Uvarint(b)
+		if w <= 0 || n > uint64(len(b)-w) {
+			return "", false
+		}
+		f := string(b[w : w+int(n)])
+		b = b[w+int(n):]
+		return f, true
+	}
+	for len(b) > 0 {
+		op := walOpNames[b[0]]
+		if op != "SET" && op != "DEL" {
+			return nil, fmt.Errorf("bad op %d in transaction", b[0])
+		}
+		b = b[1:]
+		key, ok := field()
+		if !ok {
+			return nil, errors.New("bad key length in transaction")
+		}
+		value, ok := field()
+		if !ok {
+			return nil, errors.New("bad value length in transaction")
+		}
+		ops = append(ops, walRecord{op: op, key: key, value: value})
+	}
+	return ops, nil
+}
+
+// walOps returns the writes a record makes: itself for SET and DEL, the
+// operations of a TXN, and none for other records. prev is the LSN of the
+// record before it.
+func walOps(r walRecord, prev uint64) ([]walRecord, error) {
+	switch r.op {
+	case "SET", "DEL":
+		return []walRecord{r}, nil
+	case "TXN":
+		return txnOps(r, prev)
+	}
+	return nil, nil
+}
+
+// txnOps decodes a TXN record, reporting a malformed one as corruption at
+// its offset; prev is the LSN of the record before it.
+func txnOps(r walRecord, prev uint64) ([]walRecord, error) {
+	ops, err := decodeTxnOps(r.value)
+	if err != nil {
+		return nil, &WALCorruptError{Offset: r.off, LastLSN: prev, Reason: err.Error()}
+	}
+	return ops, nil
+}
+
+// walScan describes what readWAL found.
+type walScan struct {
+	legacy  bool   // an older format the store must rewrite
+	end     int64  // offset just past the last intact record
+	torn    bool   // the bytes after end are a torn write
+	lastLSN uint64 // 0 when the log holds no records
+	records int
+}
+
+// walHeaderMax is the longest header a log can start with.
+const walHeaderMax = len(walMagicSealed) + 2 + 255
+
+// errTornHeader is framedFormat's report of a header cut short by a crash.
+var errTornHeader = errors.New("torn WAL header")
+
+// readWAL calls fn for each record in r, which holds size bytes, stopping
+// at the first error fn returns. kr decrypts encrypted segments.
+func readWAL(r io.Reader, size int64, kr *keyring, fn func(walRecord) error) (walScan, error) {
+	br := bufio.NewReaderSize(r, 64<<10)
+	head, _ := br.Peek(walHeaderMax)
+	switch {
+	case len(head) < len(walMagic) && strings.HasPrefix(walMagic, string(head)):
+		// empty, or the magic itself was torn
+		return walScan{torn: len(head) > 0}, nil
+	}
+	start, decode, err := framedFormat(head, kr)
+	switch {
+	case err == errTornHeader:
+		return walScan{torn: true}, nil
+	case err != nil:
+		return walScan{}, err
+	case decode == nil:
+		return readLegacyWAL(br, fn)
+	}
+	br.Discard(start)
+	return readFramedWAL(br, size, int64(start), decode, fn)
+}
+
+// readWALFrom is readWAL for a framed log, starting at the frame at offset
+// from instead of the first one.
+func readWALFrom(f io.ReadSeeker, from, size int64, kr *keyring, fn func(walRecord) error) (walScan, error) {
+	head := make([]byte, walHeaderMax)
+	n, _ := io.ReadFull(f, head)
+	start, decode, err := framedFormat(head[:n], kr)
+	if err != nil && err != errTornHeader {
+		return walScan{}, err
+	}
+	if decode == nil || from <= int64(start) {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return walScan{}, err
+		}
+		return readWAL(f, size, kr, fn)
+	}
+	if _, err := f.Seek(from, io.SeekStart); err != nil {
+		return walScan{}, err
+	}
+	return readFramedWAL(bufio.NewReaderSize(f, 64<<10), size, from, decode, fn)
+}
+
+// framedFormat returns the header length of a framed log starting with head
+// and how to decode its frames, or a nil decode for the text formats.
+func framedFormat(head []byte, kr *keyring) (int, func([]byte) ([]walRecord, error), error) {
+	switch {
+	case bytes.HasPrefix(head, []byte(walMagic)):
+		return len(walMagic), frameRecord, nil
+	case bytes.HasPrefix(head, []byte(walMagicBlock)):
+		if len(head) == len(walMagicBlock) {
+			return 0, nil, errTornHeader
+		}
+		codec := WALCodec(head[len(walMagicBlock)])
+		if _, ok := walCodecNames[codec]; !ok || codec == WALCodecNone {
+			return 0, nil, &WALCorruptError{Reason: fmt.Sprintf("unknown WAL codec %d", codec)}
+		}
+		return len(walMagicBlock) + 1, func(payload []byte) ([]walRecord, error) {
+			return decodeWALBlock(codec, payload)
+		}, nil
+	case bytes.HasPrefix(head, []byte(walMagicSealed)):
+		n := len(walMagicSealed)
+		if len(head) < n+2 || len(head) < n+2+int(head[n+1]) {
+			return 0, nil, errTornHeader
+		}
+		codec := WALCodec(head[n])
+		if _, ok := walCodecNames[codec]; !ok {
+			return 0, nil, &WALCorruptError{Reason: fmt.Sprintf("unknown WAL codec %d", codec)}
+		}
+		start := n + 2 + int(head[n+1])
+		aead, err := kr.aead(string(head[n+2 : start]))
+		if err != nil {
+			return 0, nil, err
+		}
+		ad := append([]byte(nil), head[:start]...)
+		return start, func(payload []byte) ([]walRecord, error) {
+			data, err := unseal(aead, payload, ad)
+			if err != nil {
+				return nil, fmt.Errorf("block %v", err)
+			}
+			return decodeWALBlock(codec, data)
+		}, nil
+	}
+	return 0, nil, nil
+}
+
+// frameRecord decodes a frame holding a single record.
+func frameRecord(payload []byte) ([]walRecord, error) {
+	rec, err := decodeWALRecord(payload)
+	if err != nil {
+		return nil, err
+	}
+	return []walRecord{rec}, nil
+}
+
+// readFramedWAL reads the frames from offset start on, using decode to turn
+// each frame's payload into records.
+func readFramedWAL(br *bufio.Reader, size, start int64, decode func([]byte) ([]walRecord, error),
+	fn func(walRecord) error) (walScan, error) {
+	scan := walScan{end: start}
+	var hdr [walFrameHeader]byte
+	var payload []byte
+	for scan.end < size {
+		off := scan.end
+		prev := scan.lastLSN
+		torn := walScan{end: off, torn: true, lastLSN: prev, records: scan.records}
+		corrupt := func(reason string) error {
+			return &WALCorruptError{Offset: off, LastLSN: prev, Reason: reason}
+		}
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			return torn, nil
+		}
+		n := int64(binary.LittleEndian.Uint32(hdr[:]))
+		if n > maxWALRecord || off+walFrameHeader+n > size {
+			return torn, nil
+		}
+		if int64(cap(payload)) < n {
+			payload = make([]byte, n)
+		}
+		payload = payload[:n]
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return torn, nil
+		}
+		final := off+walFrameHeader+n == size
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(hdr[4:]) {
+			if final || zeroTail(br, size-off-walFrameHeader-n, hdr[:], payload) {
+				return torn, nil
+			}
+			return scan, corrupt("checksum mismatch")
+		}
+		recs, err := decode(payload)
+		if err != nil {
+			// a final frame too short for a record, or zeros to the end
+			// (the zero length and checksum of an empty frame agree)
+			if (final && n < walMinRecord) || zeroTail(br, size-off-walFrameHeader-n, hdr[:], payload) {
+				return torn, nil
+			}
+			return scan, corrupt(err.Error())
+		}
+		last := prev
+		for _, rec := range recs {
+			if rec.lsn <= last {
+				return scan, corrupt(fmt.Sprintf("LSN %d does not follow %d", rec.lsn, last))
+			}
+			last = rec.lsn
+		}
+		// a block's records split its size, the remainder going to the last
+		share := (walFrameHeader + n) / int64(len(recs))
+		for i, rec := range recs {
+			rec.off, rec.size = off, share
+			if i == len(recs)-1 {
+				rec.size = walFrameHeader + n - share*int64(len(recs)-1)
+			}
+			if err := fn(rec); err != nil {
+				return scan, err
+			}
+		}
+		scan.end = off + walFrameHeader + n
+		scan.lastLSN = last
+		scan.records += len(recs)
+	}
+	return scan, nil
+}
+
+// zeroTail reports whether the frame bytes read and the next rest bytes
+// in br are all zero: space the file system allocated for a write the
+// crash never filled.
+func zeroTail(br *bufio.Reader, rest int64, read ...[]byte) bool {
+	for _, b := range read {
+		if !allZero(b) {
+			return false
+		}
+	}
+	buf := make([]byte, 32<<10)
+	for rest > 0 {
+		n, err := br.Read(buf[:min(rest, int64(len(buf)))])
+		if !allZero(buf[:n]) {
+			return false
+		}
+		rest -= int64(n)
+		if err != nil {
+			return rest == 0
+		}
+	}
+	return true
+}
+
+func allZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// readLegacyWAL reads the original "OP\tkey[\tvalue]" lines, skipping any
+// it cannot parse as the old replay did.
+func readLegacyWAL(br *bufio.Reader, fn func(walRecord) error) (walScan, error) {
+	scan := walScan{legacy: true}
+	var off int64
+	for {
+		line, err := br.ReadBytes('\n')
+		start, size := off, int64(len(line))
+		off += size
+		line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+		if len(line) > 0 {
+			parts := strings.SplitN(string(line), "\t", 3)
+			var rec walRecord
+			switch {
+			case parts[0] == "SET" && len(parts) == 3:
+				rec = walRecord{op: "SET", key: parts[1], value: parts[2]}
+			case parts[0] == "DEL" && len(parts) == 2:
+				rec = walRecord{op: "DEL", key: parts[1]}
+			}
+			if rec.op != "" {
+				scan.lastLSN++
+				rec.lsn, rec.off, rec.size = scan.lastLSN, start, size
+				if err := fn(rec); err != nil {
+					return scan, err
+				}
+				scan.records++
+			}
+		}
+		if err != nil {
+			return scan, nil
+		}
+	}
+}
+
+// openWAL opens the log for appending, starting a new one with header.
+func openWAL(path, header string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if st.Size() == 0 {
+		if _, err := f.WriteString(header); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
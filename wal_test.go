@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestWAL creates a store with n keys and returns its paths, the path
+// of its one WAL segment and the segment's size before and after the last
+// record. The store has no page file, so reopening it replays the WAL.
+func writeTestWAL(t *testing.T, n int) (dbPath, walPath, segPath string, lastStart, size int64) {
+	t.Helper()
+	dir := t.TempDir()
+	dbPath, walPath = filepath.Join(dir, "test.db"), filepath.Join(dir, "test.db.wal")
+	kv, err := NewUltraKV(dbPath, walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		kv.Set([]byte(fmt.Sprintf("k%03d", i)), []byte(fmt.Sprint(i)))
+	}
+	kv.Close()
+	removePages(dbPath)
+	segPath = kv.segmentPath(1)
+	st, err := os.Stat(segPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := encodeWALRecord(uint64(n), 0, "SET", fmt.Sprintf("k%03d", n-1), fmt.Sprint(n-1))
+	return dbPath, walPath, segPath, st.Size() - int64(len(last)), st.Size()
+}
+
+// walRecords reads every segment of the WAL at walPath.
+func walRecords(t *testing.T, walPath string) []walRecord {
+	t.Helper()
+	var recs []walRecord
+	if _, _, err := readSegments(walPath, nil, func(r walRecord) error {
+		recs = append(recs, r)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return recs
+}
+
+func walLSNs(t *testing.T, walPath string) []uint64 {
+	t.Helper()
+	var lsns []uint64
+	for _, r := range walRecords(t, walPath) {
+		lsns = append(lsns, r.lsn)
+	}
+	return lsns
+}
+
+func TestWALTornTailIsTruncated(t *testing.T) {
+	for _, cut := range []int64{1, 4, walFrameHeader, walFrameHeader + 3} {
+		dbPath, walPath, segPath, lastStart, size := writeTestWAL(t, 20)
+		if err := os.Truncate(segPath, size-cut); err != nil {
+			t.Fatal(err)
+		}
+		kv, err := NewUltraKV(dbPath, walPath)
+		if err != nil {
+			t.Fatalf("cut %d: open: %v", cut, err)
+		}
+		if st, _ := os.Stat(segPath); st.Size() != lastStart {
+			t.Fatalf("cut %d: WAL is %d bytes, want %d", cut, st.Size(), lastStart)
+		}
+		if _, ok := kv.Get([]byte("k019")); ok {
+			t.Fatalf("cut %d: torn record was applied", cut)
+		}
+		if v, ok := kv.Get([]byte("k018")); !ok || string(v) != "18" {
+			t.Fatalf("cut %d: Get(k018) = %q, %v", cut, v, ok)
+		}
+		// the log keeps going from the last intact LSN
+		kv.Set([]byte("after"), []byte("x"))
+		kv.Close()
+		if lsns := walLSNs(t, walPath); len(lsns) != 20 || lsns[19] != 20 {
+			t.Fatalf("cut %d: LSNs after reopen = %v", cut, lsns)
+		}
+	}
+}
+
+func TestWALFlippedBitInLastRecordIsTorn(t *testing.T) {
+	dbPath, walPath, segPath, _, size := writeTestWAL(t, 10)
+	data, _ := os.ReadFile(segPath)
+	data[size-2] ^= 1
+	os.WriteFile(segPath, data, 0644)
+	kv, err := NewUltraKV(dbPath, walPath)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer kv.Close()
+	if n := kv.Count(); n != 9 {
+		t.Fatalf("Count = %d, want 9", n)
+	}
+}
+
+func TestWALZeroTailIsTorn(t *testing.T) {
+	// zeros where the file system extended the file, and a short final frame
+	short := frameOf("\x01\x00\x00")
+	for _, tail := range [][]byte{make([]byte, walFrameHeader), make([]byte, 100), short} {
+		dbPath, walPath, segPath, _, size := writeTestWAL(t, 10)
+		f, _ := os.OpenFile(segPath, os.O_APPEND|os.O_WRONLY, 0644)
+		f.Write(tail)
+		f.Close()
+		kv, err := NewUltraKV(dbPath, walPath)
+		if err != nil {
+			t.Fatalf("tail %q: open: %v", tail, err)
+		}
+		if st, _ := os.Stat(segPath); st.Size() != size {
+			t.Fatalf("tail %q: WAL is %d bytes, want %d", tail, st.Size(), size)
+		}
+		if n := kv.Count(); n != 10 {
+			t.Fatalf("tail %q: Count = %d, want 10", tail, n)
+		}
+		kv.Close()
+	}
+}
+
+func TestWALCorruptionMidLogIsReported(t *testing.T) {
+	dbPath, walPath, segPath, _, _ := writeTestWAL(t, 10)
+	data, _ := os.ReadFile(segPath)
+	data[len(walMagic)+walFrameHeader+2] ^= 0x10 // inside the first record
+	os.WriteFile(segPath, data, 0644)
+	_, err := NewUltraKV(dbPath, walPath)
+	var ce *WALCorruptError
+	if !errors.As(err, &ce) || !errors.Is(err, ErrWALCorrupt) {
+		t.Fatalf("open = %v, want a *WALCorruptError", err)
+	}
+	if ce.Path != segPath || ce.Offset != int64(len(walMagic)) || ce.LastLSN != 0 {
+		t.Fatalf("corruption reported in %s at offset %d after LSN %d", ce.Path, ce.Offset, ce.LastLSN)
+	}
+	// the damaged log is left alone for inspection
+	if after, _ := os.ReadFile(segPath); len(after) != len(data) {
+		t.Fatal("corrupt WAL was modified")
+	}
+}
+
+func TestWALTransactionIsAtomic(t *testing.T) {
+	dir := t.TempDir()
+	dbPath, walPath := filepath.Join(dir, "test.db"), filepath.Join(dir, "test.db.wal")
+	kv, err := NewUltraKV(dbPath, walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.Set([]byte("a"), []byte("old"))
+	tx := kv.Begin()
+	tx.Set([]byte("a"), []byte("new"))
+	tx.Set([]byte("b\x00"), []byte("2\n"))
+	tx.Del([]byte("c"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	kv.Close()
+
+	recs := walRecords(t, walPath)
+	if len(recs) != 2 || recs[1].op != "TXN" {
+		t.Fatalf("WAL records %+v, want a SET and one TXN", recs)
+	}
+	ops, err := decodeTxnOps(recs[1].value)
+	if err != nil || len(ops) != 3 {
+		t.Fatalf("TXN holds %+v, %v", ops, err)
+	}
+
+	kv, err = NewUltraKV(dbPath, walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprintf("%q", kv.Scan(nil, nil, 0)); got != `[{"a" "new"} {"b\x00" "2\n"}]` {
+		t.Fatalf("after replay: %s", got)
+	}
+	kv.Close()
+
+	// a crash partway through writing the transaction loses all of it; the
+	// page file would not have been written past the log
+	removePages(dbPath)
+	seg := segmentPath(walPath, 1)
+	st, _ := os.Stat(seg)
+	os.Truncate(seg, st.Size()-3)
+	kv, err = NewUltraKV(dbPath, walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	if got := fmt.Sprintf("%q", kv.Scan(nil, nil, 0)); got != `[{"a" "old"}]` {
+		t.Fatalf("after torn transaction: %s", got)
+	}
+}
+
+// frameOf frames a record payload as readFramedWAL expects.
+func frameOf(payload string) []byte {
+	buf := make([]byte, walFrameHeader, walFrameHeader+len(payload))
+	binary.LittleEndian.PutUint32(buf, uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:], crc32.ChecksumIEEE([]byte(payload)))
+	return append(buf, payload...)
+}
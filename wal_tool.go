@@ -0,0 +1,396 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// --- godb wal ---
+//
+// `godb wal <command> [wal path]` works on the log without opening the
+// store, so it can look at a log that recovery refuses:
+//
+//   dump              print every record with its segment offset and LSN
+//   verify            check checksums, LSN order and record structure
+//   stats             count records by op, distinct keys and dead bytes
+//   repair [-dry-run] cut the log at the first bad record
+//
+// Repair keeps what it cuts: the damaged segment's tail is saved as
+// <segment>.lost and any later segments are renamed to <segment>.lost,
+// names recovery does not read.
+
+const walToolUsage = "usage: godb wal dump|verify|stats|repair [-dry-run] [wal path]"
+
+// runWALTool runs a `godb wal` command; walPath is the default log and keys
+// decrypt it.
+func runWALTool(args []string, walPath string, keys []EncryptionKey, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(walToolUsage)
+	}
+	fs := flag.NewFlagSet("wal "+args[0], flag.ContinueOnError)
+	fs.SetOutput(out)
+	var dryRun *bool
+	if args[0] == "repair" {
+		dryRun = fs.Bool("dry-run", false, "report what would be cut without changing anything")
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		walPath = fs.Arg(0)
+	default:
+		return errors.New(walToolUsage)
+	}
+	kr, err := newKeyring(keys)
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "dump":
+		return walDump(walPath, kr, out)
+	case "verify":
+		return walVerify(walPath, kr, out)
+	case "stats":
+		return walStats(walPath, kr, out)
+	case "repair":
+		return walRepair(walPath, kr, *dryRun, out)
+	}
+	return fmt.Errorf("unknown wal command %q\n%s", args[0], walToolUsage)
+}
+
+// walDump prints each segment's records. It is lenient: damage in one
+// segment is reported and the dump goes on with the next.
+func walDump(walPath string, kr *keyring, out io.Writer) error {
+	segs, err := listSegments(walPath)
+	if err != nil {
+		return err
+	}
+	if len(segs) == 0 {
+		return fmt.Errorf("no WAL segments at %s", walPath)
+	}
+	for _, s := range segs {
+		f, err := os.Open(s.path)
+		if err != nil {
+			return err
+		}
+		st, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		fmt.Fprintf(out, "== %s (%d bytes)\n", s.path, st.Size())
+		scan, err := readWAL(f, st.Size(), kr, func(r walRecord) error {
+			fmt.Fprintf(out, "@%-10d LSN %-8d %s  %s\n", r.off, r.lsn, recordTime(r), describeRecord(r))
+			if r.op == "TXN" {
+				ops, err := decodeTxnOps(r.value)
+				if err != nil {
+					fmt.Fprintf(out, "    malformed transaction: %v\n", err)
+				}
+				for _, op := range ops {
+					fmt.Fprintf(out, "    %s\n", describeRecord(op))
+				}
+			}
+			return nil
+		})
+		f.Close()
+		switch {
+		case err != nil:
+			fmt.Fprintf(out, "!! %v\n", err)
+		case scan.torn:
+			fmt.Fprintf(out, "!! torn tail at offset %d (%d bytes)\n", scan.end, st.Size()-scan.end)
+		}
+	}
+	return nil
+}
+
+func describeRecord(r walRecord) string {
+	switch r.op {
+	case "SET":
+		return fmt.Sprintf("SET %s = %s", clipQuote(r.key), clipQuote(r.value))
+	case "TXN":
+		ops, _ := decodeTxnOps(r.value)
+		return fmt.Sprintf("TXN (%d ops)", len(ops))
+	case "CHECKPOINT":
+		return r.op
+	}
+	return fmt.Sprintf("%s %s", r.op, clipQuote(r.key))
+}
+
+func recordTime(r walRecord) string {
+	if r.time == 0 {
+		return "-" // logged before records carried a time
+	}
+	return time.Unix(0, r.time).UTC().Format("2006-01-02T15:04:05.000000Z")
+}
+
+// clipQuote quotes s, eliding all but its first 48 bytes.
+func clipQuote(s string) string {
+	const max = 48
+	if len(s) <= max {
+		return fmt.Sprintf("%q", s)
+	}
+	return fmt.Sprintf("%q...(%d bytes)", s[:max], len(s))
+}
+
+// walCheck is what a strict read of the whole log found.
+type walCheck struct {
+	segments          []walSegment
+	records           int
+	firstLSN, lastLSN uint64
+	bad               *WALCorruptError // first damaged record
+	tornPath          string           // newest segment, when it ends torn
+	tornAt, tornBytes int64
+}
+
+// checkWAL reads the log as recovery does, also decoding transactions, and
+// calls fn for each intact record.
+func checkWAL(walPath string, kr *keyring, fn func(walRecord)) (walCheck, error) {
+	var c walCheck
+	scan, seg, err := readSegments(walPath, kr, func(r walRecord) error {
+		if r.op == "TXN" {
+			if _, err := txnOps(r, c.lastLSN); err != nil {
+				return err
+			}
+		}
+		if c.records == 0 {
+			c.firstLSN = r.lsn
+		}
+		c.records++
+		c.lastLSN = r.lsn
+		if fn != nil {
+			fn(r)
+		}
+		return nil
+	})
+	var ce *WALCorruptError
+	switch {
+	case errors.As(err, &ce):
+		c.bad = ce
+	case err != nil:
+		return c, err
+	case scan.torn:
+		st, err := os.Stat(seg)
+		if err != nil {
+			return c, err
+		}
+		c.tornPath, c.tornAt, c.tornBytes = seg, scan.end, st.Size()-scan.end
+	}
+	c.segments, err = listSegments(walPath)
+	return c, err
+}
+
+func walVerify(walPath string, kr *keyring, out io.Writer) error {
+	c, err := checkWAL(walPath, kr, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%d segments, %d records, LSN %d..%d\n", len(c.segments), c.records, c.firstLSN, c.lastLSN)
+	if c.tornPath != "" {
+		fmt.Fprintf(out, "torn tail: %d bytes at offset %d of %s (recovery cuts it)\n", c.tornBytes, c.tornAt, c.tornPath)
+	}
+	if c.bad != nil {
+		return c.bad
+	}
+	fmt.Fprintln(out, "OK")
+	return nil
+}
+
+func walStats(walPath string, kr *keyring, out io.Writer) error {
+	type recInfo struct {
+		lsn  uint64
+		size int64
+		keys []string
+	}
+	var recs []recInfo
+	ops := make(map[string]int)
+	txnOpCount := 0
+	lastWrite := make(map[string]uint64)
+	var lastCkpt uint64
+	c, err := checkWAL(walPath, kr, func(r walRecord) {
+		ops[r.op]++
+		info := recInfo{lsn: r.lsn, size: r.size}
+		switch r.op {
+		case "SET", "DEL":
+			info.keys = []string{r.key}
+		case "TXN":
+			tops, _ := decodeTxnOps(r.value)
+			txnOpCount += len(tops)
+			for _, op := range tops {
+				info.keys = append(info.keys, op.key)
+			}
+		case "CHECKPOINT":
+			lastCkpt = r.lsn
+		}
+		for _, k := range info.keys {
+			lastWrite[k] = r.lsn
+		}
+		recs = append(recs, info)
+	})
+	if err != nil {
+		return err
+	}
+
+	var total, dead int64
+	for _, s := range c.segments {
+		if st, err := os.Stat(s.path); err == nil {
+			total += st.Size()
+		}
+	}
+	for _, r := range recs {
+		// recovery skips everything before the last CHECKPOINT record, and
+		// a record is dead once all its keys are written again later
+		superseded := r.lsn < lastCkpt
+		if !superseded && len(r.keys) > 0 {
+			superseded = true
+			for _, k := range r.keys {
+				if lastWrite[k] == r.lsn {
+					superseded = false
+					break
+				}
+			}
+		}
+		if superseded {
+			dead += r.size
+		}
+	}
+	dead += c.tornBytes
+
+	fmt.Fprintf(out, "segments: %d, %d bytes\n", len(c.segments), total)
+	fmt.Fprintf(out, "records: %d (LSN %d..%d)\n", c.records, c.firstLSN, c.lastLSN)
+	names := make([]string, 0, len(ops))
+	for op := range ops {
+		names = append(names, op)
+	}
+	sort.Strings(names)
+	for _, op := range names {
+		if op == "TXN" {
+			fmt.Fprintf(out, "  %-10s %d (%d ops)\n", op, ops[op], txnOpCount)
+		} else {
+			fmt.Fprintf(out, "  %-10s %d\n", op, ops[op])
+		}
+	}
+	fmt.Fprintf(out, "distinct keys: %d\n", len(lastWrite))
+	pct := 0.0
+	if total > 0 {
+		pct = 100 * float64(dead) / float64(total)
+	}
+	fmt.Fprintf(out, "dead bytes: %d (%.1f%%)\n", dead, pct)
+	if c.bad != nil {
+		fmt.Fprintln(out, "stopped at damage; run `godb wal verify` for details")
+		return c.bad
+	}
+	return nil
+}
+
+func walRepair(walPath string, kr *keyring, dryRun bool, out io.Writer) error {
+	c, err := checkWAL(walPath, kr, nil)
+	if err != nil {
+		return err
+	}
+	var cutPath string
+	var cutAt int64
+	lastLSN := c.lastLSN
+	switch {
+	case c.bad != nil:
+		cutPath, cutAt, lastLSN = c.bad.Path, c.bad.Offset, c.bad.LastLSN
+		fmt.Fprintf(out, "first bad record: %v\n", c.bad)
+	case c.tornPath != "":
+		cutPath, cutAt = c.tornPath, c.tornAt
+	default:
+		fmt.Fprintf(out, "WAL is intact (%d records); nothing to repair\n", c.records)
+		return nil
+	}
+	st, err := os.Stat(cutPath)
+	if err != nil {
+		return err
+	}
+	var later []walSegment
+	for i, s := range c.segments {
+		if s.path == cutPath {
+			later = c.segments[i+1:]
+		}
+	}
+
+	verb := "cut"
+	if dryRun {
+		verb = "would cut"
+	}
+	fmt.Fprintf(out, "%s %d bytes at offset %d of %s; the log would end at LSN %d\n",
+		verb, st.Size()-cutAt, cutAt, cutPath, lastLSN)
+	for _, s := range later {
+		n, size := countSegment(s.path, kr)
+		fmt.Fprintf(out, "%s %s: %d records, %d bytes\n", verb, s.path, n, size)
+	}
+	if dryRun {
+		return nil
+	}
+
+	if st.Size() > cutAt {
+		if err := saveTail(cutPath, cutAt, cutPath+".lost"); err != nil {
+			return err
+		}
+	}
+	if err := truncateFile(cutPath, cutAt); err != nil {
+		return err
+	}
+	for _, s := range later {
+		if err := os.Rename(s.path, s.path+".lost"); err != nil {
+			return err
+		}
+	}
+	syncDir(cutPath)
+	fmt.Fprintln(out, "repaired; cut data saved in *.lost files")
+	return nil
+}
+
+// countSegment reports how many records a segment holds, as far as it can
+// be read, and its size.
+func countSegment(path string, kr *keyring) (int, int64) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return 0, 0
+	}
+	n := 0
+	readWAL(f, st.Size(), kr, func(walRecord) error {
+		n++
+		return nil
+	})
+	return n, st.Size()
+}
+
+// saveTail copies the bytes of path from off on into dst.
+func saveTail(path string, off int64, dst string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if _, err := in.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
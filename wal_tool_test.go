@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func runTool(t *testing.T, walPath string, args ...string) (string, error) {
+	t.Helper()
+	var out bytes.Buffer
+	err := runWALTool(args, walPath, nil, &out)
+	return out.String(), err
+}
+
+func TestWALToolDumpVerifyStats(t *testing.T) {
+	dir := t.TempDir()
+	dbPath, walPath := filepath.Join(dir, "test.db"), filepath.Join(dir, "test.db.wal")
+	kv, err := NewUltraKV(dbPath, walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.Set([]byte("a"), []byte("1"))
+	kv.Set([]byte("b"), []byte("2"))
+	tx := kv.Begin()
+	tx.Set([]byte("c"), []byte("3"))
+	tx.Del([]byte("a"))
+	tx.Commit()
+	kv.Set([]byte("b"), []byte("22"))
+	kv.Close()
+
+	out, err := runTool(t, walPath, "dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`@8 `, `Z  TXN (2 ops)`, `    DEL "a"`, `SET "b" = "22"`} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("dump lacks %q:\n%s", want, out)
+		}
+	}
+	if out, err := runTool(t, walPath, "verify"); err != nil || !strings.Contains(out, "4 records, LSN 1..4\nOK") {
+		t.Fatalf("verify = %v:\n%s", err, out)
+	}
+	out, err = runTool(t, walPath, "stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// LSN 1 and 2 are overwritten later
+	dead := fmt.Sprintf("dead bytes: %d ", 2*len(encodeWALRecord(1, 0, "SET", "a", "1")))
+	for _, want := range []string{"SET        3", "TXN        1 (2 ops)", "distinct keys: 3", dead} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("stats lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestWALToolRepair(t *testing.T) {
+	dir := t.TempDir()
+	dbPath, walPath := filepath.Join(dir, "test.db"), filepath.Join(dir, "test.db.wal")
+	kv := openCheckpointKV(t, dir, &Options{SegmentBytes: 200, CheckpointWALBytes: -1})
+	for i := 0; i < 30; i++ {
+		kv.Set([]byte{'k', byte('a' + i)}, []byte("v"))
+	}
+	kv.Close()
+	segs, _ := listSegments(walPath)
+	if len(segs) < 3 {
+		t.Fatalf("want several segments, got %d", len(segs))
+	}
+
+	// damage the third record of the second segment
+	bad := segs[1].path
+	data, _ := os.ReadFile(bad)
+	frame := len(encodeWALRecord(1, 0, "SET", "ka", "v"))
+	off := len(walMagic) + 2*frame
+	data[off+walFrameHeader+3] ^= 0xff
+	os.WriteFile(bad, data, 0644)
+
+	if _, err := NewUltraKV(dbPath, walPath); !errors.Is(err, ErrWALCorrupt) {
+		t.Fatalf("open = %v, want corruption", err)
+	}
+	if _, err := runTool(t, walPath, "verify"); !errors.Is(err, ErrWALCorrupt) {
+		t.Fatalf("verify = %v", err)
+	}
+
+	out, err := runTool(t, walPath, "repair", "-dry-run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "would cut") || !strings.Contains(out, segs[2].path) {
+		t.Fatalf("dry run:\n%s", out)
+	}
+	if after, _ := os.ReadFile(bad); !bytes.Equal(after, data) {
+		t.Fatal("dry run changed the log")
+	}
+
+	if out, err := runTool(t, walPath, "repair"); err != nil {
+		t.Fatalf("repair = %v:\n%s", err, out)
+	}
+	if _, err := os.Stat(bad + ".lost"); err != nil {
+		t.Fatalf("cut tail not saved: %v", err)
+	}
+	if _, err := os.Stat(segs[2].path + ".lost"); err != nil {
+		t.Fatalf("later segment not set aside: %v", err)
+	}
+	if out, err := runTool(t, walPath, "verify"); err != nil {
+		t.Fatalf("verify after repair = %v:\n%s", err, out)
+	}
+
+	// without the page file, which still holds the records cut
+	removePages(filepath.Join(dir, "test.db"))
+	kv = openCheckpointKV(t, dir, nil)
+	defer kv.Close()
+	want := int(segs[1].start - 1 + 2)
+	if n := kv.Count(); n != want {
+		t.Fatalf("Count after repair = %d, want %d", n, want)
+	}
+	if st := kv.Stats(); st.LSN != uint64(want) {
+		t.Fatalf("log resumes after LSN %d, want %d", st.LSN, want)
+	}
+}
+
+func TestWALToolUsage(t *testing.T) {
+	if _, err := runTool(t, "x.wal"); err == nil {
+		t.Fatal("no command accepted")
+	}
+	if _, err := runTool(t, "x.wal", "frobnicate"); err == nil {
+		t.Fatal("unknown command accepted")
+	}
+	if _, err := runTool(t, filepath.Join(t.TempDir(), "none.wal"), "dump"); err == nil {
+		t.Fatal("dump of a missing log succeeded")
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+// --- Compressed WAL blocks ---
+//
+// With a codec other than WALCodecNone, a segment starts with the magic
+// "GODBWAL5" and one byte naming the codec, and each flushed batch is
+// written as a single block:
+//
+//   length uint32 | crc32 uint32 | compressed GODBWAL4 frames
+//
+// The block is framed like a record, so a torn or damaged block is handled
+// as a torn or damaged record is. The frames inside keep their own
+// checksums. Records read from a block all report the block's offset, and
+// share its size between them.
+//
+// The codec is fixed per segment: a store reopened with another codec
+// starts a new segment, so logs written with any codec stay readable.
+// Encrypted segments are written in blocks whatever the codec; see
+// crypt.go.
+
+// WALCodec says how flushed WAL batches are stored.
+type WALCodec byte
+
+const (
+	// WALCodecNone writes each record as its own frame.
+	WALCodecNone WALCodec = iota
+	// WALCodecFlate compresses each batch with DEFLATE (compress/flate).
+	WALCodecFlate
+)
+
+const walMagicBlock = "GODBWAL5"
+
+var walCodecNames = map[WALCodec]string{
+	WALCodecNone:  "none",
+	WALCodecFlate: "flate",
+}
+
+func (c WALCodec) String() string {
+	if s, ok := walCodecNames[c]; ok {
+		return s
+	}
+	return fmt.Sprintf("WALCodec(%d)", int(c))
+}
+
+// ParseWALCodec parses a codec name as printed by String.
+func ParseWALCodec(s string) (WALCodec, error) {
+	for c, name := range walCodecNames {
+		if strings.EqualFold(s, name) {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown WAL codec %q (want none or flate)", s)
+}
+
+// walHeader is what a new segment written with codec, encrypted under kr's
+// write key if there is one, starts with.
+func walHeader(codec WALCodec, kr *keyring) string {
+	switch {
+	case kr != nil:
+		return kr.header(walMagicSealed + string(byte(codec)))
+	case codec == WALCodecNone:
+		return walMagic
+	}
+	return walMagicBlock + string(byte(codec))
+}
+
+// walBlockEncoder turns batches of frames into blocks, reusing its
+// compressor between them.
+type walBlockEncoder struct {
+	codec WALCodec
+	aead  cipher.AEAD // nil for plaintext
+	ad    []byte      // the segment header, authenticated with each block
+	buf   bytes.Buffer
+	fw    *flate.Writer
+}
+
+// newWALBlockEncoder returns the encoder for segments with header, or nil
+// when they hold plain frames.
+func newWALBlockEncoder(codec WALCodec, kr *keyring, header string) (*walBlockEncoder, error) {
+	if codec == WALCodecNone && kr == nil {
+		return nil, nil
+	}
+	e := &walBlockEncoder{codec: codec, ad: []byte(header)}
+	if kr != nil {
+		aead, err := kr.aead(kr.writeID)
+		if err != nil {
+			return nil, err
+		}
+		e.aead = aead
+	}
+	return e, nil
+}
+
+// encode returns the block holding entries' frames.
+func (e *walBlockEncoder) encode(entries []walEntry) string {
+	e.buf.Reset()
+	var w io.Writer = &e.buf
+	if e.codec == WALCodecFlate {
+		if e.fw == nil {
+			// BestSpeed: the block is compressed while writers wait on it
+			e.fw, _ = flate.NewWriter(&e.buf, flate.BestSpeed)
+		} else {
+			e.fw.Reset(&e.buf)
+		}
+		w = e.fw
+	}
+	for _, entry := range entries {
+		io.WriteString(w, entry.frame)
+	}
+	if e.fw != nil {
+		e.fw.Close()
+	}
+	payload := e.buf.Bytes()
+	if e.aead != nil {
+		payload = seal(e.aead, payload, e.ad)
+	}
+	return walFrame(payload)
+}
+
+// walFrame frames payload: length | crc32 | payload.
+func walFrame(payload []byte) string {
+	buf := make([]byte, walFrameHeader, walFrameHeader+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(payload))
+	return string(append(buf, payload...))
+}
+
+// decodeWALBlock decodes the frames in a block's (decrypted) payload.
+func decodeWALBlock(codec WALCodec, payload []byte) ([]walRecord, error) {
+	data := payload
+	switch codec {
+	case WALCodecNone:
+	case WALCodecFlate:
+		fr := flate.NewReader(bytes.NewReader(payload))
+		var err error
+		data, err = io.ReadAll(io.LimitReader(fr, maxWALRecord+1))
+		fr.Close()
+		if err != nil {
+			return nil, fmt.Errorf("bad compressed block: %v", err)
+		}
+		if len(data) > maxWALRecord {
+			return nil, errors.New("compressed block too large")
+		}
+	default:
+		return nil, fmt.Errorf("unknown WAL codec %d", codec)
+	}
+	var recs []walRecord
+	for len(data) > 0 {
+		if len(data) < walFrameHeader {
+			return nil, errors.New("partial record in block")
+		}
+		n := int(binary.LittleEndian.Uint32(data))
+		if n > len(data)-walFrameHeader {
+			return nil, errors.New("partial record in block")
+		}
+		frame := data[walFrameHeader : walFrameHeader+n]
+		if crc32.ChecksumIEEE(frame) != binary.LittleEndian.Uint32(data[4:]) {
+			return nil, fmt.Errorf("checksum mismatch in record %d of block", len(recs)+1)
+		}
+		rec, err := decodeWALRecord(frame)
+		if err != nil {
+			return nil, fmt.Errorf("record %d of block: %v", len(recs)+1, err)
+		}
+		recs = append(recs, rec)
+		data = data[walFrameHeader+n:]
+	}
+	if len(recs) == 0 {
+		return nil, errors.New("empty block")
+	}
+	return recs, nil
+}
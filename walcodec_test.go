@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func segmentBytes(t *testing.T, walPath string) int64 {
+	t.Helper()
+	segs, err := listSegments(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	for _, s := range segs {
+		st, err := os.Stat(s.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += st.Size()
+	}
+	return total
+}
+
+func jsonValue(i int) []byte {
+	return []byte(fmt.Sprintf(`{"id":%d,"name":"user %d","email":"user%d@example.com","active":true,"roles":["reader","writer"]}`, i, i, i))
+}
+
+func TestWALFlateBlocks(t *testing.T) {
+	sizes := map[WALCodec]int64{}
+	for _, codec := range []WALCodec{WALCodecNone, WALCodecFlate} {
+		dir := t.TempDir()
+		opts := &Options{WALCodec: codec, Sync: SyncNone, CheckpointWALBytes: -1}
+		kv := openCheckpointKV(t, dir, opts)
+		for i := 0; i < 2000; i++ {
+			kv.Set([]byte(fmt.Sprintf("user:%05d", i)), jsonValue(i))
+		}
+		tx := kv.Begin()
+		tx.Set([]byte("txn"), []byte("1"))
+		tx.Del([]byte("user:00000"))
+		tx.Commit()
+		kv.Close()
+		sizes[codec] = segmentBytes(t, kv.walPath)
+
+		kv = openCheckpointKV(t, dir, opts)
+		if n := kv.Count(); n != 2000 {
+			t.Fatalf("%v: Count after replay = %d", codec, n)
+		}
+		if v, _ := kv.Get([]byte("user:01234")); string(v) != string(jsonValue(1234)) {
+			t.Fatalf("%v: Get = %q", codec, v)
+		}
+		if _, ok := kv.Get([]byte("user:00000")); ok {
+			t.Fatalf("%v: transaction delete lost", codec)
+		}
+		kv.Close()
+	}
+	if sizes[WALCodecFlate]*3 > sizes[WALCodecNone] {
+		t.Fatalf("flate log is %d bytes, uncompressed %d", sizes[WALCodecFlate], sizes[WALCodecNone])
+	}
+}
+
+func TestWALCodecSwitchStartsNewSegment(t *testing.T) {
+	dir := t.TempDir()
+	for i, codec := range []WALCodec{WALCodecNone, WALCodecFlate, WALCodecNone} {
+		kv := openCheckpointKV(t, dir, &Options{WALCodec: codec, CheckpointWALBytes: -1})
+		kv.Set([]byte(fmt.Sprint(i)), []byte("v"))
+		kv.Close()
+	}
+	segs, _ := listSegments(filepath.Join(dir, "test.db.wal"))
+	if len(segs) != 3 {
+		t.Fatalf("got %d segments, want one per codec switch", len(segs))
+	}
+	head := make([]byte, len(walMagicBlock)+1)
+	f, _ := os.Open(segs[1].path)
+	f.Read(head)
+	f.Close()
+	if string(head) != walHeader(WALCodecFlate, nil) {
+		t.Fatalf("flate segment starts %q", head)
+	}
+	if lsns := walLSNs(t, filepath.Join(dir, "test.db.wal")); fmt.Sprint(lsns) != "[1 2 3]" {
+		t.Fatalf("LSNs %v", lsns)
+	}
+	if _, err := NewUltraKVWithOptions(filepath.Join(dir, "test.db"), filepath.Join(dir, "test.db.wal"),
+		&Options{WALCodec: 9}); err == nil {
+		t.Fatal("unknown codec accepted")
+	}
+}
+
+// writeBlocks writes three flushed batches of keys to a flate log and
+// returns its store and the records read back.
+func writeBlocks(t *testing.T, dir string) (*UltraKV, []walRecord) {
+	t.Helper()
+	kv := openCheckpointKV(t, dir, &Options{WALCodec: WALCodecFlate, Sync: SyncNone, CheckpointWALBytes: -1})
+	for b := 0; b < 3; b++ {
+		for i := 0; i < 10; i++ {
+			kv.Set([]byte(fmt.Sprintf("b%d-%d", b, i)), []byte("v"))
+		}
+		kv.flushWALBuffer()
+	}
+	kv.Close()
+	return kv, walRecords(t, kv.walPath)
+}
+
+func TestWALTornBlockIsTruncated(t *testing.T) {
+	dir := t.TempDir()
+	kv, recs := writeBlocks(t, dir)
+	last := recs[len(recs)-1].off
+	kept := 0
+	for _, r := range recs {
+		if r.off < last {
+			kept++
+		}
+	}
+	seg := kv.segmentPath(1)
+	st, _ := os.Stat(seg)
+	os.Truncate(seg, st.Size()-3)
+	// the page file would not have got past the log either
+	removePages(kv.btreePath)
+
+	kv = openCheckpointKV(t, dir, nil)
+	defer kv.Close()
+	if n := kv.Count(); n != kept || kept == 0 {
+		t.Fatalf("Count = %d, want the %d records before the torn block", n, kept)
+	}
+	if st, _ := os.Stat(seg); st.Size() != last {
+		t.Fatalf("segment is %d bytes, want it cut at %d", st.Size(), last)
+	}
+}
+
+func TestWALCorruptBlockIsReported(t *testing.T) {
+	dir := t.TempDir()
+	kv, recs := writeBlocks(t, dir)
+	first := recs[0].off
+	seg := kv.segmentPath(1)
+	data, _ := os.ReadFile(seg)
+	data[first+walFrameHeader+2] ^= 0x10
+	os.WriteFile(seg, data, 0644)
+
+	_, err := NewUltraKVWithOptions(kv.btreePath, kv.walPath, nil)
+	var ce *WALCorruptError
+	if !errors.As(err, &ce) {
+		t.Fatalf("open = %v, want corruption", err)
+	}
+	if ce.Offset != first || ce.LastLSN != 0 {
+		t.Fatalf("corruption at %d after LSN %d, want %d after 0", ce.Offset, ce.LastLSN, first)
+	}
+}